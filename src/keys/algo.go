@@ -0,0 +1,153 @@
+package keys
+
+// key algorithms, signing keys are ed25519 or rsa and every
+// key carries a curve25519 box key for encrypting to it
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	AlgEd25519 = "ed25519"
+	AlgRSA     = "rsa" // also keys from before the algorithm field
+
+	DefaultAlgorithm = AlgEd25519
+	MinRSASize       = 1024 // legacy keys, rotate them away
+	MaxRSASize       = 8192
+	BoxKeySize       = 32
+)
+
+var (
+	ErrBadAlgorithm = errors.New("Unknown key algorithm")
+	ErrAlgMismatch  = errors.New("Key does not match its algorithm")
+	ErrWeakKey      = errors.New("Key size out of range")
+	ErrBadBoxKey    = errors.New("Bad box key")
+	ErrVerify       = errors.New("Signature verification failed")
+)
+
+// algorithm names the signing algorithm, an empty name is a legacy rsa key
+func algorithm(name string) string {
+	if name == "" {
+		return AlgRSA
+	}
+	return name
+}
+
+// generateKey makes a signing key pair for the algorithm
+func generateKey(alg string) (priv crypto.Signer, err error) {
+	switch alg {
+	case AlgEd25519:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRSA:
+		priv, err = rsa.GenerateKey(rand.Reader, KeySize)
+	default:
+		return nil, ErrBadAlgorithm
+	}
+	return priv, err
+}
+
+// privatePem encodes a private key, rsa keeps the old PKCS1 block
+func privatePem(priv crypto.Signer, head map[string]string) (data string, err error) {
+	block := &pem.Block{Headers: head}
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		block.Type = "RSA PRIVATE KEY"
+		block.Bytes = x509.MarshalPKCS1PrivateKey(k)
+	default:
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// keyAlgorithm : the algorithm name of a public key
+func keyAlgorithm(pub crypto.PublicKey) (alg string, err error) {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return AlgEd25519, nil
+	case *rsa.PublicKey:
+		if k.N.BitLen() < MinRSASize || k.N.BitLen() > MaxRSASize {
+			return "", ErrWeakKey
+		}
+		return AlgRSA, nil
+	}
+	return "", ErrBadAlgorithm
+}
+
+// sign data, rsa is PSS over SHA256 and ed25519 signs the raw data
+func sign(priv crypto.Signer, data []byte) (signature string, err error) {
+	var sig []byte
+	switch k := priv.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, data)
+	case *rsa.PrivateKey:
+		hashed := sha256.Sum256(data)
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}
+		sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, hashed[:], opts)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", ErrBadAlgorithm
+	}
+	return hex.EncodeToString(sig), nil
+}
+
+// verify a hex signature, the key must be of the named algorithm
+func verify(pub crypto.PublicKey, alg string, data []byte, sig string) (err error) {
+	signature, err := hex.DecodeString(sig)
+	if err != nil {
+		return err
+	}
+	have, err := keyAlgorithm(pub)
+	if err != nil {
+		return err
+	}
+	if have != algorithm(alg) {
+		return ErrAlgMismatch
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, signature) {
+			return ErrVerify
+		}
+		return nil
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256(data)
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}
+		return rsa.VerifyPSS(k, crypto.SHA256, hashed[:], signature, opts)
+	}
+	return ErrBadAlgorithm
+}
+
+// newBoxKeys : a curve25519 key pair, hex encoded
+func newBoxKeys() (public, private string, err error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(pub[:]), hex.EncodeToString(priv[:]), nil
+}
+
+// decodeBoxKey : a hex curve25519 key
+func decodeBoxKey(data string) (key *[BoxKeySize]byte, err error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil || len(raw) != BoxKeySize {
+		return nil, ErrBadBoxKey
+	}
+	key = new([BoxKeySize]byte)
+	copy(key[:], raw)
+	return key, nil
+}
@@ -0,0 +1,140 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAlgorithms(t *testing.T) {
+	for _, alg := range []string{AlgEd25519, AlgRSA} {
+		lc, err := (&KeyStore{}).NewLocalKeyAlg(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigK, err := lc.MakeSigned()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sigK.Check(); err != nil {
+			t.Errorf("%s check %v", alg, err)
+		}
+		dk, _ := sigK.GetDistKey()
+		if dk.Algorithm != alg || dk.Weak() {
+			t.Errorf("%s dist key %s weak %v", alg, dk.Algorithm, dk.Weak())
+		}
+		if _, err := dk.BoxPublicKey(); err != nil {
+			t.Errorf("%s box key %v", alg, err)
+		}
+		sig, _ := lc.Sign([]byte("data"))
+		if err := sigK.Verify([]byte("tampered"), sig); err == nil {
+			t.Errorf("%s verified tampered data", alg)
+		}
+	}
+	// a key claiming the wrong algorithm is refused
+	lc, _ := (&KeyStore{}).NewLocalKey()
+	lc.Algorithm = AlgRSA
+	sigK, _ := lc.MakeSigned()
+	if err := sigK.Check(); err != ErrAlgMismatch {
+		t.Errorf("algorithm mismatch got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	path := t.TempDir() + "/keys"
+	os.MkdirAll(path+"/private", 0700)
+	// a key as written before algorithms, 1024 bit rsa and no box key
+	priv, _ := rsa.GenerateKey(rand.Reader, 1024)
+	der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	legacy := &StoredKey{
+		HavePrivate: true,
+		Private: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(priv),
+		})),
+		Public: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+	data, _ := json.MarshalIndent(&DistKey{
+		PublicKey:   legacy.Public,
+		FingerPrint: legacy.FingerPrint(),
+	}, " ", " ")
+	sig, _ := legacy.Sign(data)
+	oldK := &SignedKey{Data: data, Signature: sig}
+	ks := &KeyStore{path: path, pass: plaintext, priv: make(map[string]*StoredKey)}
+	ks.Save(legacy)
+
+	ks, err := NewKeyStore(path, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	lc, err := ks.LocalKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lc.Algorithm != AlgRSA || lc.BoxPublic == "" || lc.FingerPrint() != legacy.FingerPrint() {
+		t.Errorf("migrated key %s box %q", lc.Algorithm, lc.BoxPublic)
+	}
+	sigK, err := ks.GetPublic(lc.FingerPrint(), "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sigK.Check(); err != nil {
+		t.Errorf("migrated public key %v", err)
+	}
+	if dk, _ := sigK.GetDistKey(); !dk.Weak() {
+		t.Errorf("1024 bit key not weak")
+	}
+	// keys gossiped before the algorithm field still check
+	if err := oldK.Check(); err != nil {
+		t.Errorf("legacy signed key %v", err)
+	}
+	if _, err := ks.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	next, _ := ks.LocalKey()
+	if next.Algorithm != DefaultAlgorithm {
+		t.Errorf("rotated to %s", next.Algorithm)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	owner, _ := NewKeyStore(t.TempDir()+"/owner", plaintext)
+	defer owner.Close()
+	node, _ := NewKeyStore(t.TempDir()+"/node", plaintext)
+	defer node.Close()
+	local, _ := owner.LocalKey()
+	current, _ := local.MakeSigned()
+	// the key as gossiped before migrate gave it a box key and work
+	dk, _ := current.GetDistKey()
+	dk.BoxKey, dk.Work = "", 0
+	data, _ := json.Marshal(dk)
+	sig, _ := local.Sign(data)
+	old := &SignedKey{Data: data, Signature: sig}
+	if err := node.PutPublic(old, "public"); err != nil {
+		t.Fatal(err)
+	}
+	// a box key the owner did not sign is refused
+	forged := &SignedKey{Signature: sig}
+	dk.BoxKey = strings.Repeat("00", BoxKeySize)
+	forged.Data, _ = json.Marshal(dk)
+	if bucket, err := node.Upgrade(forged); bucket != "" || err == nil {
+		t.Errorf("forged key taken in %q %v", bucket, err)
+	}
+	if bucket, err := node.Upgrade(current); bucket != "public" || err != nil {
+		t.Fatalf("upgrade got %q %v", bucket, err)
+	}
+	held, _ := node.GetPublic(local.FingerPrint(), "public")
+	if got, _ := held.GetDistKey(); got.BoxKey == "" || got.WorkBits() < DefaultWorkBits {
+		t.Errorf("held key not upgraded %+v", got)
+	}
+	// the older signing does not take it back
+	if bucket, _ := node.Upgrade(old); bucket != "" {
+		t.Errorf("downgraded in %s", bucket)
+	}
+}
@@ -0,0 +1,138 @@
+package keys
+
+// export and import of public keys, a bundle carries signed keys
+// with their rotations, revocations and certifications
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+)
+
+const BundlePemType = "MFSREPL KEY BUNDLE"
+
+var ErrUnsigned = errors.New("Plain public keys carry no self signature, import a bundle")
+
+// ExportBundle : the keys as a pem armoured bundle, one block
+// for each message decodeMessage takes
+func (ks *KeyStore) ExportBundle(fps []string) (data []byte, err error) {
+	st := newState()
+	want := make(map[string]bool)
+	for _, fp := range fps {
+		sigK, err := ks.rawPublic(fp)
+		if err != nil {
+			return nil, err
+		}
+		st.add(fp, sigK)
+		want[fp] = true
+		if sr, err := ks.GetRotation(fp); err == nil {
+			st.rotations[fp] = sr
+		}
+		if sr, err := ks.GetRevocation(fp); err == nil {
+			st.revoked[fp] = sr
+		}
+	}
+	certs, err := ks.ListKeys("certs")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range certs {
+		sc, err := ks.GetCertification(id)
+		if err != nil {
+			continue
+		}
+		c, err := sc.GetCertification()
+		if err == nil && (want[c.Issuer] || want[c.Subject]) {
+			st.certs[id] = sc
+		}
+	}
+	var out bytes.Buffer
+	for _, msg := range st.batch(fps) {
+		buf, err := encodeMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		err = pem.Encode(&out, &pem.Block{Type: BundlePemType, Bytes: buf})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// ExportAll : every stored key as a bundle
+func (ks *KeyStore) ExportAll() (data []byte, err error) {
+	fps, err := ks.ListKeys("public")
+	if err != nil {
+		return nil, err
+	}
+	return ks.ExportBundle(fps)
+}
+
+// ExportPEM : the plain public key for use outside the mesh
+func (ks *KeyStore) ExportPEM(fp string) (data []byte, err error) {
+	sigK, err := ks.rawPublic(fp)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := sigK.GetDistKey()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(dk.PublicKey), nil
+}
+
+// Import : the keys of every bundle in data, returns the finger
+// prints added. Each part is checked as if it came from gossip.
+func (ks *KeyStore) Import(data []byte) (added []string, err error) {
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		found = true
+		switch block.Type {
+		case BundlePemType:
+		case "PUBLIC KEY":
+			return added, ErrUnsigned
+		default:
+			return added, ErrBadPemType
+		}
+		msg, err := decodeMessage(block.Bytes)
+		if err != nil {
+			return added, err
+		}
+		for fp, sigK := range msg.Keys {
+			if ks.haveStored(fp) {
+				continue
+			}
+			err := ks.TryInsertFrom(sigK, "public", SourceImport, "")
+			if err != nil {
+				logger.Errorf("Import key %s %v", fp, err)
+				continue
+			}
+			added = append(added, fp)
+		}
+		// revocations first so rotations to a revoked key are not taken
+		for _, sr := range msg.Revoked {
+			if _, err := ks.TryRevoke(sr); err != nil {
+				logger.Errorf("Import revocation %v", err)
+			}
+		}
+		for _, sr := range msg.Rotations {
+			if _, err := ks.TryRotation(sr); err != nil {
+				logger.Errorf("Import rotation %v", err)
+			}
+		}
+		for _, sc := range msg.Certs {
+			if _, err := ks.TryCertify(sc); err != nil {
+				logger.Errorf("Import certification %v", err)
+			}
+		}
+	}
+	if !found {
+		return nil, ErrBadPem
+	}
+	return added, nil
+}
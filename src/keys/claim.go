@@ -0,0 +1,212 @@
+package keys
+
+// identity claims tie a mesh peer to a key
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+const MaxClaims = 1024
+
+var (
+	ErrClaimConflict = errors.New("Peer name claimed by another key")
+	ErrBadClaim      = errors.New("Bad identity claim")
+	ErrStaleClaim    = errors.New("Key has a newer claim")
+	ErrTooManyClaims = errors.New("Too many identity claims")
+)
+
+// Claim binds a mesh peer name and nickname to a key
+type Claim struct {
+	PeerName    string
+	Nickname    string
+	IPFSID      string
+	FingerPrint string
+	Stamp       time.Time
+}
+
+// Claim signed by the key it names, for mesh gossip
+type SignedClaim struct {
+	Data      json.RawMessage
+	Signature string
+}
+
+// PeerNameFromFingerPrint : derive a mesh peer name from a key,
+// the first six bytes as a locally administered mac.
+func PeerNameFromFingerPrint(fp string) (name mesh.PeerName, err error) {
+	if err := ValidFingerPrint(fp); err != nil {
+		return mesh.UnknownPeerName, err
+	}
+	var buf [6]byte
+	fmt.Sscanf(fp[:12], "%02x%02x%02x%02x%02x%02x", &buf[0], &buf[1], &buf[2], &buf[3], &buf[4], &buf[5])
+	buf[0] |= 2
+	buf[0] &^= 1
+	s := fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5])
+	return mesh.PeerNameFromString(s)
+}
+
+// MakeClaim : sign a claim with our own key
+func (sk *StoredKey) MakeClaim(peerName mesh.PeerName, nickname, ipfsID string) (sc *SignedClaim, err error) {
+	c := &Claim{
+		PeerName:    peerName.String(),
+		Nickname:    nickname,
+		IPFSID:      ipfsID,
+		FingerPrint: sk.FingerPrint(),
+		Stamp:       time.Now(),
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := sk.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	sc = &SignedClaim{
+		Data:      data,
+		Signature: signature,
+	}
+	return sc, nil
+}
+
+func (sc *SignedClaim) GetClaim() (c *Claim, err error) {
+	c = &Claim{}
+	err = json.Unmarshal(sc.Data, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Valid checks the structure of a claim, not the signature
+func (sc *SignedClaim) Valid() (err error) {
+	if len(sc.Data) == 0 || len(sc.Data) > MaxSignedKeySize {
+		return ErrTooBig
+	}
+	if len(sc.Signature) == 0 || len(sc.Signature) > MaxSignatureSize {
+		return ErrBadSignature
+	}
+	c, err := sc.GetClaim()
+	if err != nil {
+		return err
+	}
+	if _, err := mesh.PeerNameFromString(c.PeerName); err != nil {
+		return ErrBadClaim
+	}
+	if len(c.Nickname) > 255 || len(c.IPFSID) > 255 {
+		return ErrBadClaim
+	}
+	return ValidFingerPrint(c.FingerPrint)
+}
+
+// Check the claim against the key it names
+func (sc *SignedClaim) Check(sigK *SignedKey) (c *Claim, err error) {
+	c, err = sc.GetClaim()
+	if err != nil {
+		return nil, err
+	}
+	keyFp, err := sigK.GetFingerPrint()
+	if err != nil {
+		return nil, err
+	}
+	if keyFp != c.FingerPrint {
+		return nil, ErrKeyMismatch
+	}
+	err = sigK.Verify(sc.Data, sc.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Directory holds the verified identity of each mesh peer,
+// one live claim for each key and at most MaxClaims in all
+type Directory struct {
+	lock   sync.RWMutex
+	claims map[mesh.PeerName]*Claim
+	names  map[string]mesh.PeerName // by finger print
+}
+
+func NewDirectory() *Directory {
+	return &Directory{
+		claims: make(map[mesh.PeerName]*Claim),
+		names:  make(map[string]mesh.PeerName),
+	}
+}
+
+// Lookup : the verified identity of a mesh peer
+func (d *Directory) Lookup(name mesh.PeerName) (c *Claim, ok bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	c, ok = d.claims[name]
+	return c, ok
+}
+
+// All : a copy of every verified identity
+func (d *Directory) All() (claims map[mesh.PeerName]*Claim) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	claims = make(map[mesh.PeerName]*Claim)
+	for i, j := range d.claims {
+		claims[i] = j
+	}
+	return claims
+}
+
+// add a verified claim. A name derived from the key always wins,
+// otherwise the first key to claim a name keeps it. A key holds
+// one name, a newer claim moves it and the name it left is
+// returned as dropped.
+func (d *Directory) add(c *Claim) (dropped mesh.PeerName, err error) {
+	name, err := mesh.PeerNameFromString(c.PeerName)
+	if err != nil {
+		return mesh.UnknownPeerName, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	old, moving := d.names[c.FingerPrint]
+	if moving && old != name && d.claims[old].Stamp.After(c.Stamp) {
+		return mesh.UnknownPeerName, ErrStaleClaim
+	}
+	cur, ok := d.claims[name]
+	if ok && cur.FingerPrint != c.FingerPrint {
+		derived, _ := PeerNameFromFingerPrint(c.FingerPrint)
+		if derived != name {
+			return mesh.UnknownPeerName, ErrClaimConflict
+		}
+	}
+	if ok && cur.FingerPrint == c.FingerPrint && cur.Stamp.After(c.Stamp) {
+		return mesh.UnknownPeerName, nil
+	}
+	if !ok && !moving && len(d.claims) >= MaxClaims {
+		return mesh.UnknownPeerName, ErrTooManyClaims
+	}
+	dropped = mesh.UnknownPeerName
+	if moving && old != name {
+		delete(d.claims, old)
+		dropped = old
+	}
+	if ok && cur.FingerPrint != c.FingerPrint {
+		delete(d.names, cur.FingerPrint)
+	}
+	d.claims[name] = c
+	d.names[c.FingerPrint] = name
+	return dropped, nil
+}
+
+// remove the claim of a key we no longer hold
+func (d *Directory) remove(fp string) (name mesh.PeerName, ok bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	name, ok = d.names[fp]
+	if !ok {
+		return mesh.UnknownPeerName, false
+	}
+	delete(d.names, fp)
+	delete(d.claims, name)
+	return name, true
+}
@@ -0,0 +1,105 @@
+package keys
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestClaim(t *testing.T) {
+	k, err := (&KeyStore{}).NewLocalKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigK, _ := k.MakeSigned()
+	name, err := PeerNameFromFingerPrint(k.FingerPrint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := PeerNameFromFingerPrint(k.FingerPrint())
+	if name != again {
+		t.Errorf("peer name not stable %v %v", name, again)
+	}
+	sc, err := k.MakeClaim(name, "bob", "QmNode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Valid(); err != nil {
+		t.Errorf("claim not valid %v", err)
+	}
+	c, err := sc.Check(sigK)
+	if err != nil || c.PeerName != name.String() || c.Nickname != "bob" {
+		t.Errorf("claim check %v %v", c, err)
+	}
+	// another key can not sign for us
+	other, _ := (&KeyStore{}).NewLocalKey()
+	otherK, _ := other.MakeSigned()
+	if _, err := sc.Check(otherK); err == nil {
+		t.Errorf("claim checked against the wrong key")
+	}
+	sc.Data[len(sc.Data)-2] ^= 1
+	if _, err := sc.Check(sigK); err == nil {
+		t.Errorf("tampered claim accepted")
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	d := NewDirectory()
+	fp := "0123456789abcdef0123456789abcdef"
+	name, _ := PeerNameFromFingerPrint(fp)
+	squat := &Claim{PeerName: name.String(), FingerPrint: "fedcba9876543210fedcba9876543210"}
+	if _, err := d.add(squat); err != nil {
+		t.Fatal(err)
+	}
+	// the key the name is derived from takes it back
+	if _, err := d.add(&Claim{PeerName: name.String(), FingerPrint: fp}); err != nil {
+		t.Errorf("derived claim refused %v", err)
+	}
+	if c, _ := d.Lookup(name); c.FingerPrint != fp {
+		t.Errorf("directory holds %v", c)
+	}
+	if _, err := d.add(squat); err != ErrClaimConflict {
+		t.Errorf("conflicting claim got %v", err)
+	}
+}
+
+func TestDirectoryCaps(t *testing.T) {
+	d := NewDirectory()
+	fp := "0123456789abcdef0123456789abcdef"
+	first := mesh.PeerName(1)
+	if _, err := d.add(&Claim{PeerName: first.String(), FingerPrint: fp, Stamp: time.Unix(10, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	// one key holds one name, the newer claim moves it
+	dropped, err := d.add(&Claim{PeerName: mesh.PeerName(2).String(), FingerPrint: fp, Stamp: time.Unix(20, 0)})
+	if err != nil || dropped != first {
+		t.Errorf("moved claim dropped %v %v", dropped, err)
+	}
+	if _, ok := d.Lookup(first); ok {
+		t.Errorf("old name still held")
+	}
+	if _, err := d.add(&Claim{PeerName: first.String(), FingerPrint: fp, Stamp: time.Unix(15, 0)}); err != ErrStaleClaim {
+		t.Errorf("stale claim got %v", err)
+	}
+	for i := 1; len(d.All()) < MaxClaims; i++ {
+		c := &Claim{PeerName: mesh.PeerName(100 + i).String(), FingerPrint: fmt.Sprintf("%032x", i)}
+		if _, err := d.add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.add(&Claim{PeerName: mesh.PeerName(1 << 40).String(), FingerPrint: fmt.Sprintf("%032x", 1<<40)}); err != ErrTooManyClaims {
+		t.Errorf("claim past the cap got %v", err)
+	}
+	// a key already holding a name can still move it when full
+	if _, err := d.add(&Claim{PeerName: first.String(), FingerPrint: fp, Stamp: time.Unix(30, 0)}); err != nil {
+		t.Errorf("move when full got %v", err)
+	}
+	if name, ok := d.remove(fp); !ok || name != first {
+		t.Errorf("remove got %v %v", name, ok)
+	}
+	if _, ok := d.Lookup(first); ok {
+		t.Errorf("removed claim still held")
+	}
+}
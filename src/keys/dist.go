@@ -2,7 +2,6 @@ package keys
 
 import (
 	"bytes"
-	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/gob"
@@ -10,17 +9,43 @@ import (
 	"encoding/json"
 	"errors"
 	"strings"
+	"time"
 )
 
 var (
 	ErrFingerPrintSize  = errors.New("Incorrect Finger Print Size")
 	ErrFingerPrintCheck = errors.New("Finger Print does not match")
+	ErrExpired          = errors.New("Key has expired")
 )
 
 // Key with finger print
 type DistKey struct {
 	PublicKey   string //pem format
 	FingerPrint string
+	Expires     time.Time // zero never expires
+	Algorithm   string    `json:",omitempty"` // empty for legacy rsa keys
+	BoxKey      string    `json:",omitempty"` // hex curve25519 public key
+	Work        uint64    `json:",omitempty"` // proof of work stamp
+}
+
+// BoxPublicKey : the curve25519 key for sending boxes to this key
+func (dk *DistKey) BoxPublicKey() (key *[BoxKeySize]byte, err error) {
+	return decodeBoxKey(dk.BoxKey)
+}
+
+// Weak : legacy rsa keys smaller than new keys are made
+func (dk *DistKey) Weak() bool {
+	pub, err := GetPublicFromPem(dk.PublicKey)
+	if err != nil {
+		return true
+	}
+	k, ok := pub.(*rsa.PublicKey)
+	return ok && k.N.BitLen() < KeySize
+}
+
+// Expired : is the key past its expiry at time t
+func (dk *DistKey) Expired(t time.Time) bool {
+	return !dk.Expires.IsZero() && t.After(dk.Expires)
 }
 
 // Public Key signed with itself for mesh gossip
@@ -46,12 +71,19 @@ func (sigK *SignedKey) Encode() (data []byte, err error) {
 }
 
 func DecodeSignedKey(data []byte) (sigK *SignedKey, err error) {
+	if len(data) > MaxSignedKeySize {
+		return nil, ErrTooBig
+	}
 	b := bytes.NewBuffer(data)
 	dec := gob.NewDecoder(b)
 	err = dec.Decode(&sigK)
 	if err != nil {
 		return nil, err
 	}
+	err = sigK.Valid()
+	if err != nil {
+		return nil, err
+	}
 	return sigK, err
 }
 
@@ -75,10 +107,6 @@ func (sigK *SignedKey) GetDistKey() (dk *DistKey, err error) {
 }
 
 func (sigK *SignedKey) Check() (err error) {
-	signature, err := hex.DecodeString(sigK.Signature)
-	if err != nil {
-		return err
-	}
 	data := sigK.Data
 	dk := &DistKey{}
 	// Unmarshall the json
@@ -95,22 +123,24 @@ func (sigK *SignedKey) Check() (err error) {
 	if strings.Compare(fp, dk.FingerPrint) != 0 {
 		return ErrFingerPrintCheck
 	}
-	// Get The Public Key
-	publicKey, err := GetPublicFromPem(dk.PublicKey)
+	if dk.Expired(time.Now()) {
+		return ErrExpired
+	}
+	return sigK.Verify(data, sigK.Signature)
+}
+
+// Verify a hex signature over data made by this key,
+// dispatched on the algorithm of the key
+func (sigK *SignedKey) Verify(data []byte, sig string) (err error) {
+	dk, err := sigK.GetDistKey()
 	if err != nil {
 		return err
 	}
-	// Check the Signature
-	var opts rsa.PSSOptions
-	opts.SaltLength = rsa.PSSSaltLengthAuto
-	newhash := crypto.SHA256
-	pssh := newhash.New()
-	// use the raw data before unmarshalling
-	pssh.Write(data)
-	hashed := pssh.Sum(nil)
-	err = rsa.VerifyPSS(publicKey, crypto.SHA256, hashed, signature, &opts)
+	// Get The Public Key
+	publicKey, err := GetPublicFromPem(dk.PublicKey)
 	if err != nil {
 		return err
 	}
-	return nil
+	// use the raw data before unmarshalling
+	return verify(publicKey, dk.Algorithm, data, sig)
 }
@@ -0,0 +1,125 @@
+package keys
+
+// signing and checking arbitrary data with the node identity,
+// for subsystems that need to authenticate what they send
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"time"
+)
+
+const MaxPurposeLen = 64
+
+var (
+	ErrBadEnvelope = errors.New("Bad signature envelope")
+	ErrPurpose     = errors.New("Signature made for another purpose")
+)
+
+// Envelope is a detached signature, the payload travels separately.
+// Purpose keeps a signature made for one subsystem from being
+// replayed into another.
+type Envelope struct {
+	Signer    string // finger print
+	Purpose   string
+	Stamp     time.Time
+	Signature string
+}
+
+// signed : the bytes the envelope signature covers
+func (env *Envelope) signed(data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(env.Purpose)
+	b.WriteByte(0)
+	b.WriteString(env.Stamp.UTC().Format(time.RFC3339Nano))
+	b.WriteByte(0)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// Valid checks the structure of an envelope, not the signature
+func (env *Envelope) Valid() (err error) {
+	if env.Purpose == "" || len(env.Purpose) > MaxPurposeLen || env.Stamp.IsZero() {
+		return ErrBadEnvelope
+	}
+	if len(env.Signature) == 0 || len(env.Signature) > MaxSignatureSize {
+		return ErrBadSignature
+	}
+	return ValidFingerPrint(env.Signer)
+}
+
+func (env *Envelope) Encode() (data []byte, err error) {
+	var b bytes.Buffer
+	err = gob.NewEncoder(&b).Encode(env)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func DecodeEnvelope(data []byte) (env *Envelope, err error) {
+	if len(data) > MaxSignedKeySize {
+		return nil, ErrTooBig
+	}
+	err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&env)
+	if err != nil {
+		return nil, err
+	}
+	err = env.Valid()
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// SignBytes : a hex signature over data with the local key
+func (ks *KeyStore) SignBytes(data []byte) (signature string, err error) {
+	local, err := ks.LocalKey()
+	if err != nil {
+		return "", err
+	}
+	return local.Sign(data)
+}
+
+// VerifyBytes : check a signature by the key fp, nothing
+// verifies once the key is revoked whatever it was stamped
+func (ks *KeyStore) VerifyBytes(fp string, data []byte, signature string) (err error) {
+	sigK, err := ks.liveKey(fp)
+	if err != nil {
+		return err
+	}
+	return sigK.Verify(data, signature)
+}
+
+// Sign : a detached signature over data for the purpose
+func (ks *KeyStore) Sign(purpose string, data []byte) (env *Envelope, err error) {
+	if purpose == "" || len(purpose) > MaxPurposeLen {
+		return nil, ErrBadEnvelope
+	}
+	local, err := ks.LocalKey()
+	if err != nil {
+		return nil, err
+	}
+	env = &Envelope{
+		Signer:  local.FingerPrint(),
+		Purpose: purpose,
+		Stamp:   time.Now().UTC(),
+	}
+	env.Signature, err = local.Sign(env.signed(data))
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// Verify : check a detached signature over data for the purpose
+func (ks *KeyStore) Verify(env *Envelope, purpose string, data []byte) (err error) {
+	err = env.Valid()
+	if err != nil {
+		return err
+	}
+	if env.Purpose != purpose {
+		return ErrPurpose
+	}
+	return ks.VerifyBytes(env.Signer, env.signed(data), env.Signature)
+}
@@ -0,0 +1,46 @@
+package keys
+
+import (
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	a, _ := NewKeyStore(t.TempDir()+"/a", plaintext)
+	defer a.Close()
+	b, _ := NewKeyStore(t.TempDir()+"/b", plaintext)
+	defer b.Close()
+	local, _ := a.LocalKey()
+	sigK, _ := local.MakeSigned()
+	b.PutPublic(sigK, "public")
+
+	data := []byte("audit line")
+	env, err := a.Sign("audit", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, _ := env.Encode()
+	env, err = DecodeEnvelope(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Verify(env, "audit", data); err != nil {
+		t.Errorf("verify %v", err)
+	}
+	if err := b.Verify(env, "config", data); err != ErrPurpose {
+		t.Errorf("other purpose got %v", err)
+	}
+	if err := b.Verify(env, "audit", []byte("audit lie")); err == nil {
+		t.Errorf("tampered data verified")
+	}
+	env.Stamp = env.Stamp.Add(1)
+	if err := b.Verify(env, "audit", data); err == nil {
+		t.Errorf("moved stamp verified")
+	}
+	// unknown signer
+	env, _ = b.Sign("audit", data)
+	c, _ := NewKeyStore(t.TempDir()+"/c", plaintext)
+	defer c.Close()
+	if err := c.Verify(env, "audit", data); err != ErrNoKey {
+		t.Errorf("unknown signer got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func testSignedKey(t testing.TB) *SignedKey {
+	ks := &KeyStore{}
+	k, err := ks.NewLocalKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigK, err := k.MakeSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sigK
+}
+
+func encodeKeySet(t testing.TB, set map[string]*SignedKey) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&message{Keys: set}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeMessage(t *testing.T) {
+	sigK := testSignedKey(t)
+	fp, _ := sigK.GetFingerPrint()
+	if _, err := decodeMessage(encodeKeySet(t, map[string]*SignedKey{fp: sigK})); err != nil {
+		t.Errorf("good set rejected %v", err)
+	}
+	other := "0123456789abcdef0123456789abcdef"
+	if _, err := decodeMessage(encodeKeySet(t, map[string]*SignedKey{other: sigK})); err != ErrKeyMismatch {
+		t.Errorf("mismatched finger print got %v", err)
+	}
+	if _, err := decodeMessage(make([]byte, MaxGossipSize+1)); err != ErrTooBig {
+		t.Errorf("oversized message got %v", err)
+	}
+}
+
+func FuzzDecodeSignedKey(f *testing.F) {
+	data, err := testSignedKey(f).Encode()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		sigK, err := DecodeSignedKey(buf)
+		if err != nil {
+			return
+		}
+		// decoded keys must be safe to check
+		sigK.Check()
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	sigK := testSignedKey(f)
+	fp, _ := sigK.GetFingerPrint()
+	f.Add(encodeKeySet(f, map[string]*SignedKey{fp: sigK}))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			return
+		}
+		if len(msg.Keys) > MaxKeys {
+			t.Errorf("too many keys accepted %d", len(msg.Keys))
+		}
+		for _, sigK := range msg.Keys {
+			sigK.Check()
+		}
+		for _, sc := range msg.Claims {
+			sc.GetClaim()
+		}
+	})
+}
@@ -5,7 +5,6 @@ package keys
 import (
 	"bytes"
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -15,23 +14,34 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"path/filepath"
     "time"
 )
 
-const KeySize = 1024
+// KeySize is the size of new rsa keys
+const KeySize = 3072
 const FingerPrintSize = 32
 
+// KeyLifetime is how long a new key is valid for
+const KeyLifetime = 365 * 24 * time.Hour
+
 var (
-	ErrNoPrivate  = errors.New("No Private Key")
-	ErrBadPem     = errors.New("Bad Pem Block")
-	ErrBadPemType = errors.New("Bad Pem Type")
+	ErrNoPrivate   = errors.New("No Private Key")
+	ErrManyPrivate = errors.New("More than one private key, retire all but one")
+	ErrBadPem      = errors.New("Bad Pem Block")
+	ErrBadPemType  = errors.New("Bad Pem Type")
 )
 
 type StoredKey struct {
 	HavePrivate bool
 	Private     string
 	Public      string
+	Expires     time.Time // zero never expires
+	Algorithm   string    // empty for legacy rsa keys
+	BoxPublic   string    // hex curve25519 keys
+	BoxPrivate  string
+	Work        uint64     `json:",omitempty"` // proof of work stamp for the public key
+	Sealed      *SealedKey `json:",omitempty"` // Private and BoxPrivate under a passphrase
 }
 
 // Trucated finger SHA256 of the public key
@@ -61,97 +71,135 @@ func Decode(data []byte) (sk *StoredKey, err error) {
 	return sk, err
 }
 
-func GetPrivateFromPem(data string) (key *rsa.PrivateKey, err error) {
+// GetPrivateFromPem : an rsa (PKCS1 or PKCS8) or ed25519 private key
+func GetPrivateFromPem(data string) (key crypto.Signer, err error) {
 	block, _ := pem.Decode([]byte(data))
 	if block == nil {
 		return nil, ErrBadPem
 	}
-	if block.Type != "RSA PRIVATE KEY" {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var k interface{}
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			key, ok = k.(crypto.Signer)
+			if !ok {
+				return nil, ErrBadPemType
+			}
+		}
+	default:
 		return nil, ErrBadPemType
 	}
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
-	err = privateKey.Validate()
-	if err != nil {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		err = rsaKey.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := keyAlgorithm(key.Public()); err != nil {
 		return nil, err
 	}
-	return privateKey, nil
+	return key, nil
 }
 
-func GetPublicFromPem(data string) (key *rsa.PublicKey, err error) {
+// GetPublicFromPem : an rsa or ed25519 public key
+func GetPublicFromPem(data string) (key crypto.PublicKey, err error) {
+	if len(data) > MaxPemSize {
+		return nil, ErrBadPem
+	}
 	block, _ := pem.Decode([]byte(data))
 	if block == nil {
 		return nil, ErrBadPem
 	}
 	if block.Type != "PUBLIC KEY" {
-		fmt.Println(block.Type)
 		return nil, ErrBadPemType
 	}
-	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	key, err = x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
-	return publicKey.(*rsa.PublicKey), nil
+	if _, err := keyAlgorithm(key); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
 // takes a stored key and makes a distribution key
 func (sk *StoredKey) MakeSigned() (sig *SignedKey, err error) {
-	if sk.HavePrivate == false {
-		return nil, ErrNoPrivate
-	}
-	//Get Private Key
-	privKey, err := GetPrivateFromPem(sk.Private)
-	if err != nil {
-		return nil, err
-	}
 	dk := &DistKey{
 		PublicKey:   sk.Public,
 		FingerPrint: sk.FingerPrint(),
+		Expires:     sk.Expires,
+		Algorithm:   algorithm(sk.Algorithm),
+		BoxKey:      sk.BoxPublic,
+		Work:        sk.Work,
 	}
 	jsonData, err := json.MarshalIndent(dk, " ", " ")
 	if err != nil {
 		return nil, err
 	}
-	hash := crypto.SHA256
-	h := hash.New()
-	h.Write(jsonData)
-	hashed := h.Sum(nil)
-	var opts rsa.PSSOptions
-	opts.SaltLength = rsa.PSSSaltLengthAuto
-	signature, err := rsa.SignPSS(rand.Reader, privKey, hash, hashed, &opts)
+	signature, err := sk.Sign(jsonData)
 	if err != nil {
 		return nil, err
 	}
-
 	sig = &SignedKey{
 		Data:      jsonData,
-		Signature: hex.EncodeToString(signature[:]),
+		Signature: signature,
 	}
 	return sig, nil
 }
 
+// Sign data with the private key, returns a hex signature
+func (sk *StoredKey) Sign(data []byte) (signature string, err error) {
+	if sk.HavePrivate == false {
+		return "", ErrNoPrivate
+	}
+	//Get Private Key
+	privKey, err := GetPrivateFromPem(sk.Private)
+	if err != nil {
+		return "", err
+	}
+	return sign(privKey, data)
+}
+
+// BoxPrivateKey : the curve25519 key for opening boxes sent to us
+func (sk *StoredKey) BoxPrivateKey() (key *[BoxKeySize]byte, err error) {
+	if sk.HavePrivate == false {
+		return nil, ErrNoPrivate
+	}
+	return decodeBoxKey(sk.BoxPrivate)
+}
+
+// NewLocalKey : a new key of the default algorithm
 func (ks *KeyStore) NewLocalKey() (lc *StoredKey, err error) {
-	var privateKey *rsa.PrivateKey
-	var publicKey *rsa.PublicKey
-	privateKey, err = rsa.GenerateKey(rand.Reader, KeySize)
+	return ks.NewLocalKeyAlg(DefaultAlgorithm)
+}
+
+// NewLocalKeyAlg : a new signing key of the algorithm and a box key
+func (ks *KeyStore) NewLocalKeyAlg(alg string) (lc *StoredKey, err error) {
+	privateKey, err := generateKey(alg)
 	if err != nil {
 		logger.Critical(err)
 		return nil, err
 	}
-	publicKey = &privateKey.PublicKey
 	//TODO, add some header stuff
-    head := make(map[string]string)
-    head["created"] = fmt.Sprintf("%s",time.Now())
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-        Headers: head,
+	now := time.Now()
+	expires := now.Add(KeyLifetime).UTC()
+	head := make(map[string]string)
+	head["created"] = fmt.Sprintf("%s", now)
+	head["expires"] = expires.Format(time.RFC3339)
+	pr, err := privatePem(privateKey, head)
+	if err != nil {
+		return nil, err
 	}
-	pr := string(pem.EncodeToMemory(privateKeyPEM))
 
-	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(privateKey.Public())
 	if err != nil {
 		logger.Criticalf("PUBLIC %v", err)
 		return nil, err
@@ -163,24 +211,73 @@ func (ks *KeyStore) NewLocalKey() (lc *StoredKey, err error) {
 	}
 	pb := string(pem.EncodeToMemory(&publicKeyBlock))
 
+	boxPublic, boxPrivate, err := newBoxKeys()
+	if err != nil {
+		return nil, err
+	}
 	lc = &StoredKey{
 		HavePrivate: true,
 		Private:     pr,
 		Public:      pb,
+		Expires:     expires,
+		Algorithm:   alg,
+		BoxPublic:   boxPublic,
+		BoxPrivate:  boxPrivate,
+		Work:        mintWork(FingerPrint(pb), DefaultWorkBits),
 	}
 	return lc, nil
 }
 
 func (ks *KeyStore) Save(lc *StoredKey) (err error) {
-	enc, err := json.MarshalIndent(lc, "", " ")
+	return ks.saveStored(ks.path+"/private/"+lc.FingerPrint()+".key", lc)
+}
+
+// LocalKey : load our own key from the private folder
+func (ks *KeyStore) LocalKey() (lc *StoredKey, err error) {
+	file, err := localKeyFile(ks.path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fp := lc.FingerPrint()
-	err = ioutil.WriteFile(ks.path+"/private/"+fp+".key", enc, 0600)
+	return ks.loadStored(file)
+}
+
+// localKeyFile : the one key file in the private folder
+func localKeyFile(path string) (file string, err error) {
+	files, err := filepath.Glob(path + "/private/*.key")
 	if err != nil {
-		return err
+		return "", err
+	}
+	switch len(files) {
+	case 0:
+		return "", ErrNoPrivate
+	case 1:
+		return files[0], nil
+	}
+	return "", ErrManyPrivate
+}
 
+// privateKey : a local or retired key by finger print
+func (ks *KeyStore) privateKey(fp string) (lc *StoredKey, err error) {
+	if err := ValidFingerPrint(fp); err != nil {
+		return nil, err
+	}
+	lc, err = ks.loadStored(ks.path + "/private/" + fp + ".key")
+	if err == nil {
+		return lc, nil
+	}
+	return ks.loadStored(ks.path + "/private/retired/" + fp + ".key")
+}
+
+// LocalFingerPrint : the finger print of the local key in the store
+// at path, read without opening the store or the sealed key
+func LocalFingerPrint(path string) (fp string, err error) {
+	file, err := localKeyFile(path)
+	if err != nil {
+		return "", err
+	}
+	lc, err := readStored(file)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return lc.FingerPrint(), nil
 }
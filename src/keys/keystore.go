@@ -4,11 +4,11 @@ package keys
 // boltdb store for keys
 import (
 	"errors"
-	"fmt"
 	"github.com/boltdb/bolt"
 	"io/ioutil"
 	"os"
 	"sync"
+	"time"
 )
 
 var (
@@ -17,29 +17,70 @@ var (
 
 type KeyStore struct {
 	db   *bolt.DB
-	priv map[string]*StoredKey
 	path string
 
+	pass     *Passphrase
+	privLock sync.Mutex
+	priv     map[string]*StoredKey // opened private keys by finger print
+
 	mapLock sync.Mutex
 	keySets map[string]*state // reuse state for key cache
+
+	revokeLock sync.RWMutex
+	revoked    map[string]*Revocation
+	admins     map[string]bool
+
+	markLock sync.RWMutex
+	marks    map[string]Mark // local trusted and blocked keys
+
+	trust trustCache // computed web of trust
+
+	policyLock sync.RWMutex
+	policy     Policy // admission of gossiped keys
 }
 
-func NewKeyStore(path string) (ks *KeyStore, err error) {
+// NewKeyStore : open a key store, pass unlocks the private keys
+func NewKeyStore(path string, pass *Passphrase) (ks *KeyStore, err error) {
 	logger.Infof("Open Key Store %s", path)
+	if pass == nil || !pass.Plaintext && len(pass.Secret) == 0 {
+		return nil, ErrNoPassphrase
+	}
 	ks = &KeyStore{}
 	ks.path = path
+	ks.pass = pass
+	ks.priv = make(map[string]*StoredKey)
+	ks.policy = DefaultPolicy()
 	pubK, err := ks.initFolder()
 	if err != nil {
 		logger.Errorf("Init fail %s", err)
 		return nil, err
 	}
-	ks.db, err = bolt.Open(path+"/keystore.db", 0600, nil)
+	// a running daemon holds the lock, do not wait on it forever
+	ks.db, err = bolt.Open(path+"/keystore.db", 0600, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		return nil, err
 	}
-	ks.makeBucket("public")
-	ks.makeBucket("keylist")
+	err = ks.upgrade()
+	if err != nil {
+		ks.Close()
+		return nil, err
+	}
 	ks.keySets = make(map[string]*state)
+	err = ks.loadRevoked()
+	if err != nil {
+		ks.Close()
+		return nil, err
+	}
+	err = ks.loadMarks()
+	if err != nil {
+		ks.Close()
+		return nil, err
+	}
+	err = ks.migrate()
+	if err != nil {
+		ks.Close()
+		return nil, err
+	}
 	// if new key insert
 	if pubK != nil {
 		ks.PutPublic(pubK, "public")
@@ -58,14 +99,17 @@ func (ks *KeyStore) initFolder() (sigK *SignedKey, err error) {
 	}
 
 	files, err := ioutil.ReadDir(private)
-	fmt.Println(len(files), err)
+	logger.Debugf("%d private keys %v", len(files), err)
 	if len(files) == 0 {
 		logger.Debug("Generate Local Key")
 		k, err := ks.NewLocalKey()
 		if err != nil {
 			return nil, err
 		}
-		ks.Save(k)
+		err = ks.Save(k)
+		if err != nil {
+			return nil, err
+		}
 		logger.Debug("Sign Public Key")
 		sigK, err = k.MakeSigned()
 		if err != nil {
@@ -92,15 +136,34 @@ func (ks *KeyStore) Close() {
 }
 
 func (ks *KeyStore) TryInsert(sigK *SignedKey, bucket string) (err error) {
-	//logger.Critical(ks)
+	return ks.TryInsertFrom(sigK, bucket, SourceGossip, "")
+}
+
+// TryInsertFrom : check and store a key, noting where and from
+// which mesh peer it came, peer is empty when not known.
+// Gossiped keys go through the admission policy.
+func (ks *KeyStore) TryInsertFrom(sigK *SignedKey, bucket, source, peer string) (err error) {
 	err = sigK.Check()
 	if err != nil {
 		return err
 	}
-	err = ks.PutPublic(sigK, bucket)
+	fp, _ := sigK.GetFingerPrint()
+	if err := ks.refused(fp); err != nil {
+		return err
+	}
+	if source == SourceGossip {
+		bucket, err = ks.admit(sigK, fp)
+		if err != nil {
+			return err
+		}
+	}
+	err = ks.PutPublicFrom(sigK, bucket, source, peer)
 	if err != nil {
 		return err
 	}
+	if bucket == "quarantine" {
+		return ErrQuarantined
+	}
 	return nil
 }
 
@@ -109,7 +172,15 @@ func (ks *KeyStore) HaveKey(fp string, bucket string) (have bool) {
 	return have
 }
 
+// CacheKey : a key from the cache, revoked and blocked keys are never returned
 func (ks *KeyStore) CacheKey(fp string, bucket string) (sigK *SignedKey, have bool) {
+	if ks.refused(fp) != nil {
+		return nil, false
+	}
+	return ks.cacheKey(fp, bucket)
+}
+
+func (ks *KeyStore) cacheKey(fp string, bucket string) (sigK *SignedKey, have bool) {
 	ks.mapLock.Lock()
 	defer ks.mapLock.Unlock()
 	// a state set for each bucket name
@@ -133,7 +204,7 @@ func (ks *KeyStore) CacheKey(fp string, bucket string) (sigK *SignedKey, have bo
 		return sigK, true
 	}
 	// if not load it
-	sigK, err := ks.GetPublic(fp, bucket)
+	sigK, err := ks.getPublic(fp, bucket)
 	if err != nil {
 		//logger.Errorf("KEY FAIL %v", err)
 		return nil, false
@@ -160,7 +231,29 @@ func (ks *KeyStore) ListKeys(bucket string) (items []string, err error) {
 	return items, err
 }
 
+// Counts : the entries in each bucket of keys
+func (ks *KeyStore) Counts() (counts map[string]int) {
+	counts = make(map[string]int)
+	ks.db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{"public", "quarantine", "revoked", "certs", "rotations"} {
+			if b := tx.Bucket([]byte(name)); b != nil {
+				counts[name] = b.Stats().KeyN
+			}
+		}
+		return nil
+	})
+	return counts
+}
+
+// GetPublic : a stored key, ErrRevoked or ErrBlocked if it is refused
 func (ks *KeyStore) GetPublic(fp, bucket string) (sigK *SignedKey, err error) {
+	if err := ks.refused(fp); err != nil {
+		return nil, err
+	}
+	return ks.getPublic(fp, bucket)
+}
+
+func (ks *KeyStore) getPublic(fp, bucket string) (sigK *SignedKey, err error) {
 	//logger.Criticalf("%s", fp)
 	err = ks.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucket))
@@ -183,6 +276,11 @@ func (ks *KeyStore) GetPublic(fp, bucket string) (sigK *SignedKey, err error) {
 }
 
 func (ks *KeyStore) PutPublic(sigK *SignedKey, bucket string) error {
+	return ks.PutPublicFrom(sigK, bucket, SourceLocal, "")
+}
+
+// PutPublicFrom : store a key, the first source is kept in the key meta
+func (ks *KeyStore) PutPublicFrom(sigK *SignedKey, bucket, source, peer string) error {
 	err := ks.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(bucket))
 		if err != nil {
@@ -200,7 +298,7 @@ func (ks *KeyStore) PutPublic(sigK *SignedKey, bucket string) error {
 		if err != nil {
 			return err
 		}
-		return nil
+		return putMeta(tx, key, source, peer)
 	})
 	return err
 }
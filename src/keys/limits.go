@@ -0,0 +1,235 @@
+package keys
+
+// bounds and checks for keys received from the mesh
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	MaxGossipSize    = 1 << 20 // largest accepted gossip message in bytes
+	MaxKeys          = 256     // keys in a single message
+	MaxPemSize       = 4096    // encoded public key
+	MaxSignatureSize = 2048    // hex encoded signature
+	MaxSignedKeySize = 16384   // encoded SignedKey
+
+	gossipBudget  = MaxGossipSize - 64<<10 // bytes of entries we put in a message
+	entryOverhead = 16                     // gob framing of one map entry
+)
+
+var (
+	ErrTooBig       = errors.New("Gossip message too large")
+	ErrTooMany      = errors.New("Too many keys in gossip")
+	ErrKeyMismatch  = errors.New("Key does not match its finger print")
+	ErrBadSignature = errors.New("Bad signature encoding")
+)
+
+// Valid checks the structure of a signed key without
+// doing any crypto, it is cheap enough to run on everything received.
+func (sigK *SignedKey) Valid() (err error) {
+	if len(sigK.Data) == 0 || len(sigK.Data) > MaxSignedKeySize {
+		return ErrTooBig
+	}
+	if len(sigK.Signature) == 0 || len(sigK.Signature) > MaxSignatureSize {
+		return ErrBadSignature
+	}
+	if _, err := hex.DecodeString(sigK.Signature); err != nil {
+		return ErrBadSignature
+	}
+	dk, err := sigK.GetDistKey()
+	if err != nil {
+		return err
+	}
+	if len(dk.PublicKey) == 0 || len(dk.PublicKey) > MaxPemSize {
+		return ErrBadPem
+	}
+	switch algorithm(dk.Algorithm) {
+	case AlgRSA, AlgEd25519:
+	default:
+		return ErrBadAlgorithm
+	}
+	if dk.BoxKey != "" {
+		if _, err := dk.BoxPublicKey(); err != nil {
+			return err
+		}
+	}
+	return ValidFingerPrint(dk.FingerPrint)
+}
+
+// ValidFingerPrint : check the syntax of a key finger print
+func ValidFingerPrint(fp string) (err error) {
+	if len(fp) != FingerPrintSize {
+		return ErrFingerPrintSize
+	}
+	if _, err := hex.DecodeString(fp); err != nil {
+		return ErrFingerPrintCheck
+	}
+	return nil
+}
+
+// decodeMessage unpacks a keybase gossip message, every entry must be
+// structurally valid and keys are stored under their own finger print.
+func decodeMessage(buf []byte) (msg *message, err error) {
+	if len(buf) > MaxGossipSize {
+		return nil, ErrTooBig
+	}
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&msg); err != nil {
+		return nil, err
+	}
+	if len(msg.Keys) > MaxKeys || len(msg.Claims) > MaxClaims || len(msg.Rotations) > MaxKeys || len(msg.Revoked) > MaxKeys || len(msg.Certs) > MaxCerts || len(msg.Want) > MaxWants || len(msg.Have) > MaxHave {
+		return nil, ErrTooMany
+	}
+	for _, fps := range [][]string{msg.Want, msg.Have} {
+		for _, fp := range fps {
+			if err := ValidFingerPrint(fp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for fp, sigK := range msg.Keys {
+		if sigK == nil {
+			return nil, ErrBadPem
+		}
+		if err := sigK.Valid(); err != nil {
+			return nil, err
+		}
+		keyFp, _ := sigK.GetFingerPrint()
+		if keyFp != fp {
+			return nil, ErrKeyMismatch
+		}
+	}
+	for name, sc := range msg.Claims {
+		if sc == nil {
+			return nil, ErrBadClaim
+		}
+		if err := sc.Valid(); err != nil {
+			return nil, err
+		}
+		c, _ := sc.GetClaim()
+		if c.PeerName != name {
+			return nil, ErrBadClaim
+		}
+	}
+	for fp, sr := range msg.Rotations {
+		if sr == nil {
+			return nil, ErrBadRotation
+		}
+		if err := sr.Valid(); err != nil {
+			return nil, err
+		}
+		r, _ := sr.GetRotation()
+		if r.Old != fp {
+			return nil, ErrBadRotation
+		}
+	}
+	for fp, sr := range msg.Revoked {
+		if sr == nil {
+			return nil, ErrBadRevoke
+		}
+		if err := sr.Valid(); err != nil {
+			return nil, err
+		}
+		r, _ := sr.GetRevocation()
+		if r.FingerPrint != fp {
+			return nil, ErrBadRevoke
+		}
+	}
+	for id, sc := range msg.Certs {
+		if sc == nil {
+			return nil, ErrBadCert
+		}
+		if err := sc.Valid(); err != nil {
+			return nil, err
+		}
+		certID, _ := sc.ID()
+		if certID != id {
+			return nil, ErrBadCert
+		}
+	}
+	return msg, nil
+}
+
+// batches splits what we send into messages decodeMessage
+// takes, each under its caps and the gossip size
+type batches struct {
+	msgs []*message
+	left int // bytes left in the last message
+	max  int // messages, 0 for no limit
+}
+
+func newMessage() *message {
+	return &message{
+		Keys:      make(map[string]*SignedKey),
+		Claims:    make(map[string]*SignedClaim),
+		Rotations: make(map[string]*SignedRotation),
+		Revoked:   make(map[string]*SignedRevocation),
+		Certs:     make(map[string]*SignedCertification),
+	}
+}
+
+// add : the message an entry of size bytes goes in, a new one when
+// the last is full, nil when there is no room left for it
+func (b *batches) add(size int, full func(*message) bool) *message {
+	if len(b.msgs) == 0 || size > b.left || full(b.msgs[len(b.msgs)-1]) {
+		if b.max > 0 && len(b.msgs) == b.max {
+			return nil
+		}
+		b.msgs = append(b.msgs, newMessage())
+		b.left = gossipBudget
+	}
+	if size > b.left {
+		return nil
+	}
+	b.left -= size
+	return b.msgs[len(b.msgs)-1]
+}
+
+// first : the first message, an empty one when nothing was added
+func (b *batches) first() *message {
+	if len(b.msgs) == 0 {
+		b.msgs = append(b.msgs, newMessage())
+		b.left = gossipBudget
+	}
+	return b.msgs[0]
+}
+
+// entrySize : about what an entry adds to an encoded message
+func entrySize(id string, data []byte, sig string) int {
+	return len(id) + len(data) + len(sig) + entryOverhead
+}
+
+// rejects counts, for each source peer, the keybase messages that
+// did not decode and the ones holding keys that failed their checks
+// or the admission limit. Periodic gossip carries no source, its
+// refusals are counted under mesh.UnknownPeerName.
+type rejects struct {
+	mtx   sync.Mutex
+	count map[mesh.PeerName]uint64
+}
+
+func newRejects() *rejects {
+	return &rejects{
+		count: make(map[mesh.PeerName]uint64),
+	}
+}
+
+func (r *rejects) add(src mesh.PeerName) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.count[src]++
+}
+
+func (r *rejects) get() (count map[mesh.PeerName]uint64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	count = make(map[mesh.PeerName]uint64)
+	for i, j := range r.count {
+		count[i] = j
+	}
+	return count
+}
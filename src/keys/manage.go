@@ -0,0 +1,253 @@
+package keys
+
+// key management, where keys came from, local marks and deletion
+import (
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// where a key was first seen
+const (
+	SourceLocal    = "local"
+	SourceGossip   = "gossip"
+	SourceImport   = "import"
+	SourceRotation = "rotation"
+)
+
+// Mark is a local decision about a key, it is not gossiped
+type Mark string
+
+const (
+	MarkNone    Mark = ""
+	MarkTrusted Mark = "trusted" // trusted fully, as an anchor
+	MarkBlocked Mark = "blocked" // refused, as if revoked
+)
+
+var (
+	ErrBlocked = errors.New("Key is blocked")
+	ErrBadMark = errors.New("Unknown key mark")
+)
+
+// KeyInfo describes a stored key for listing
+type KeyInfo struct {
+	FingerPrint string
+	Algorithm   string
+	Expires     time.Time
+	Weak        bool
+	BoxKey      bool
+	KeyMeta
+	Mark        Mark
+	Trust       Trust
+	Revoked     *Revocation
+	Quarantined bool
+}
+
+// ParseMark : a mark from its name, none clears it
+func ParseMark(s string) (m Mark, err error) {
+	switch Mark(s) {
+	case MarkTrusted, MarkBlocked:
+		return Mark(s), nil
+	case "none", MarkNone:
+		return MarkNone, nil
+	}
+	return MarkNone, ErrBadMark
+}
+
+// SetMark : mark a key trusted or blocked, MarkNone clears the mark
+func (ks *KeyStore) SetMark(fp string, m Mark) (err error) {
+	if err := ValidFingerPrint(fp); err != nil {
+		return err
+	}
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("marks"))
+		if err != nil {
+			return err
+		}
+		if m == MarkNone {
+			return bucket.Delete([]byte(fp))
+		}
+		return bucket.Put([]byte(fp), []byte(m))
+	})
+	if err != nil {
+		return err
+	}
+	ks.markLock.Lock()
+	if m == MarkNone {
+		delete(ks.marks, fp)
+	} else {
+		ks.marks[fp] = m
+	}
+	ks.markLock.Unlock()
+	if m == MarkBlocked {
+		ks.uncache(fp)
+	}
+	ks.trust.dirty()
+	if m == MarkTrusted {
+		ks.promote()
+	}
+	return nil
+}
+
+// Marked : the local mark on a key
+func (ks *KeyStore) Marked(fp string) Mark {
+	ks.markLock.RLock()
+	defer ks.markLock.RUnlock()
+	return ks.marks[fp]
+}
+
+// trusted : keys marked trusted locally
+func (ks *KeyStore) trusted() (fps []string) {
+	ks.markLock.RLock()
+	defer ks.markLock.RUnlock()
+	for fp, m := range ks.marks {
+		if m == MarkTrusted {
+			fps = append(fps, fp)
+		}
+	}
+	return fps
+}
+
+func (ks *KeyStore) loadMarks() (err error) {
+	ks.markLock.Lock()
+	defer ks.markLock.Unlock()
+	ks.marks = make(map[string]Mark)
+	return ks.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("marks"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			ks.marks[string(k)] = Mark(v)
+			return nil
+		})
+	})
+}
+
+// refused : ErrRevoked or ErrBlocked for keys we will not use
+func (ks *KeyStore) refused(fp string) error {
+	if _, ok := ks.Revoked(fp); ok {
+		return ErrRevoked
+	}
+	if ks.Marked(fp) == MarkBlocked {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// uncache drops a key from the cache
+func (ks *KeyStore) uncache(fp string) {
+	ks.mapLock.Lock()
+	defer ks.mapLock.Unlock()
+	for _, keySet := range ks.keySets {
+		keySet.mtx.Lock()
+		delete(keySet.set, fp)
+		keySet.mtx.Unlock()
+	}
+}
+
+// Delete : remove a public key and its meta data. Gossip will bring
+// it back unless it is also blocked.
+func (ks *KeyStore) Delete(fp string) (err error) {
+	if !ks.haveStored(fp) {
+		return ErrNoKey
+	}
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"public", "quarantine", "meta"} {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			err := bucket.Delete([]byte(fp))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ks.uncache(fp)
+	ks.trust.dirty()
+	return nil
+}
+
+// rawPublic : a stored key without the checks, so expired,
+// revoked, blocked and quarantined keys can still be shown
+func (ks *KeyStore) rawPublic(fp string) (sigK *SignedKey, err error) {
+	err = ks.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte("public")).Get([]byte(fp))
+		if data == nil {
+			data = tx.Bucket([]byte("quarantine")).Get([]byte(fp))
+		}
+		if data == nil {
+			return ErrNoKey
+		}
+		sigK, err = DecodeSignedKey(data)
+		return err
+	})
+	return sigK, err
+}
+
+// haveStored : is the key held, refused or quarantined or not
+func (ks *KeyStore) haveStored(fp string) (have bool) {
+	ks.db.View(func(tx *bolt.Tx) error {
+		have = tx.Bucket([]byte("public")).Get([]byte(fp)) != nil ||
+			tx.Bucket([]byte("quarantine")).Get([]byte(fp)) != nil
+		return nil
+	})
+	return have
+}
+
+// Info : the details of a stored key
+func (ks *KeyStore) Info(fp string) (info *KeyInfo, err error) {
+	sigK, err := ks.rawPublic(fp)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := sigK.GetDistKey()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := ks.GetMeta(fp)
+	if err != nil {
+		return nil, err
+	}
+	info = &KeyInfo{
+		FingerPrint: fp,
+		Algorithm:   algorithm(dk.Algorithm),
+		Expires:     dk.Expires,
+		Weak:        dk.Weak(),
+		BoxKey:      dk.BoxKey != "",
+		KeyMeta:     *meta,
+		Mark:        ks.Marked(fp),
+		Trust:       ks.Trust(fp),
+	}
+	info.Revoked, _ = ks.Revoked(fp)
+	info.Quarantined = ks.Quarantined(fp)
+	return info, nil
+}
+
+// List : the details of every public and quarantined key
+func (ks *KeyStore) List() (infos []*KeyInfo, err error) {
+	fps, err := ks.ListKeys("public")
+	if err != nil {
+		return nil, err
+	}
+	held, err := ks.ListKeys("quarantine")
+	if err != nil {
+		return nil, err
+	}
+	fps = append(fps, held...)
+	for _, fp := range fps {
+		info, err := ks.Info(fp)
+		if err != nil {
+			logger.Errorf("Key %s %v", fp, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
@@ -0,0 +1,89 @@
+package keys
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestManage(t *testing.T) {
+	a, _ := NewKeyStore(t.TempDir()+"/a", plaintext)
+	defer a.Close()
+	b, _ := NewKeyStore(t.TempDir()+"/b", plaintext)
+	defer b.Close()
+	local, _ := a.LocalKey()
+	fp := local.FingerPrint()
+	if meta, _ := a.GetMeta(fp); meta.Source != SourceLocal || meta.FirstSeen.IsZero() {
+		t.Errorf("local key meta %+v", meta)
+	}
+
+	bundle, err := a.ExportBundle([]string{fp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := b.Import(bundle)
+	if err != nil || len(added) != 1 || added[0] != fp {
+		t.Fatalf("import %v %v", added, err)
+	}
+	if meta, _ := b.GetMeta(fp); meta.Source != SourceImport {
+		t.Errorf("imported key source %s", meta.Source)
+	}
+	plain, _ := a.ExportPEM(fp)
+	if _, err := b.Import(plain); err != ErrUnsigned {
+		t.Errorf("plain pem import got %v", err)
+	}
+
+	// marks
+	if b.Trust(fp) != TrustUnknown {
+		t.Errorf("imported key trusted")
+	}
+	b.SetMark(fp, MarkTrusted)
+	if b.Trust(fp) != TrustFull {
+		t.Errorf("trusted mark gives %s", b.Trust(fp))
+	}
+	b.SetMark(fp, MarkBlocked)
+	if b.HaveKey(fp, "public") {
+		t.Errorf("blocked key still served")
+	}
+	info, err := b.Info(fp)
+	if err != nil || info.Mark != MarkBlocked {
+		t.Errorf("blocked key info %+v %v", info, err)
+	}
+	sigK, _ := local.MakeSigned()
+	if err := b.TryInsert(sigK, "public"); err != ErrBlocked {
+		t.Errorf("blocked key inserted %v", err)
+	}
+
+	// delete
+	if err := b.Delete(fp); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := b.List(); len(infos) != 1 {
+		t.Errorf("keys after delete %d", len(infos))
+	}
+	if err := b.Delete(fp); err != ErrNoKey {
+		t.Errorf("delete missing key got %v", err)
+	}
+}
+
+func TestBundleSplit(t *testing.T) {
+	a, _ := NewKeyStore(t.TempDir()+"/a", plaintext)
+	defer a.Close()
+	b, _ := NewKeyStore(t.TempDir()+"/b", plaintext)
+	defer b.Close()
+	for i := 0; i < MaxKeys+10; i++ {
+		k, _ := (&KeyStore{}).NewLocalKey()
+		sigK, _ := k.MakeSigned()
+		a.PutPublic(sigK, "public")
+	}
+	bundle, err := a.ExportAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(bundle, []byte("BEGIN "+BundlePemType)); n < 2 {
+		t.Errorf("%d keys in %d blocks", MaxKeys+10, n)
+	}
+	added, err := b.Import(bundle)
+	if err != nil || len(added) != MaxKeys+11 {
+		t.Errorf("imported %d of %d %v", len(added), MaxKeys+11, err)
+	}
+}
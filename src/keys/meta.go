@@ -0,0 +1,133 @@
+package keys
+
+// provenance of the keys we hold, kept beside them in the meta bucket
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// MaxMetaClaims bounds the claims remembered for one key
+const MaxMetaClaims = 16
+
+// KeyMeta is what we know about a key beyond the key itself
+type KeyMeta struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Source    string
+	Peer      string // mesh peer it first came from, empty when unknown
+	Seen      uint64 // times it arrived again by gossip
+	Claims    []MetaClaim
+}
+
+// MetaClaim is an identity claim made with the key
+type MetaClaim struct {
+	PeerName string
+	Nickname string
+	Stamp    time.Time
+}
+
+func getMeta(tx *bolt.Tx, fp string) (meta *KeyMeta, err error) {
+	meta = &KeyMeta{}
+	bucket := tx.Bucket([]byte("meta"))
+	if bucket == nil {
+		return meta, nil
+	}
+	data := bucket.Get([]byte(fp))
+	if data == nil {
+		return meta, nil
+	}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func setMeta(tx *bolt.Tx, fp string, meta *KeyMeta) (err error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("meta"))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(fp), data)
+}
+
+// putMeta records the first sighting of a key
+func putMeta(tx *bolt.Tx, fp, source, peer string) (err error) {
+	meta, err := getMeta(tx, fp)
+	if err != nil {
+		return err
+	}
+	if !meta.FirstSeen.IsZero() {
+		return nil
+	}
+	now := time.Now()
+	meta.FirstSeen = now
+	meta.LastSeen = now
+	meta.Source = source
+	meta.Peer = peer
+	return setMeta(tx, fp, meta)
+}
+
+// GetMeta : the meta data of a key, empty for keys stored before it was kept
+func (ks *KeyStore) GetMeta(fp string) (meta *KeyMeta, err error) {
+	err = ks.db.View(func(tx *bolt.Tx) error {
+		meta, err = getMeta(tx, fp)
+		return err
+	})
+	return meta, err
+}
+
+// Seen : note keys we already hold arriving again, in one write
+func (ks *KeyStore) Seen(fps []string, peer string) (err error) {
+	if len(fps) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return ks.db.Update(func(tx *bolt.Tx) error {
+		for _, fp := range fps {
+			meta, err := getMeta(tx, fp)
+			if err != nil {
+				return err
+			}
+			if meta.FirstSeen.IsZero() {
+				meta.FirstSeen = now
+				meta.Peer = peer
+			}
+			meta.LastSeen = now
+			meta.Seen++
+			err = setMeta(tx, fp, meta)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddClaim : remember an identity claim made with the key fp
+func (ks *KeyStore) AddClaim(fp string, c *Claim) (err error) {
+	return ks.db.Update(func(tx *bolt.Tx) error {
+		meta, err := getMeta(tx, fp)
+		if err != nil {
+			return err
+		}
+		mc := MetaClaim{PeerName: c.PeerName, Nickname: c.Nickname, Stamp: c.Stamp}
+		for i, have := range meta.Claims {
+			if have.PeerName == mc.PeerName {
+				meta.Claims[i] = mc
+				return setMeta(tx, fp, meta)
+			}
+		}
+		meta.Claims = append(meta.Claims, mc)
+		if len(meta.Claims) > MaxMetaClaims {
+			meta.Claims = meta.Claims[len(meta.Claims)-MaxMetaClaims:]
+		}
+		return setMeta(tx, fp, meta)
+	})
+}
@@ -0,0 +1,65 @@
+package keys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestMeta(t *testing.T) {
+	ks, _ := NewKeyStore(t.TempDir()+"/a", plaintext)
+	defer ks.Close()
+	other, _ := (&KeyStore{}).NewLocalKey()
+	sigK, _ := other.MakeSigned()
+	fp := other.FingerPrint()
+	if err := ks.TryInsertFrom(sigK, "public", SourceGossip, "02:00:00:00:00:01"); err != nil {
+		t.Fatal(err)
+	}
+	ks.Seen([]string{fp}, "02:00:00:00:00:02")
+	ks.Seen([]string{fp}, "02:00:00:00:00:02")
+	c := &Claim{PeerName: "02:00:00:00:00:01", Nickname: "bob", FingerPrint: fp, Stamp: time.Now()}
+	ks.AddClaim(fp, c)
+	ks.AddClaim(fp, c)
+	meta, err := ks.GetMeta(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Peer != "02:00:00:00:00:01" || meta.Source != SourceGossip || meta.Seen != 2 {
+		t.Errorf("meta %+v", meta)
+	}
+	if meta.LastSeen.Before(meta.FirstSeen) || len(meta.Claims) != 1 || meta.Claims[0].Nickname != "bob" {
+		t.Errorf("meta %+v", meta)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	path := t.TempDir() + "/a"
+	ks, _ := NewKeyStore(path, plaintext)
+	if ks.Version() != SchemaVersion {
+		t.Errorf("new store version %d", ks.Version())
+	}
+	local, _ := ks.LocalKey()
+	fp := local.FingerPrint()
+	// wind the store back to before meta was kept
+	ks.db.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket([]byte("meta"))
+		return tx.DeleteBucket([]byte("schema"))
+	})
+	ks.Close()
+
+	ks, err := NewKeyStore(path, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := ks.GetMeta(fp); meta.FirstSeen.IsZero() {
+		t.Errorf("meta not back filled")
+	}
+	ks.db.Update(func(tx *bolt.Tx) error {
+		return setVersion(tx, SchemaVersion+1)
+	})
+	ks.Close()
+	if _, err := NewKeyStore(path, plaintext); err != ErrSchema {
+		t.Errorf("newer schema got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package keys
+
+// bring key stores made by older versions up to date
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// migrate fills in the algorithm of stored private keys, gives the
+// local key a box key and proof of work, and seals plaintext keys when
+// we have a passphrase. The public key is signed again to carry them.
+// Weak legacy rsa keys are left alone, rotate them away.
+func (ks *KeyStore) migrate() (err error) {
+	files, err := ks.privateFiles()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		// retired keys sign nothing new, they do not need a box key
+		local := filepath.Dir(path) == ks.path+"/private"
+		onDisk, err := readStored(path)
+		if err != nil {
+			logger.Errorf("Migrate %s %v", path, err)
+			continue
+		}
+		lc, err := ks.loadStored(path)
+		if err != nil {
+			return err
+		}
+		seal := onDisk.Sealed == nil && !ks.pass.Plaintext
+		unworked := local && workBits(lc.FingerPrint(), lc.Work) < DefaultWorkBits
+		resign := lc.Algorithm == "" || local && lc.BoxPublic == "" || unworked
+		if !seal && !resign {
+			continue
+		}
+		if lc.Algorithm == "" {
+			priv, err := GetPrivateFromPem(lc.Private)
+			if err != nil {
+				logger.Errorf("Migrate %s %v", path, err)
+				continue
+			}
+			lc.Algorithm, _ = keyAlgorithm(priv.Public())
+		}
+		if local && lc.BoxPublic == "" {
+			lc.BoxPublic, lc.BoxPrivate, err = newBoxKeys()
+			if err != nil {
+				return err
+			}
+		}
+		if unworked {
+			lc.Work = mintWork(lc.FingerPrint(), DefaultWorkBits)
+		}
+		logger.Infof("Migrate key %s %s sealed %v", lc.FingerPrint(), lc.Algorithm, !ks.pass.Plaintext)
+		err = ks.saveStored(path, lc)
+		if err != nil {
+			return err
+		}
+		if !local || !resign {
+			continue
+		}
+		sigK, err := lc.MakeSigned()
+		if err != nil {
+			return err
+		}
+		err = ks.PutPublic(sigK, "public")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upgrade : replace a held public key with sigK when it is the same
+// key signed again by its owner carrying fields the held one lacks,
+// as migrate does. Returns the bucket it was replaced in, empty when
+// nothing changed.
+func (ks *KeyStore) Upgrade(sigK *SignedKey) (bucket string, err error) {
+	dk, err := sigK.GetDistKey()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{"public", "quarantine"} {
+		held, ok := ks.CacheKey(dk.FingerPrint, name)
+		if !ok {
+			continue
+		}
+		if string(held.Data) == string(sigK.Data) {
+			return "", nil
+		}
+		cur, err := held.GetDistKey()
+		if err != nil || !dk.upgrades(cur) {
+			return "", err
+		}
+		if err := sigK.Check(); err != nil {
+			return "", err
+		}
+		if err := ks.PutPublicFrom(sigK, name, SourceGossip, ""); err != nil {
+			return "", err
+		}
+		ks.uncache(dk.FingerPrint)
+		logger.Infof("Key %s signed again with new fields", dk.FingerPrint)
+		return name, nil
+	}
+	return "", ErrNoKey
+}
+
+// upgrades : dk is cur with fields filled in that cur lacks and
+// nothing taken away, so an older signing can not replace a newer one
+func (dk *DistKey) upgrades(cur *DistKey) bool {
+	if dk.PublicKey != cur.PublicKey || dk.FingerPrint != cur.FingerPrint || !dk.Expires.Equal(cur.Expires) {
+		return false
+	}
+	if cur.Algorithm != "" && dk.Algorithm != cur.Algorithm {
+		return false
+	}
+	if cur.BoxKey != "" && dk.BoxKey != cur.BoxKey {
+		return false
+	}
+	if dk.WorkBits() < cur.WorkBits() {
+		return false
+	}
+	return dk.Algorithm != cur.Algorithm || dk.BoxKey != cur.BoxKey || dk.WorkBits() > cur.WorkBits()
+}
+
+// readStored : a key file as it is on disk
+func readStored(path string) (lc *StoredKey, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lc = &StoredKey{}
+	err = json.Unmarshal(data, lc)
+	if err != nil {
+		return nil, err
+	}
+	return lc, nil
+}
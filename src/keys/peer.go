@@ -1,10 +1,11 @@
 package keys
 
 import (
+	"sync"
+	"time"
+
 	"github.com/op/go-logging"
 
-	"bytes"
-	"encoding/gob"
 	//	"fmt"
 	"github.com/weaveworks/mesh"
 )
@@ -17,13 +18,21 @@ var logger = logging.MustGetLogger("keys")
 const fullKeys = 5
 
 type peer struct {
-	st       *state
-    countdown int // every fullKeys send the whole keyset
-	send     mesh.Gossip
-	actions  chan<- func()
-	quit     chan struct{}
-	logger   *logging.Logger
-	keyStore *KeyStore
+	st         *state
+	countdown  int // every fullKeys send the whole keyset
+	send       mesh.Gossip
+	actions    chan<- func()
+	quit       chan struct{}
+	stopOnce   sync.Once
+	logger     *logging.Logger
+	keyStore   *KeyStore
+	rejects    *rejects
+	limit      *limiter // new keys from each source peer
+	directory  *Directory
+	wants      *wants                 // open lookups by finger print
+	neighbours func() []mesh.PeerName // peers to ask for wanted keys
+	connected  map[mesh.PeerName]bool // neighbours at the last sync
+	syncing    *syncs
 }
 
 // peer implements mesh.Gossiper.
@@ -32,18 +41,24 @@ var _ mesh.Gossiper = &peer{}
 // Construct a peer with empty state.
 // Be sure to register a channel, later,
 // so we can make outbound communication.
-func NewPeer(keypath string, logger *logging.Logger) *peer {
+func NewPeer(keypath string, pass *Passphrase, logger *logging.Logger) *peer {
 	actions := make(chan func())
 	p := &peer{
-		st:      newState(),
-		send:    nil, // must .register() later
-        countdown: fullKeys,
-		actions: actions,
-		quit:    make(chan struct{}),
+		st:        newState(),
+		send:      nil, // must .register() later
+		countdown: fullKeys,
+		actions:   actions,
+		quit:      make(chan struct{}),
 		//update:  make(chan ident, 10),
-		logger: logger,
+		logger:    logger,
+		rejects:   newRejects(),
+		limit:     newLimiter(DefaultPolicy()),
+		directory: NewDirectory(),
+		wants:     newWants(),
+		connected: make(map[mesh.PeerName]bool),
+		syncing:   newSyncs(),
 	}
-	ks, err := NewKeyStore(keypath)
+	ks, err := NewKeyStore(keypath, pass)
 	if err != nil {
 		logger.Fatalf("Keystore fail %v", err)
 	}
@@ -59,6 +74,47 @@ func NewPeer(keypath string, logger *logging.Logger) *peer {
 //	return p.update
 //}
 
+// Store returns the key store behind the peer.
+func (p *peer) Store() *KeyStore {
+	return p.keyStore
+}
+
+// Directory returns the verified identities of mesh peers.
+func (p *peer) Directory() *Directory {
+	return p.directory
+}
+
+// Claim signs our identity and gossips it on the keys channel.
+func (p *peer) Claim(peerName mesh.PeerName, nickname, ipfsID string) (err error) {
+	local, err := p.keyStore.LocalKey()
+	if err != nil {
+		return err
+	}
+	sc, err := local.MakeClaim(peerName, nickname, ipfsID)
+	if err != nil {
+		return err
+	}
+	c, _ := sc.GetClaim()
+	dropped, err := p.directory.add(c)
+	if err != nil {
+		return err
+	}
+	p.dropClaim(dropped)
+	p.st.insertClaim(c.PeerName, sc)
+	return nil
+}
+
+// SetPolicy changes how gossiped keys are admitted.
+func (p *peer) SetPolicy(pol Policy) {
+	p.keyStore.SetPolicy(pol)
+	p.limit.set(pol)
+}
+
+// Rejected returns the count of refused gossip messages per source peer.
+func (p *peer) Rejected() map[mesh.PeerName]uint64 {
+	return p.rejects.get()
+}
+
 func (p *peer) loop(actions <-chan func()) {
 	for {
 		select {
@@ -71,6 +127,8 @@ func (p *peer) loop(actions <-chan func()) {
 }
 
 func (p *peer) loadAllKeys() {
+	// trust may have changed while we were away
+	p.keyStore.promote()
 	keys, err := p.keyStore.ListKeys("public")
 	if err != nil {
 		logger.Critical(err)
@@ -85,16 +143,52 @@ func (p *peer) loadAllKeys() {
 		}
 		p.st.insert(k)
 	}
+	rotations, err := p.keyStore.ListKeys("rotations")
+	if err != nil {
+		logger.Critical(err)
+	}
+	for _, i := range rotations {
+		sr, err := p.keyStore.GetRotation(i)
+		if err != nil {
+			logger.Errorf("ROTATION FAIL %v", err)
+			continue
+		}
+		p.st.insertRotation(i, sr)
+	}
+	revoked, err := p.keyStore.ListKeys("revoked")
+	if err != nil {
+		logger.Critical(err)
+	}
+	for _, i := range revoked {
+		sr, err := p.keyStore.GetRevocation(i)
+		if err != nil {
+			logger.Errorf("REVOCATION FAIL %v", err)
+			continue
+		}
+		p.st.insertRevocation(i, sr)
+	}
+	certs, err := p.keyStore.ListKeys("certs")
+	if err != nil {
+		logger.Critical(err)
+	}
+	for _, i := range certs {
+		sc, err := p.keyStore.GetCertification(i)
+		if err != nil {
+			logger.Errorf("CERT FAIL %v", err)
+			continue
+		}
+		p.st.insertCert(i, sc)
+	}
 }
 
 // register the result of a mesh.Router.NewGossip.
 func (p *peer) Register(send mesh.Gossip) {
-	p.actions <- func() { p.send = send }
+	p.do(func() { p.send = send })
 }
 
 func (p *peer) Insert(sigK *SignedKey) (result *SignedKey) {
 	c := make(chan struct{})
-	p.actions <- func() {
+	ok := p.do(func() {
 		defer close(c)
 		st := p.st.insert(sigK)
 		//p.logger.Debugf("Insert data %v", st)
@@ -104,17 +198,29 @@ func (p *peer) Insert(sigK *SignedKey) (result *SignedKey) {
 			p.logger.Critical("no sender configured; not broadcasting update right now")
 		}
 		//		result = st.get()
+	})
+	if ok {
+		<-c
 	}
-	<-c
 	return result
 }
 
-func (p *peer) stop() {
-	close(p.quit)
+// Stop ends the loop, the peer does nothing after it.
+func (p *peer) Stop() {
+	p.stopOnce.Do(func() { close(p.quit) })
 }
 
-// Return a copy of our complete state.
-// TODO , get a small random selection of keys
+// do runs f in the loop, false once the peer has stopped
+func (p *peer) do(f func()) bool {
+	select {
+	case p.actions <- f:
+		return true
+	case <-p.quit:
+		return false
+	}
+}
+
+// Return a sample of our state, newest keys first.
 func (p *peer) Gossip() (complete mesh.GossipData) {
 	logger.Critical("KEY GOSSIP")
     //logger.Critical(p.countdown)
@@ -131,36 +237,292 @@ func (p *peer) Gossip() (complete mesh.GossipData) {
 }
 
 // Merge the gossiped data represented by buf into our state.
-// Return the state information that was modified.
+// Return the state information that was modified. Periodic gossip
+// has no source so its keys are bounded by Evict and quarantine,
+// not the rate limit.
 func (p *peer) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
-    st := newState()
-    var set map[string]*SignedKey
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
+	msg, err := decodeMessage(buf)
+	if err != nil {
+		p.rejects.add(mesh.UnknownPeerName)
 		return nil, err
 	}
-	for i, j := range set {
-        //logger.Debug("key -> ",i)
-		if p.keyStore.HaveKey(i, "public") == false {
-			logger.Criticalf("ADDING KEY %v", i)
-			err := p.keyStore.TryInsert(j, "public")
-            if err != nil {
+	st := p.merge(mesh.UnknownPeerName, msg)
+	if st == nil {
+		return nil, nil
+	}
+	return st, nil
+}
+
+// merge takes what is new to us from a message,
+// returns the new parts or nil if there were none.
+func (p *peer) merge(src mesh.PeerName, msg *message) (st *state) {
+	st = newState()
+	from := ""
+	if src != mesh.UnknownPeerName {
+		from = src.String()
+	}
+	var seen []string
+	added, limited := 0, 0
+	now := time.Now()
+	for i, j := range msg.Keys {
+		//logger.Debug("key -> ",i)
+		if p.keyStore.HaveKey(i, "public") || p.keyStore.Quarantined(i) {
+			seen = append(seen, i)
+			// a key its owner signed again to carry new fields
+			bucket, err := p.keyStore.Upgrade(j)
+			if err != nil {
+				logger.Debugf("Key %s not upgraded %v", i, err)
+			}
+			if bucket == "public" {
+				st.insert(j)
+				p.st.insert(j)
+			}
+			continue
+		}
+		// checked against the limit of the source before any crypto
+		// is done. Keys we asked for are not held to it, nor is periodic
+		// gossip, it has no source to charge and a single bucket would
+		// let one peer starve the rest, Evict and quarantine bound it.
+		solicited := p.wants.has(i) || p.syncing.take(src)
+		if !solicited && src != mesh.UnknownPeerName && !p.limit.allow(src, now) {
+			limited++
+			continue
+		}
+		logger.Criticalf("ADDING KEY %v", i)
+		err := p.keyStore.TryInsertFrom(j, "public", SourceGossip, from)
+		switch err {
+		case nil:
+			st.insert(j)
+			p.st.insert(j)
+			p.wants.resolve(i)
+			logger.Criticalf("# keys %d", len(p.st.set))
+		case ErrQuarantined:
+			// held back keys are not passed on
+		case ErrRevoked, ErrBlocked:
+			p.wants.resolve(i)
+			continue
+		default:
 			logger.Critical(err)
-            }
-            st.insert(j)
-            logger.Criticalf("# keys %d",len(p.st.set))
+			p.rejects.add(src)
+			continue
 		}
+		added++
 	}
-    if len(st.set) == 0 {
-        return nil,nil
-    }
-    //logger.Debug(st)
-	return st, nil
+	if limited > 0 {
+		logger.Warningf("%s %d keys from %v", ErrRateLimited, limited, src)
+		p.rejects.add(src)
+	}
+	if err := p.keyStore.Seen(seen, from); err != nil {
+		logger.Errorf("Key meta %v", err)
+	}
+	if added > 0 {
+		evicted, err := p.keyStore.Evict()
+		if err != nil {
+			logger.Errorf("Evict %v", err)
+		}
+		for _, fp := range evicted {
+			st.remove(fp)
+			p.st.remove(fp)
+			if name, ok := p.directory.remove(fp); ok {
+				st.removeClaim(name.String())
+				p.dropClaim(name)
+			}
+		}
+	}
+	for name, sc := range msg.Claims {
+		if p.mergeClaim(sc) {
+			st.insertClaim(name, sc)
+		}
+	}
+	for fp, sr := range msg.Rotations {
+		if p.mergeRotation(sr) {
+			st.insertRotation(fp, sr)
+		}
+	}
+	for fp, sr := range msg.Revoked {
+		if p.mergeRevocation(sr) {
+			st.insertRevocation(fp, sr)
+			p.wants.resolve(fp)
+		}
+	}
+	vouched := false
+	for id, sc := range msg.Certs {
+		if p.mergeCert(sc) {
+			st.insertCert(id, sc)
+			vouched = true
+		}
+	}
+	if vouched || len(st.rotations) > 0 {
+		p.promote(st)
+	}
+	if len(st.set) == 0 && len(st.claims) == 0 && len(st.rotations) == 0 && len(st.revoked) == 0 && len(st.certs) == 0 {
+		return nil
+	}
+	//logger.Debug(st)
+	return st
+}
+
+// Import : add the keys of a bundle and gossip them on
+func (p *peer) Import(data []byte) (added []string, err error) {
+	added, err = p.keyStore.Import(data)
+	if err != nil {
+		return nil, err
+	}
+	p.loadAllKeys()
+	return added, nil
+}
+
+// promote moves keys out of quarantine that are now vouched
+// for, and passes them on with st
+func (p *peer) promote(st *state) {
+	promoted, err := p.keyStore.Promote()
+	if err != nil {
+		logger.Errorf("Promote %v", err)
+	}
+	for _, sigK := range promoted {
+		st.insert(sigK)
+		p.st.insert(sigK)
+	}
+}
+
+// mergeCert records a certification signed by a key we hold,
+// returns true if it was new to us.
+func (p *peer) mergeCert(sc *SignedCertification) bool {
+	id, err := sc.ID()
+	if err != nil {
+		return false
+	}
+	cur, ok := p.st.getCert(id)
+	if ok && string(cur.Data) == string(sc.Data) {
+		return false
+	}
+	c, err := p.keyStore.TryCertify(sc)
+	if err != nil {
+		logger.Debugf("Certification not taken %v", err)
+		return false
+	}
+	// an older certification than the one we hold
+	if now, _ := sc.GetCertification(); !now.Stamp.Equal(c.Stamp) {
+		return false
+	}
+	logger.Infof("KEY CERTIFIED %s by %s as %s", c.Subject, c.Issuer, c.Level)
+	p.st.insertCert(id, sc)
+	return true
+}
+
+// mergeRevocation records a revocation signed by the key or an admin,
+// returns true if it was new to us.
+func (p *peer) mergeRevocation(sr *SignedRevocation) bool {
+	r, err := sr.GetRevocation()
+	if err != nil || p.st.haveRevocation(r.FingerPrint) {
+		return false
+	}
+	r, err = p.keyStore.TryRevoke(sr)
+	if err != nil {
+		logger.Debugf("Revocation not taken %v", err)
+		return false
+	}
+	logger.Warningf("KEY REVOKED %s by %s : %s", r.FingerPrint, r.Signer, r.Reason)
+	p.st.insertRevocation(r.FingerPrint, sr)
+	return true
+}
+
+// mergeRotation trusts the successor of a key we hold,
+// returns true if the rotation was new to us.
+func (p *peer) mergeRotation(sr *SignedRotation) bool {
+	r, err := sr.GetRotation()
+	if err != nil || p.st.haveRotation(r.Old) {
+		return false
+	}
+	r, err = p.keyStore.TryRotation(sr)
+	if err != nil {
+		logger.Debugf("Rotation not taken %v", err)
+		return false
+	}
+	logger.Infof("KEY ROTATED %s", r.Old)
+	p.st.insertRotation(r.Old, sr)
+	if next, err := r.NewKey(); err == nil {
+		p.st.insert(next)
+	}
+	return true
 }
 
+// mergeClaim checks a claim against the key it names,
+// returns true if it was new to us.
+func (p *peer) mergeClaim(sc *SignedClaim) bool {
+	c, err := sc.GetClaim()
+	if err != nil {
+		return false
+	}
+	// claims for keys we do not hold yet come round again
+	sigK, ok := p.keyStore.CacheKey(c.FingerPrint, "public")
+	if !ok {
+		return false
+	}
+	cur, ok := p.st.getClaim(c.PeerName)
+	if ok && string(cur.Data) == string(sc.Data) {
+		return false
+	}
+	name := c.PeerName
+	c, err = sc.Check(sigK)
+	if err != nil {
+		logger.Errorf("Claim for %s %v", name, err)
+		return false
+	}
+	dropped, err := p.directory.add(c)
+	switch err {
+	case nil:
+	case ErrStaleClaim:
+		logger.Debugf("Claim for %s %v", c.PeerName, err)
+		return false
+	default:
+		logger.Errorf("Claim for %s %v", c.PeerName, err)
+		return false
+	}
+	p.dropClaim(dropped)
+	p.st.insertClaim(c.PeerName, sc)
+	if err := p.keyStore.AddClaim(c.FingerPrint, c); err != nil {
+		logger.Errorf("Key meta %v", err)
+	}
+	return true
+}
+
+// dropClaim stops gossiping a name the directory let go
+func (p *peer) dropClaim(name mesh.PeerName) {
+	if name != mesh.UnknownPeerName {
+		p.st.removeClaim(name.String())
+	}
+}
+
+// OnGossipBroadcast merges keys broadcast by src, unlike OnGossip
+// the source is known so it is held to the admission limits.
 func (p *peer) OnGossipBroadcast(src mesh.PeerName, buf []byte) (received mesh.GossipData, err error) {
-	return nil, nil
+	msg, err := decodeMessage(buf)
+	if err != nil {
+		p.rejects.add(src)
+		return nil, err
+	}
+	st := p.merge(src, msg)
+	if st == nil {
+		return nil, nil
+	}
+	return st, nil
 }
 
+// OnGossipUnicast answers want requests and takes the keys sent
+// back, what is new is passed on by the next gossip round.
 func (p *peer) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	msg, err := decodeMessage(buf)
+	if err != nil {
+		p.rejects.add(src)
+		return err
+	}
+	if len(msg.Want) > 0 {
+		p.answer(src, msg.Want)
+	}
+	if len(msg.Have) > 0 {
+		p.do(func() { p.reconcile(src, msg.Have) })
+	}
+	p.merge(src, msg)
 	return nil
 }
@@ -0,0 +1,266 @@
+package keys
+
+// revocation certificates, signed by the key itself or an admin key
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	ErrRevoked      = errors.New("Key has been revoked")
+	ErrBadRevoke    = errors.New("Bad revocation")
+	ErrNotAdmin     = errors.New("Revocation not signed by the key or an admin")
+	ErrNoRevokeKeys = errors.New("No private key to sign the revocation")
+)
+
+// Revocation withdraws trust in a key from a point in time
+type Revocation struct {
+	FingerPrint string    // the revoked key
+	Signer      string    // the key itself or an admin key
+	Stamp       time.Time // when it was made
+	Reason      string
+}
+
+// Revocation signed by Signer, for mesh gossip
+type SignedRevocation struct {
+	Data      json.RawMessage
+	Signature string
+}
+
+// MakeRevocation : sign a revocation of fp with this key
+func (sk *StoredKey) MakeRevocation(fp, reason string) (sr *SignedRevocation, err error) {
+	r := &Revocation{
+		FingerPrint: fp,
+		Signer:      sk.FingerPrint(),
+		Stamp:       time.Now(),
+		Reason:      reason,
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := sk.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	sr = &SignedRevocation{
+		Data:      data,
+		Signature: signature,
+	}
+	return sr, nil
+}
+
+func (sr *SignedRevocation) GetRevocation() (r *Revocation, err error) {
+	r = &Revocation{}
+	err = json.Unmarshal(sr.Data, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Valid checks the structure of a revocation, not the signature
+func (sr *SignedRevocation) Valid() (err error) {
+	if len(sr.Data) == 0 || len(sr.Data) > MaxSignedKeySize {
+		return ErrTooBig
+	}
+	if len(sr.Signature) == 0 || len(sr.Signature) > MaxSignatureSize {
+		return ErrBadSignature
+	}
+	r, err := sr.GetRevocation()
+	if err != nil {
+		return err
+	}
+	if len(r.Reason) > 1024 {
+		return ErrBadRevoke
+	}
+	if err := ValidFingerPrint(r.Signer); err != nil {
+		return err
+	}
+	return ValidFingerPrint(r.FingerPrint)
+}
+
+func (sr *SignedRevocation) Encode() (data []byte, err error) {
+	var b bytes.Buffer
+	err = gob.NewEncoder(&b).Encode(sr)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func DecodeSignedRevocation(data []byte) (sr *SignedRevocation, err error) {
+	err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&sr)
+	if err != nil {
+		return nil, err
+	}
+	err = sr.Valid()
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// SetAdmins : the keys allowed to revoke keys other than their own
+func (ks *KeyStore) SetAdmins(admins []string) {
+	ks.revokeLock.Lock()
+	defer ks.revokeLock.Unlock()
+	ks.admins = make(map[string]bool)
+	for _, fp := range admins {
+		ks.admins[fp] = true
+	}
+}
+
+func (ks *KeyStore) isAdmin(fp string) bool {
+	ks.revokeLock.RLock()
+	defer ks.revokeLock.RUnlock()
+	return ks.admins[fp]
+}
+
+// Revoked : the revocation of a key, if there is one
+func (ks *KeyStore) Revoked(fp string) (r *Revocation, ok bool) {
+	ks.revokeLock.RLock()
+	defer ks.revokeLock.RUnlock()
+	r, ok = ks.revoked[fp]
+	return r, ok
+}
+
+// TryRevoke : check a revocation and record it
+func (ks *KeyStore) TryRevoke(sr *SignedRevocation) (r *Revocation, err error) {
+	r, err = sr.GetRevocation()
+	if err != nil {
+		return nil, err
+	}
+	// the earliest revocation stands
+	if cur, ok := ks.Revoked(r.FingerPrint); ok && !r.Stamp.Before(cur.Stamp) {
+		return cur, nil
+	}
+	if r.Signer != r.FingerPrint && !ks.isAdmin(r.Signer) {
+		return nil, ErrNotAdmin
+	}
+	// the revoked key may sign its own revocation
+	signer, err := ks.getPublic(r.Signer, "public")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ks.Revoked(r.Signer); ok && r.Signer != r.FingerPrint {
+		return nil, ErrRevoked
+	}
+	err = signer.Verify(sr.Data, sr.Signature)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.putRevocation(r.FingerPrint, sr)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Revoke : revoke a key, a retired local key signs its own
+// revocation, anything else is signed as admin by the local key.
+func (ks *KeyStore) Revoke(fp, reason string) (sr *SignedRevocation, err error) {
+	signer, err := ks.privateKey(fp)
+	if err != nil {
+		signer, err = ks.LocalKey()
+		if err != nil {
+			return nil, ErrNoRevokeKeys
+		}
+	}
+	sr, err = signer.MakeRevocation(fp, reason)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.putRevocation(fp, sr)
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+func (ks *KeyStore) putRevocation(fp string, sr *SignedRevocation) (err error) {
+	r, err := sr.GetRevocation()
+	if err != nil {
+		return err
+	}
+	data, err := sr.Encode()
+	if err != nil {
+		return err
+	}
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("revoked"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fp), data)
+	})
+	if err != nil {
+		return err
+	}
+	ks.revokeLock.Lock()
+	ks.revoked[fp] = r
+	ks.revokeLock.Unlock()
+	ks.trust.dirty()
+	ks.uncache(fp)
+	return nil
+}
+
+// GetRevocation : the signed revocation of a key
+func (ks *KeyStore) GetRevocation(fp string) (sr *SignedRevocation, err error) {
+	err = ks.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("revoked"))
+		if bucket == nil {
+			return ErrNoKey
+		}
+		data := bucket.Get([]byte(fp))
+		if data == nil {
+			return ErrNoKey
+		}
+		sr, err = DecodeSignedRevocation(data)
+		return err
+	})
+	return sr, err
+}
+
+// loadRevoked fills the revocation cache from the store
+func (ks *KeyStore) loadRevoked() (err error) {
+	ks.revokeLock.Lock()
+	defer ks.revokeLock.Unlock()
+	ks.revoked = make(map[string]*Revocation)
+	return ks.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("revoked"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			sr, err := DecodeSignedRevocation(v)
+			if err != nil {
+				return err
+			}
+			r, err := sr.GetRevocation()
+			if err != nil {
+				return err
+			}
+			ks.revoked[string(k)] = r
+			return nil
+		})
+	})
+}
+
+// liveKey : a key new signatures are taken from, the signer picks
+// any stamp on what it signs so a revoked key verifies nothing.
+func (ks *KeyStore) liveKey(fp string) (sigK *SignedKey, err error) {
+	if _, ok := ks.Revoked(fp); ok {
+		return nil, ErrRevoked
+	}
+	sigK, have := ks.cacheKey(fp, "public")
+	if !have {
+		return nil, ErrNoKey
+	}
+	return sigK, nil
+}
@@ -0,0 +1,81 @@
+package keys
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevoke(t *testing.T) {
+	ks, err := NewKeyStore(t.TempDir()+"/a", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	other, err := NewKeyStore(t.TempDir()+"/b", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	old, _ := ks.LocalKey()
+	oldK, _ := old.MakeSigned()
+	other.PutPublic(oldK, "public")
+	fp := old.FingerPrint()
+	// an envelope stamped before the revocation, as a leaked
+	// key can make any time after it too
+	data := []byte("refs")
+	env := &Envelope{Signer: fp, Purpose: "test", Stamp: time.Now().Add(-time.Hour).UTC()}
+	env.Signature, _ = old.Sign(env.signed(data))
+	if err := other.Verify(env, "test", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate away then revoke the retired key with itself
+	ks.Rotate()
+	sr, err := ks.Revoke(fp, "leaked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := sr.GetRevocation(); r.Signer != fp {
+		t.Errorf("revocation signed by %s", r.Signer)
+	}
+	if _, err := other.TryRevoke(sr); err != nil {
+		t.Fatal(err)
+	}
+	if other.HaveKey(fp, "public") {
+		t.Errorf("revoked key still held")
+	}
+	if _, err := other.GetPublic(fp, "public"); err != ErrRevoked {
+		t.Errorf("GetPublic got %v", err)
+	}
+	if err := other.Verify(env, "test", data); err != ErrRevoked {
+		t.Errorf("backdated envelope after revocation got %v", err)
+	}
+}
+
+func TestAdminRevoke(t *testing.T) {
+	admin, _ := NewKeyStore(t.TempDir()+"/admin", plaintext)
+	defer admin.Close()
+	node, _ := NewKeyStore(t.TempDir()+"/node", plaintext)
+	defer node.Close()
+	adminKey, _ := admin.LocalKey()
+	adminK, _ := adminKey.MakeSigned()
+	victim, _ := (&KeyStore{}).NewLocalKey()
+	victimK, _ := victim.MakeSigned()
+	node.PutPublic(adminK, "public")
+	node.PutPublic(victimK, "public")
+
+	sr, err := admin.Revoke(victim.FingerPrint(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.TryRevoke(sr); err != ErrNotAdmin {
+		t.Errorf("revocation by non admin got %v", err)
+	}
+	node.SetAdmins([]string{adminKey.FingerPrint()})
+	if _, err := node.TryRevoke(sr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.Revoked(victim.FingerPrint()); !ok {
+		t.Errorf("admin revocation not recorded")
+	}
+}
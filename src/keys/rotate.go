@@ -0,0 +1,290 @@
+package keys
+
+// key rotation, the old key signs over to its successor
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	ErrBadRotation = errors.New("Bad key rotation")
+)
+
+// Rotation hands the trust in an old key to a new one
+type Rotation struct {
+	Old   string // finger print of the retiring key
+	New   []byte // encoded SignedKey of the successor
+	Stamp time.Time
+}
+
+// NewKey : the successor key, json would reformat the raw
+// key data and break its signature so it is carried encoded.
+func (r *Rotation) NewKey() (sigK *SignedKey, err error) {
+	return DecodeSignedKey(r.New)
+}
+
+// Rotation signed by the old key, for mesh gossip
+type SignedRotation struct {
+	Data      json.RawMessage
+	Signature string
+}
+
+// MakeRotation : sign the successor key with this one
+func (sk *StoredKey) MakeRotation(next *SignedKey) (sr *SignedRotation, err error) {
+	enc, err := next.Encode()
+	if err != nil {
+		return nil, err
+	}
+	r := &Rotation{
+		Old:   sk.FingerPrint(),
+		New:   enc,
+		Stamp: time.Now(),
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := sk.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	sr = &SignedRotation{
+		Data:      data,
+		Signature: signature,
+	}
+	return sr, nil
+}
+
+func (sr *SignedRotation) GetRotation() (r *Rotation, err error) {
+	r = &Rotation{}
+	err = json.Unmarshal(sr.Data, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.New) == 0 {
+		return nil, ErrBadRotation
+	}
+	return r, nil
+}
+
+// Valid checks the structure of a rotation, not the signatures
+func (sr *SignedRotation) Valid() (err error) {
+	if len(sr.Data) == 0 || len(sr.Data) > 2*MaxSignedKeySize {
+		return ErrTooBig
+	}
+	if len(sr.Signature) == 0 || len(sr.Signature) > MaxSignatureSize {
+		return ErrBadSignature
+	}
+	r, err := sr.GetRotation()
+	if err != nil {
+		return err
+	}
+	if err := ValidFingerPrint(r.Old); err != nil {
+		return err
+	}
+	_, err = r.NewKey()
+	return err
+}
+
+// Check the rotation against the retiring key and the successor itself
+func (sr *SignedRotation) Check(old *SignedKey) (r *Rotation, err error) {
+	r, err = sr.GetRotation()
+	if err != nil {
+		return nil, err
+	}
+	oldFp, err := old.GetFingerPrint()
+	if err != nil {
+		return nil, err
+	}
+	if oldFp != r.Old {
+		return nil, ErrKeyMismatch
+	}
+	err = old.Verify(sr.Data, sr.Signature)
+	if err != nil {
+		return nil, err
+	}
+	next, err := r.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	err = next.Check()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (sr *SignedRotation) Encode() (data []byte, err error) {
+	var b bytes.Buffer
+	err = gob.NewEncoder(&b).Encode(sr)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func DecodeSignedRotation(data []byte) (sr *SignedRotation, err error) {
+	err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&sr)
+	if err != nil {
+		return nil, err
+	}
+	err = sr.Valid()
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Rotate : replace the local key with a successor signed by the old one.
+// The old private key is kept in private/retired.
+func (ks *KeyStore) Rotate() (sr *SignedRotation, err error) {
+	return ks.RotateAlg(DefaultAlgorithm)
+}
+
+// RotateAlg : rotate to a successor of the given algorithm
+func (ks *KeyStore) RotateAlg(alg string) (sr *SignedRotation, err error) {
+	old, err := ks.LocalKey()
+	if err != nil {
+		return nil, err
+	}
+	next, err := ks.NewLocalKeyAlg(alg)
+	if err != nil {
+		return nil, err
+	}
+	sigK, err := next.MakeSigned()
+	if err != nil {
+		return nil, err
+	}
+	sr, err = old.MakeRotation(sigK)
+	if err != nil {
+		return nil, err
+	}
+	// the old key is retired first so private never holds two
+	retired := ks.path + "/private/retired"
+	err = os.MkdirAll(retired, 0700)
+	if err != nil {
+		return nil, err
+	}
+	name := "/" + old.FingerPrint() + ".key"
+	err = os.Rename(ks.path+"/private"+name, retired+name)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.Save(next)
+	if err != nil {
+		if err := os.Rename(retired+name, ks.path+"/private"+name); err != nil {
+			logger.Criticalf("Old key left in %s %v", retired, err)
+		}
+		return nil, err
+	}
+	err = ks.PutPublic(sigK, "public")
+	if err != nil {
+		return nil, err
+	}
+	err = ks.PutRotation(sr)
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// TryRotation : check a gossiped rotation and trust the successor
+func (ks *KeyStore) TryRotation(sr *SignedRotation) (r *Rotation, err error) {
+	r, err = sr.GetRotation()
+	if err != nil {
+		return nil, err
+	}
+	old, ok := ks.CacheKey(r.Old, "public")
+	if !ok {
+		return nil, ErrNoKey
+	}
+	r, err = sr.Check(old)
+	if err != nil {
+		return nil, err
+	}
+	next, err := r.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	err = ks.PutPublicFrom(next, "public", SourceRotation, "")
+	if err != nil {
+		return nil, err
+	}
+	err = ks.PutRotation(sr)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (ks *KeyStore) PutRotation(sr *SignedRotation) (err error) {
+	r, err := sr.GetRotation()
+	if err != nil {
+		return err
+	}
+	data, err := sr.Encode()
+	if err != nil {
+		return err
+	}
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("rotations"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(r.Old), data)
+	})
+	if err != nil {
+		return err
+	}
+	ks.trust.dirty()
+	return nil
+}
+
+// GetRotation : the rotation away from a retired key
+func (ks *KeyStore) GetRotation(fp string) (sr *SignedRotation, err error) {
+	err = ks.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("rotations"))
+		if bucket == nil {
+			return ErrNoKey
+		}
+		data := bucket.Get([]byte(fp))
+		if data == nil {
+			return ErrNoKey
+		}
+		sr, err = DecodeSignedRotation(data)
+		return err
+	})
+	return sr, err
+}
+
+// Successor : follow rotations from a key to its current replacement
+func (ks *KeyStore) Successor(fp string) (current string) {
+	current = fp
+	// bounded in case of a rotation loop
+	for i := 0; i < 64; i++ {
+		sr, err := ks.GetRotation(current)
+		if err != nil {
+			return current
+		}
+		r, err := sr.GetRotation()
+		if err != nil {
+			return current
+		}
+		sigK, err := r.NewKey()
+		if err != nil {
+			return current
+		}
+		next, err := sigK.GetFingerPrint()
+		if err != nil {
+			return current
+		}
+		current = next
+	}
+	return current
+}
@@ -0,0 +1,83 @@
+package keys
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	k, err := (&KeyStore{}).NewLocalKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Expires = time.Now().Add(-time.Hour)
+	sigK, _ := k.MakeSigned()
+	if err := sigK.Check(); err != ErrExpired {
+		t.Errorf("expired key got %v", err)
+	}
+	k.Expires = time.Time{}
+	sigK, _ = k.MakeSigned()
+	if err := sigK.Check(); err != nil {
+		t.Errorf("key without expiry got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ks, err := NewKeyStore(t.TempDir()+"/a", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	other, err := NewKeyStore(t.TempDir()+"/b", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	old, _ := ks.LocalKey()
+	oldK, _ := old.MakeSigned()
+	other.PutPublic(oldK, "public")
+
+	sr, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := ks.LocalKey()
+	if err != nil || next.FingerPrint() == old.FingerPrint() {
+		t.Fatalf("local key not replaced %v", err)
+	}
+	if ks.Successor(old.FingerPrint()) != next.FingerPrint() {
+		t.Errorf("successor not recorded")
+	}
+	// the other node trusts the old key so takes the new one
+	if _, err := other.TryRotation(sr); err != nil {
+		t.Fatal(err)
+	}
+	if !other.HaveKey(next.FingerPrint(), "public") {
+		t.Errorf("successor not trusted")
+	}
+	// a rotation from a key we do not hold is refused
+	third, _ := NewKeyStore(t.TempDir()+"/c", plaintext)
+	defer third.Close()
+	if _, err := third.TryRotation(sr); err == nil {
+		t.Errorf("rotation from unknown key accepted")
+	}
+}
+
+func TestManyPrivate(t *testing.T) {
+	dir := t.TempDir() + "/a"
+	ks, err := NewKeyStore(dir, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	extra, _ := ks.NewLocalKey()
+	if err := ks.Save(extra); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.LocalKey(); err != ErrManyPrivate {
+		t.Errorf("two local keys got %v", err)
+	}
+	if _, err := LocalFingerPrint(dir); err != ErrManyPrivate {
+		t.Errorf("two local keys got %v", err)
+	}
+}
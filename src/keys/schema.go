@@ -0,0 +1,104 @@
+package keys
+
+// keystore layout versions, each migration moves the bolt
+// store up one version inside a single transaction
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrSchema = errors.New("Keystore is from a newer version")
+
+// buckets every keystore has
+var buckets = []string{"public", "keylist", "rotations", "revoked", "certs", "meta", "marks", "schema"}
+
+// migrations[i] moves the store from version i to i+1
+var migrations = []func(tx *bolt.Tx) error{
+	// 1 : the buckets
+	func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2 : meta for keys stored before it was kept
+	func(tx *bolt.Tx) error {
+		now := time.Now()
+		return tx.Bucket([]byte("public")).ForEach(func(k, v []byte) error {
+			meta, err := getMeta(tx, string(k))
+			if err != nil || !meta.FirstSeen.IsZero() {
+				return err
+			}
+			meta.FirstSeen = now
+			meta.LastSeen = now
+			meta.Source = "unknown"
+			return setMeta(tx, string(k), meta)
+		})
+	},
+	// 3 : gossiped keys held back until vouched for
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("quarantine"))
+		return err
+	},
+}
+
+// SchemaVersion is the layout this code writes
+var SchemaVersion = uint64(len(migrations))
+
+func getVersion(tx *bolt.Tx) uint64 {
+	bucket := tx.Bucket([]byte("schema"))
+	if bucket == nil {
+		return 0
+	}
+	data := bucket.Get([]byte("version"))
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+func setVersion(tx *bolt.Tx, version uint64) (err error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("schema"))
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, version)
+	return bucket.Put([]byte("version"), data)
+}
+
+// Version : the layout version of the open store
+func (ks *KeyStore) Version() (version uint64) {
+	ks.db.View(func(tx *bolt.Tx) error {
+		version = getVersion(tx)
+		return nil
+	})
+	return version
+}
+
+// upgrade runs the migrations the store has not had yet
+func (ks *KeyStore) upgrade() (err error) {
+	version := ks.Version()
+	if version > SchemaVersion {
+		return ErrSchema
+	}
+	for ; version < SchemaVersion; version++ {
+		logger.Infof("Keystore schema %d -> %d", version, version+1)
+		err = ks.db.Update(func(tx *bolt.Tx) error {
+			err := migrations[version](tx)
+			if err != nil {
+				return err
+			}
+			return setVersion(tx, version+1)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
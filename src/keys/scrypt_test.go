@@ -0,0 +1,35 @@
+package keys
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// test vectors from RFC 7914, against the vendored scrypt
+func TestScrypt(t *testing.T) {
+	vectors := []struct {
+		pass, salt string
+		N, r, p    int
+		want       string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, v := range vectors {
+		key, err := scrypt.Key([]byte(v.pass), []byte(v.salt), v.N, v.r, v.p, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(key); got != v.want {
+			t.Errorf("scrypt(%q, %q) = %s", v.pass, v.salt, got)
+		}
+	}
+	if _, err := sealKey(nil, nil, &SealedKey{N: 1000, R: 1, P: 1}); err == nil {
+		t.Errorf("N not a power of two accepted")
+	}
+	if _, err := sealKey(nil, nil, &SealedKey{N: 2 * MaxScryptN, R: 1, P: 1}); err != ErrScryptParams {
+		t.Errorf("N over the limit got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package keys
+
+// private keys at rest are sealed with a passphrase,
+// scrypt derives the key and nacl secretbox does the rest
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+
+	MaxScryptN = 1 << 20 // largest cost a key file may ask for
+
+	saltSize  = 32
+	nonceSize = 24
+)
+
+var (
+	ErrLocked       = errors.New("Private key is sealed, no passphrase given")
+	ErrPassphrase   = errors.New("Wrong passphrase")
+	ErrNoPassphrase = errors.New("No passphrase and plaintext keys not enabled")
+	ErrScryptParams = errors.New("Bad scrypt parameters")
+)
+
+// Passphrase unlocks the private keys on disk,
+// leaving them unencrypted has to be asked for.
+type Passphrase struct {
+	Secret    []byte
+	Plaintext bool
+}
+
+// SealedKey holds the secret parts of a StoredKey
+type SealedKey struct {
+	Salt  string // hex
+	N     int
+	R     int
+	P     int
+	Nonce string // hex
+	Box   string // hex secretbox of the secrets
+}
+
+// secrets are the parts of a key that get sealed
+type secrets struct {
+	Private    string
+	BoxPrivate string
+}
+
+func (sk *StoredKey) seal(passphrase []byte) (sealed *StoredKey, err error) {
+	s := &SealedKey{N: ScryptN, R: ScryptR, P: ScryptP}
+	salt := make([]byte, saltSize)
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key, err := sealKey(passphrase, salt, s)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&secrets{Private: sk.Private, BoxPrivate: sk.BoxPrivate})
+	if err != nil {
+		return nil, err
+	}
+	s.Salt = hex.EncodeToString(salt)
+	s.Nonce = hex.EncodeToString(nonce[:])
+	s.Box = hex.EncodeToString(secretbox.Seal(nil, data, &nonce, key))
+	sealed = &StoredKey{}
+	*sealed = *sk
+	sealed.Private = ""
+	sealed.BoxPrivate = ""
+	sealed.Sealed = s
+	return sealed, nil
+}
+
+func (sk *StoredKey) open(passphrase []byte) (opened *StoredKey, err error) {
+	s := sk.Sealed
+	salt, err := hex.DecodeString(s.Salt)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(s.Nonce)
+	if err != nil || len(raw) != nonceSize {
+		return nil, ErrPassphrase
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], raw)
+	box, err := hex.DecodeString(s.Box)
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealKey(passphrase, salt, s)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := secretbox.Open(nil, box, &nonce, key)
+	if !ok {
+		return nil, ErrPassphrase
+	}
+	sec := &secrets{}
+	err = json.Unmarshal(data, sec)
+	if err != nil {
+		return nil, err
+	}
+	opened = &StoredKey{}
+	*opened = *sk
+	opened.Private = sec.Private
+	opened.BoxPrivate = sec.BoxPrivate
+	opened.Sealed = nil
+	return opened, nil
+}
+
+// sealKey : the secretbox key for s, a key file asking
+// for more than MaxScryptN is refused before deriving
+func sealKey(passphrase, salt []byte, s *SealedKey) (key *[32]byte, err error) {
+	if s.N > MaxScryptN {
+		return nil, ErrScryptParams
+	}
+	derived, err := scrypt.Key(passphrase, salt, s.N, s.R, s.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	key = new([32]byte)
+	copy(key[:], derived)
+	return key, nil
+}
+
+// saveStored writes a private key, sealed unless plaintext was asked for
+func (ks *KeyStore) saveStored(path string, lc *StoredKey) (err error) {
+	out := lc
+	if !ks.pass.Plaintext {
+		out, err = lc.seal(ks.pass.Secret)
+		if err != nil {
+			return err
+		}
+	}
+	enc, err := json.MarshalIndent(out, "", " ")
+	if err != nil {
+		return err
+	}
+	// write aside and move into place so a failed write keeps the old key
+	err = os.WriteFile(path+".tmp", enc, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	ks.privLock.Lock()
+	ks.priv[lc.FingerPrint()] = lc
+	ks.privLock.Unlock()
+	return nil
+}
+
+// loadStored reads a private key, opening it if it is sealed
+func (ks *KeyStore) loadStored(path string) (lc *StoredKey, err error) {
+	fp := filepath.Base(path)
+	fp = fp[:len(fp)-len(filepath.Ext(fp))]
+	ks.privLock.Lock()
+	lc, ok := ks.priv[fp]
+	ks.privLock.Unlock()
+	if ok {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return lc, nil
+	}
+	lc, err = readStored(path)
+	if err != nil {
+		return nil, err
+	}
+	if lc.HavePrivate == false {
+		return nil, ErrNoPrivate
+	}
+	if lc.Sealed != nil {
+		if len(ks.pass.Secret) == 0 {
+			return nil, ErrLocked
+		}
+		lc, err = lc.open(ks.pass.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ks.privLock.Lock()
+	ks.priv[fp] = lc
+	ks.privLock.Unlock()
+	return lc, nil
+}
+
+// Passwd : seal every private key again under a new passphrase
+func (ks *KeyStore) Passwd(pass *Passphrase) (err error) {
+	if pass == nil || !pass.Plaintext && len(pass.Secret) == 0 {
+		return ErrNoPassphrase
+	}
+	files, err := ks.privateFiles()
+	if err != nil {
+		return err
+	}
+	opened := make(map[string]*StoredKey)
+	for _, path := range files {
+		lc, err := ks.loadStored(path)
+		if err != nil {
+			return err
+		}
+		opened[path] = lc
+	}
+	ks.pass = pass
+	for path, lc := range opened {
+		err = ks.saveStored(path, lc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// privateFiles : the local and retired private key files
+func (ks *KeyStore) privateFiles() (files []string, err error) {
+	files, err = filepath.Glob(ks.path + "/private/*.key")
+	if err != nil {
+		return nil, err
+	}
+	retired, err := filepath.Glob(ks.path + "/private/retired/*.key")
+	if err != nil {
+		return nil, err
+	}
+	return append(files, retired...), nil
+}
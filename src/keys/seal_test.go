@@ -0,0 +1,81 @@
+package keys
+
+import (
+	"testing"
+)
+
+var plaintext = &Passphrase{Plaintext: true}
+
+func TestSeal(t *testing.T) {
+	path := t.TempDir() + "/keys"
+	if _, err := NewKeyStore(path, nil); err != ErrNoPassphrase {
+		t.Errorf("new store without passphrase got %v", err)
+	}
+	path = t.TempDir() + "/keys"
+	ks, err := NewKeyStore(path, &Passphrase{Secret: []byte("one")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, _ := ks.LocalKey()
+	fp := lc.FingerPrint()
+	ks.Close()
+	onDisk, err := readStored(path + "/private/" + fp + ".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk.Sealed == nil || onDisk.Private != "" || onDisk.BoxPrivate != "" {
+		t.Errorf("private key not sealed on disk")
+	}
+	if _, err := NewKeyStore(path, &Passphrase{Secret: []byte("two")}); err != ErrPassphrase {
+		t.Errorf("wrong passphrase got %v", err)
+	}
+	if _, err := NewKeyStore(path, plaintext); err != ErrLocked {
+		t.Errorf("sealed key opened without passphrase %v", err)
+	}
+
+	// change the passphrase
+	ks, err = NewKeyStore(path, &Passphrase{Secret: []byte("one")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Passwd(&Passphrase{Secret: []byte("two")}); err != nil {
+		t.Fatal(err)
+	}
+	ks.Close()
+	ks, err = NewKeyStore(path, &Passphrase{Secret: []byte("two")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	lc, err = ks.LocalKey()
+	if err != nil || lc.FingerPrint() != fp {
+		t.Fatalf("key after passwd %v", err)
+	}
+	if _, err := lc.Sign([]byte("data")); err != nil {
+		t.Errorf("sign with opened key %v", err)
+	}
+}
+
+func TestSealMigrate(t *testing.T) {
+	path := t.TempDir() + "/keys"
+	ks, err := NewKeyStore(path, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, _ := ks.LocalKey()
+	fp := lc.FingerPrint()
+	ks.Close()
+	if _, err := NewKeyStore(path, nil); err != ErrNoPassphrase {
+		t.Errorf("plaintext key opened without opt in %v", err)
+	}
+	// opening a plaintext store with a passphrase seals it
+	ks, err = NewKeyStore(path, &Passphrase{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.Close()
+	onDisk, _ := readStored(path + "/private/" + fp + ".key")
+	if onDisk.Sealed == nil || onDisk.Private != "" {
+		t.Errorf("plaintext key not sealed by migration")
+	}
+}
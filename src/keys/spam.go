@@ -0,0 +1,326 @@
+package keys
+
+// admission of gossiped keys, anyone on the mesh can make keys so
+// new ones are rate limited per source peer, can be made to carry a
+// proof of work, and the ones nobody vouches for are capped and can
+// be held back in quarantine
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	DefaultWorkBits     = 16   // proof of work minted into new keys
+	DefaultRate         = 1.0  // new keys a second from one source peer
+	DefaultBurst        = 64   // new keys from one source peer at once
+	DefaultMaxUntrusted = 1024 // gossiped keys held that nobody vouches for
+
+	maxLimiters = 1024 // source peers tracked before full buckets are dropped
+)
+
+var (
+	ErrRateLimited = errors.New("Too many new keys from peer")
+	ErrWork        = errors.New("Key has too little proof of work")
+	ErrQuarantined = errors.New("Key held in quarantine until vouched for")
+	ErrBadPolicy   = errors.New("Admission limits can not be negative")
+	ErrPolicyWork  = errors.New("Admission needs more work than keys are minted with")
+)
+
+// Policy decides which gossiped keys are taken,
+// zero Rate, Burst and MaxUntrusted take the defaults
+type Policy struct {
+	Rate         float64 // new keys a second from one source peer
+	Burst        int
+	MaxUntrusted int  // the least recently seen go first
+	WorkBits     int  // proof of work needed on gossiped keys, 0 for none
+	Quarantine   bool // hold keys nobody vouches for out of the public bucket
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		Rate:         DefaultRate,
+		Burst:        DefaultBurst,
+		MaxUntrusted: DefaultMaxUntrusted,
+	}
+}
+
+// Valid : check the limits make sense, more work than
+// DefaultWorkBits would refuse every key made here
+func (pol Policy) Valid() error {
+	if pol.Rate < 0 || pol.Burst < 0 || pol.MaxUntrusted < 0 || pol.WorkBits < 0 {
+		return ErrBadPolicy
+	}
+	if pol.WorkBits > DefaultWorkBits {
+		return ErrPolicyWork
+	}
+	return nil
+}
+
+func (pol Policy) withDefaults() Policy {
+	def := DefaultPolicy()
+	if pol.Rate <= 0 {
+		pol.Rate = def.Rate
+	}
+	if pol.Burst <= 0 {
+		pol.Burst = def.Burst
+	}
+	if pol.MaxUntrusted <= 0 {
+		pol.MaxUntrusted = def.MaxUntrusted
+	}
+	return pol
+}
+
+// workBits : the leading zero bits of sha256(fp:work)
+func workBits(fp string, work uint64) (n int) {
+	sum := sha256.Sum256([]byte(fp + ":" + strconv.FormatUint(work, 10)))
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// mintWork : the first stamp with at least n bits of work on fp
+func mintWork(fp string, n int) (work uint64) {
+	for workBits(fp, work) < n {
+		work++
+	}
+	return work
+}
+
+// WorkBits : the proof of work carried by the key
+func (dk *DistKey) WorkBits() int {
+	return workBits(dk.FingerPrint, dk.Work)
+}
+
+// SetPolicy : change how gossiped keys are admitted
+func (ks *KeyStore) SetPolicy(pol Policy) {
+	ks.policyLock.Lock()
+	ks.policy = pol.withDefaults()
+	ks.policyLock.Unlock()
+}
+
+// Policy : how gossiped keys are admitted
+func (ks *KeyStore) Policy() Policy {
+	ks.policyLock.RLock()
+	defer ks.policyLock.RUnlock()
+	return ks.policy
+}
+
+// vouched : keys trusted locally or by certification
+func (ks *KeyStore) vouched(fp string) bool {
+	return ks.Marked(fp) == MarkTrusted || ks.Trust(fp) != TrustUnknown
+}
+
+// admit : the bucket a checked gossiped key goes in
+func (ks *KeyStore) admit(sigK *SignedKey, fp string) (bucket string, err error) {
+	if ks.vouched(fp) {
+		return "public", nil
+	}
+	pol := ks.Policy()
+	dk, err := sigK.GetDistKey()
+	if err != nil {
+		return "", err
+	}
+	if dk.WorkBits() < pol.WorkBits {
+		return "", ErrWork
+	}
+	if pol.Quarantine {
+		return "quarantine", nil
+	}
+	return "public", nil
+}
+
+// Quarantined : is the key held back until vouched for
+func (ks *KeyStore) Quarantined(fp string) (have bool) {
+	ks.db.View(func(tx *bolt.Tx) error {
+		have = tx.Bucket([]byte("quarantine")).Get([]byte(fp)) != nil
+		return nil
+	})
+	return have
+}
+
+// Promote : move quarantined keys that are now vouched for into
+// the public bucket, returns the keys moved
+func (ks *KeyStore) Promote() (promoted []*SignedKey, err error) {
+	fps, err := ks.ListKeys("quarantine")
+	if err != nil || len(fps) == 0 {
+		return nil, err
+	}
+	// work out trust before the write, it reads the store
+	var move []string
+	for _, fp := range fps {
+		if ks.vouched(fp) && ks.refused(fp) == nil {
+			move = append(move, fp)
+		}
+	}
+	if len(move) == 0 {
+		return nil, nil
+	}
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket([]byte("quarantine"))
+		public := tx.Bucket([]byte("public"))
+		for _, fp := range move {
+			data := quarantine.Get([]byte(fp))
+			sigK, err := DecodeSignedKey(data)
+			if err != nil {
+				return err
+			}
+			err = public.Put([]byte(fp), data)
+			if err != nil {
+				return err
+			}
+			err = quarantine.Delete([]byte(fp))
+			if err != nil {
+				return err
+			}
+			promoted = append(promoted, sigK)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range move {
+		logger.Infof("Key %s out of quarantine", fp)
+	}
+	return promoted, nil
+}
+
+// promote : Promote for local changes, a running peer
+// picks the moved keys up when it next loads
+func (ks *KeyStore) promote() {
+	if _, err := ks.Promote(); err != nil {
+		logger.Errorf("Promote %v", err)
+	}
+}
+
+// Evict : drop the least recently seen gossiped keys nobody vouches
+// for until there are no more than the policy allows, returns the
+// finger prints dropped
+func (ks *KeyStore) Evict() (evicted []string, err error) {
+	max := ks.Policy().MaxUntrusted
+	levels := ks.TrustAll()
+	type untrusted struct {
+		fp, bucket string
+		last       time.Time
+	}
+	var found []untrusted
+	err = ks.db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{"public", "quarantine"} {
+			err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				fp := string(k)
+				if levels[fp] != TrustUnknown || ks.Marked(fp) != MarkNone {
+					return nil
+				}
+				meta, err := getMeta(tx, fp)
+				if err != nil || meta.Source != SourceGossip {
+					return nil
+				}
+				found = append(found, untrusted{fp, name, meta.LastSeen})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || len(found) <= max {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].last.Before(found[j].last)
+	})
+	found = found[:len(found)-max]
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		for _, u := range found {
+			if err := tx.Bucket([]byte(u.bucket)).Delete([]byte(u.fp)); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte("meta")).Delete([]byte(u.fp)); err != nil {
+				return err
+			}
+			evicted = append(evicted, u.fp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range evicted {
+		ks.uncache(fp)
+	}
+	logger.Warningf("Evicted %d untrusted keys", len(evicted))
+	return evicted, nil
+}
+
+// limiter is a token bucket of new keys for each source peer
+type limiter struct {
+	mtx     sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[mesh.PeerName]*tokens
+}
+
+type tokens struct {
+	left float64
+	last time.Time
+}
+
+func newLimiter(pol Policy) *limiter {
+	l := &limiter{buckets: make(map[mesh.PeerName]*tokens)}
+	l.set(pol)
+	return l
+}
+
+func (l *limiter) set(pol Policy) {
+	pol = pol.withDefaults()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.rate = pol.Rate
+	l.burst = float64(pol.Burst)
+}
+
+// allow takes a token for a new key from src
+func (l *limiter) allow(src mesh.PeerName, now time.Time) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	t, ok := l.buckets[src]
+	if !ok {
+		if len(l.buckets) >= maxLimiters {
+			l.prune(now)
+		}
+		t = &tokens{left: l.burst, last: now}
+		l.buckets[src] = t
+	}
+	t.left += now.Sub(t.last).Seconds() * l.rate
+	if t.left > l.burst {
+		t.left = l.burst
+	}
+	t.last = now
+	if t.left < 1 {
+		return false
+	}
+	t.left--
+	return true
+}
+
+// prune forgets sources that have refilled, they start full anyway
+func (l *limiter) prune(now time.Time) {
+	for src, t := range l.buckets {
+		if t.left+now.Sub(t.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, src)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package keys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func gossipKey(t *testing.T) (sigK *SignedKey, fp string) {
+	k, err := (&KeyStore{}).NewLocalKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigK, _ = k.MakeSigned()
+	return sigK, k.FingerPrint()
+}
+
+func TestWork(t *testing.T) {
+	sigK, fp := gossipKey(t)
+	dk, _ := sigK.GetDistKey()
+	if dk.WorkBits() < DefaultWorkBits {
+		t.Errorf("new key has %d bits of work", dk.WorkBits())
+	}
+	ks, _ := NewKeyStore(t.TempDir()+"/a", plaintext)
+	defer ks.Close()
+	ks.SetPolicy(Policy{WorkBits: 64})
+	if err := ks.TryInsertFrom(sigK, "public", SourceGossip, ""); err != ErrWork {
+		t.Errorf("gossip without work got %v", err)
+	}
+	if err := ks.TryInsertFrom(sigK, "public", SourceImport, ""); err != nil {
+		t.Errorf("import without work got %v", err)
+	}
+	if !ks.HaveKey(fp, "public") {
+		t.Errorf("imported key missing")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(Policy{Rate: 1, Burst: 2})
+	now := time.Now()
+	src := mesh.PeerName(1)
+	if !l.allow(src, now) || !l.allow(src, now) || l.allow(src, now) {
+		t.Errorf("burst not held to")
+	}
+	if !l.allow(mesh.PeerName(2), now) {
+		t.Errorf("sources share a bucket")
+	}
+	if !l.allow(src, now.Add(time.Second)) {
+		t.Errorf("bucket did not refill")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ks, _ := NewKeyStore(t.TempDir()+"/a", plaintext)
+	defer ks.Close()
+	ks.SetPolicy(Policy{Quarantine: true})
+	sigK, fp := gossipKey(t)
+	if err := ks.TryInsertFrom(sigK, "public", SourceGossip, ""); err != ErrQuarantined {
+		t.Fatalf("unvouched key got %v", err)
+	}
+	if ks.HaveKey(fp, "public") || !ks.Quarantined(fp) {
+		t.Errorf("key not held in quarantine")
+	}
+	if _, err := ks.Certify(fp, TrustMarginal); err != nil {
+		t.Fatal(err)
+	}
+	if !ks.HaveKey(fp, "public") || ks.Quarantined(fp) {
+		t.Errorf("certified key not promoted")
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ks, _ := NewKeyStore(t.TempDir()+"/a", plaintext)
+	defer ks.Close()
+	ks.SetPolicy(Policy{MaxUntrusted: 2})
+	var fps []string
+	for i := 0; i < 3; i++ {
+		sigK, fp := gossipKey(t)
+		if err := ks.TryInsertFrom(sigK, "public", SourceGossip, ""); err != nil {
+			t.Fatal(err)
+		}
+		fps = append(fps, fp)
+	}
+	// the first is seen again so the second is the oldest
+	ks.Seen(fps[:1], "")
+	evicted, err := ks.Evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 1 || evicted[0] != fps[1] {
+		t.Errorf("evicted %v of %v", evicted, fps)
+	}
+	if local, _ := ks.LocalKey(); !ks.HaveKey(local.FingerPrint(), "public") {
+		t.Errorf("local key evicted")
+	}
+}
+
+func TestPolicyValid(t *testing.T) {
+	if err := DefaultPolicy().Valid(); err != nil {
+		t.Errorf("default policy %v", err)
+	}
+	if err := (Policy{Burst: -1}).Valid(); err != ErrBadPolicy {
+		t.Errorf("negative burst %v", err)
+	}
+	if err := (Policy{WorkBits: DefaultWorkBits + 1}).Valid(); err != ErrPolicyWork {
+		t.Errorf("work above minted %v", err)
+	}
+}
+
+func TestLimitBySource(t *testing.T) {
+	p := NewPeer(t.TempDir()+"/a", plaintext, logger)
+	p.SetPolicy(Policy{Rate: 0.001, Burst: 2})
+	merged := func(src mesh.PeerName, n int) int {
+		msg := newMessage()
+		for i := 0; i < n; i++ {
+			sigK, fp := gossipKey(t)
+			msg.Keys[fp] = sigK
+		}
+		st := p.merge(src, msg)
+		if st == nil {
+			return 0
+		}
+		return len(st.set)
+	}
+	if got := merged(mesh.PeerName(1), 4); got != 2 {
+		t.Errorf("flooding peer got %d keys in", got)
+	}
+	// another peer has its own bucket
+	if got := merged(mesh.PeerName(2), 2); got != 2 {
+		t.Errorf("second peer got %d keys of 2 in", got)
+	}
+	// and periodic gossip is not charged to a shared one
+	if got := merged(mesh.UnknownPeerName, 4); got != 4 {
+		t.Errorf("periodic gossip got %d keys of 4 in", got)
+	}
+}
@@ -1,22 +1,42 @@
 package keys
 
 import (
-	"bytes"
 	"sync"
 
-	"encoding/gob"
-
+	"crypto/rand"
 	"github.com/op/go-logging"
 	"github.com/weaveworks/mesh"
-    "crypto/rand"
-    "math/big"
+	"math/big"
+	"sort"
+	"time"
 )
 
 var log = logging.MustGetLogger("keyset")
 
 type state struct {
-	mtx sync.RWMutex
-	set map[string]*SignedKey
+	mtx       sync.RWMutex
+	set       map[string]*SignedKey
+	claims    map[string]*SignedClaim    // by mesh peer name
+	rotations map[string]*SignedRotation // by retired finger print
+	revoked   map[string]*SignedRevocation
+	certs     map[string]*SignedCertification // by issuer:subject
+	added     map[string]time.Time            // when each key joined the set
+}
+
+// message is the wire format of the keybase channel
+type message struct {
+	Keys      map[string]*SignedKey
+	Claims    map[string]*SignedClaim
+	Rotations map[string]*SignedRotation
+	Revoked   map[string]*SignedRevocation
+	Certs     map[string]*SignedCertification
+	Want      []string // finger prints asked for by unicast
+	Have      []string // finger prints held, sent to sync a new peer
+}
+
+func (msg *message) empty() bool {
+	return len(msg.Keys) == 0 && len(msg.Claims) == 0 && len(msg.Rotations) == 0 &&
+		len(msg.Revoked) == 0 && len(msg.Certs) == 0 && len(msg.Want) == 0 && len(msg.Have) == 0
 }
 
 // state implements GossipData.
@@ -27,7 +47,12 @@ var _ mesh.GossipData = &state{}
 // Other peers will populate us with data.
 func newState() *state {
 	return &state{
-		set: make(map[string]*SignedKey),
+		set:       make(map[string]*SignedKey),
+		claims:    make(map[string]*SignedClaim),
+		rotations: make(map[string]*SignedRotation),
+		revoked:   make(map[string]*SignedRevocation),
+		certs:     make(map[string]*SignedCertification),
+		added:     make(map[string]time.Time),
 	}
 }
 
@@ -36,102 +61,339 @@ func (st *state) String() string {
 	for i, _ := range st.set {
 		s += i + "\n"
 	}
+	for i, _ := range st.claims {
+		s += "claim " + i + "\n"
+	}
+	for i, _ := range st.rotations {
+		s += "rotation " + i + "\n"
+	}
+	for i, _ := range st.revoked {
+		s += "revoked " + i + "\n"
+	}
+	for i, _ := range st.certs {
+		s += "cert " + i + "\n"
+	}
 	return s
 }
 
 func (st *state) insert(sigK *SignedKey) (state *state) {
-	st.mtx.RLock()
-	defer st.mtx.RUnlock()
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
 	fp, err := sigK.GetFingerPrint()
 	if err != nil {
 		logger.Critical(err)
 	}
-	st.set[fp] = sigK
+	st.add(fp, sigK)
 	return
 }
 
+// add puts a key in the set, noting when it was new, hold the lock
+func (st *state) add(fp string, sigK *SignedKey) {
+	if _, ok := st.set[fp]; !ok {
+		st.added[fp] = time.Now()
+	}
+	st.set[fp] = sigK
+}
+
+// remove stops gossiping a key we no longer hold
+func (st *state) remove(fp string) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	delete(st.set, fp)
+	delete(st.added, fp)
+}
+
+func (st *state) insertClaim(name string, sc *SignedClaim) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.claims[name] = sc
+}
+
+// removeClaim stops gossiping a claim the directory dropped
+func (st *state) removeClaim(name string) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	delete(st.claims, name)
+}
+
+func (st *state) insertRotation(fp string, sr *SignedRotation) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.rotations[fp] = sr
+}
+
+// insertRevocation records the revocation and stops gossiping the key
+func (st *state) insertRevocation(fp string, sr *SignedRevocation) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.revoked[fp] = sr
+	delete(st.set, fp)
+	delete(st.added, fp)
+}
+
+func (st *state) insertCert(id string, sc *SignedCertification) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.certs[id] = sc
+}
+
+func (st *state) getCert(id string) (sc *SignedCertification, ok bool) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	sc, ok = st.certs[id]
+	return sc, ok
+}
+
+func (st *state) haveRevocation(fp string) (ok bool) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	_, ok = st.revoked[fp]
+	return ok
+}
+
+func (st *state) haveRotation(fp string) (ok bool) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	_, ok = st.rotations[fp]
+	return ok
+}
+
+func (st *state) getClaim(name string) (sc *SignedClaim, ok bool) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	sc, ok = st.claims[name]
+	return sc, ok
+}
+
 func (st *state) copy() *state {
 	st.mtx.RLock()
 	defer st.mtx.RUnlock()
 	return &state{
-		set: st.set,
+		set:       st.set,
+		claims:    st.claims,
+		rotations: st.rotations,
+		revoked:   st.revoked,
+		certs:     st.certs,
+		added:     st.added,
 	}
 }
 
-// Encode serializes our complete state to a slice of byte-slices.
-// In this simple example, we use a single JSON-encoded buffer.
+// Encode serializes our complete state to a slice of byte-slices,
+// one for each message decodeMessage takes, so a merged delta
+// of any size is still received.
 func (st *state) Encode() [][]byte {
 	st.mtx.RLock()
 	defer st.mtx.RUnlock()
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(st.set); err != nil {
-		panic(err)
-	}
-	return [][]byte{buf.Bytes()}
-}
-
-func (st *state)GetRand(count int) (partial mesh.GossipData){
-    if len(st.set) == 0{
-        return nil
-    }
-    newSt := newState()
-    var keys []string
-    for i,_ := range st.set{
-        keys = append(keys,i)
-    }
-    for i := 0 ; i< count ; i++ {
-        z,err := rand.Int(rand.Reader,big.NewInt(int64(len(st.set))))
-        if err != nil {
-            panic("CRYPTO FAIL")
-        }
-        k := keys[z.Int64()]
-        newSt.insert(st.set[k])
-    }
-    return newSt
+	b := &batches{}
+	st.fill(b, st.newest())
+	bufs := make([][]byte, 0, len(b.msgs))
+	for _, msg := range b.msgs {
+		buf, err := encodeMessage(msg)
+		if err != nil {
+			panic(err)
+		}
+		bufs = append(bufs, buf)
+	}
+	return bufs
 }
-// Merge merges the other GossipData into this one,
-// and returns our resulting, complete state.
-func (st *state) Merge(other mesh.GossipData) (complete mesh.GossipData) {
-	return st.mergeComplete(other.(*state).copy().set)
+
+// newest : the finger prints of the set, most recently added first,
+// hold the lock
+func (st *state) newest() (fps []string) {
+	fps = make([]string, 0, len(st.set))
+	for fp := range st.set {
+		fps = append(fps, fp)
+	}
+	sort.Slice(fps, func(i, j int) bool {
+		return st.added[fps[i]].After(st.added[fps[j]])
+	})
+	return fps
 }
 
-// Return any key/values that have been mutated, or nil if nothing changed.
-// TODO this needs to check sub keys
-func (st *state) mergeDelta(set map[string]*SignedKey) (delta mesh.GossipData) {
-	st.mtx.Lock()
-	defer st.mtx.Unlock()
-	for fp, v := range set {
-		// Do we have the key in our data
-		//logger.Criticalf("MERGE %v %v", peer, v)
-		err := v.Check()
-		if err == nil {
-			logger.Criticalf("GOOD KEY %v", fp)
-		}
-		if _, ok := st.set[fp]; ok {
-			delete(set, fp) // requirement: it's not part of a delta
+// fingerPrints : up to max finger prints, most recently added first
+func (st *state) fingerPrints(max int) (fps []string) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	fps = st.newest()
+	if len(fps) > max {
+		fps = fps[:max]
+	}
+	return fps
+}
+
+// keys : a copy of the key set
+func (st *state) keys() (set map[string]*SignedKey) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	set = make(map[string]*SignedKey, len(st.set))
+	for i, j := range st.set {
+		set[i] = j
+	}
+	return set
+}
+
+// GetRand : count keys without repeats, half of them the most
+// recently added and the rest drawn from the older ones, with the
+// newest revocations, claims, rotations and certifications one
+// message holds
+func (st *state) GetRand(count int) (partial mesh.GossipData) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	if len(st.set) == 0 {
+		return nil
+	}
+	b := &batches{max: 1}
+	st.fill(b, pick(st.newest(), count))
+	return stateOf(b.first())
+}
+
+// batch : the keys fps and everything else we hold, as
+// many messages as decodeMessage needs them split into
+func (st *state) batch(fps []string) (msgs []*message) {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	b := &batches{}
+	st.fill(b, fps)
+	return b.msgs
+}
+
+// fill : the keys fps then the revocations, rotations, claims
+// and certifications, newest first, hold the lock
+func (st *state) fill(b *batches, fps []string) {
+	for _, fp := range fps {
+		sigK, ok := st.set[fp]
+		if !ok {
 			continue
 		}
-		st.set[fp] = v
+		if msg := b.add(entrySize(fp, sigK.Data, sigK.Signature), func(m *message) bool { return len(m.Keys) == MaxKeys }); msg != nil {
+			msg.Keys[fp] = sigK
+		}
+	}
+	stamps := make(map[string]time.Time, len(st.revoked))
+	for fp, sr := range st.revoked {
+		if r, err := sr.GetRevocation(); err == nil {
+			stamps[fp] = r.Stamp
+		}
+	}
+	for _, fp := range byStamp(stamps) {
+		sr := st.revoked[fp]
+		if msg := b.add(entrySize(fp, sr.Data, sr.Signature), func(m *message) bool { return len(m.Revoked) == MaxKeys }); msg != nil {
+			msg.Revoked[fp] = sr
+		}
 	}
+	stamps = make(map[string]time.Time, len(st.rotations))
+	for fp, sr := range st.rotations {
+		if r, err := sr.GetRotation(); err == nil {
+			stamps[fp] = r.Stamp
+		}
+	}
+	for _, fp := range byStamp(stamps) {
+		sr := st.rotations[fp]
+		if msg := b.add(entrySize(fp, sr.Data, sr.Signature), func(m *message) bool { return len(m.Rotations) == MaxKeys }); msg != nil {
+			msg.Rotations[fp] = sr
+		}
+	}
+	stamps = make(map[string]time.Time, len(st.claims))
+	for name, sc := range st.claims {
+		if c, err := sc.GetClaim(); err == nil {
+			stamps[name] = c.Stamp
+		}
+	}
+	for _, name := range byStamp(stamps) {
+		sc := st.claims[name]
+		if msg := b.add(entrySize(name, sc.Data, sc.Signature), func(m *message) bool { return len(m.Claims) == MaxClaims }); msg != nil {
+			msg.Claims[name] = sc
+		}
+	}
+	stamps = make(map[string]time.Time, len(st.certs))
+	for id, sc := range st.certs {
+		if c, err := sc.GetCertification(); err == nil {
+			stamps[id] = c.Stamp
+		}
+	}
+	for _, id := range byStamp(stamps) {
+		sc := st.certs[id]
+		if msg := b.add(entrySize(id, sc.Data, sc.Signature), func(m *message) bool { return len(m.Certs) == MaxCerts }); msg != nil {
+			msg.Certs[id] = sc
+		}
+	}
+}
 
-	//log.Debugf("%v -> %v", set, delta)
-	if len(set) <= 0 {
-		return nil // per OnGossip requirements
+// pick : count of ids without repeats, half the first ones and
+// the rest drawn from the others, ids is shuffled in place
+func pick(ids []string, count int) []string {
+	if count > len(ids) {
+		count = len(ids)
 	}
-	return &state{
-		set: set, // all remaining elements were novel to us
+	recent := count / 2
+	// a partial shuffle of the older ones picks the rest
+	older := ids[recent:]
+	for i := 0; i < count-recent; i++ {
+		z, err := rand.Int(rand.Reader, big.NewInt(int64(len(older)-i)))
+		if err != nil {
+			panic("CRYPTO FAIL")
+		}
+		j := i + int(z.Int64())
+		older[i], older[j] = older[j], older[i]
 	}
+	return ids[:count]
 }
 
-func (st *state) mergeComplete(set map[string]*SignedKey) (complete mesh.GossipData) {
+// byStamp : the ids most recently signed first, the ones
+// without a stamp are left out
+func byStamp(stamps map[string]time.Time) (ids []string) {
+	ids = make([]string, 0, len(stamps))
+	for id := range stamps {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return stamps[ids[i]].After(stamps[ids[j]])
+	})
+	return ids
+}
+
+// stateOf : msg as gossip data
+func stateOf(msg *message) *state {
+	st := newState()
+	for fp, sigK := range msg.Keys {
+		st.add(fp, sigK)
+	}
+	st.claims, st.rotations, st.revoked, st.certs = msg.Claims, msg.Rotations, msg.Revoked, msg.Certs
+	return st
+}
+
+// Merge merges the other GossipData into this one,
+// and returns our resulting, complete state.
+func (st *state) Merge(other mesh.GossipData) (complete mesh.GossipData) {
+	return st.mergeComplete(other.(*state).copy())
+}
+
+func (st *state) mergeComplete(other *state) (complete mesh.GossipData) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
 
-	for peer, v := range set {
-		st.set[peer] = v
+	for fp, v := range other.set {
+		st.add(fp, v)
+	}
+	for name, v := range other.claims {
+		st.claims[name] = v
+	}
+	for fp, v := range other.rotations {
+		st.rotations[fp] = v
+	}
+	for fp, v := range other.revoked {
+		st.revoked[fp] = v
+	}
+	for id, v := range other.certs {
+		st.certs[id] = v
 	}
 
 	return &state{
-		set: st.set, // n.b. can't .copy() due to lock contention
+		set:       st.set, // n.b. can't .copy() due to lock contention
+		claims:    st.claims,
+		rotations: st.rotations,
+		revoked:   st.revoked,
+		certs:     st.certs,
+		added:     st.added,
 	}
 }
@@ -7,14 +7,14 @@ import (
 
 
 func TestPeer( t *testing.T ){
-    p := NewPeer("keys",logger)
+    p := NewPeer("keys", plaintext, logger)
     r := p.st.GetRand(5)
     fmt.Println("rand",r)
 	t.Errorf("FAIL")
 }
 
 func testStore(t *testing.T) {
-	ks, err := NewKeyStore("keys")
+	ks, err := NewKeyStore("keys", plaintext)
 	if err != nil {
 		fmt.Println(err)
 	}
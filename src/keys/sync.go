@@ -0,0 +1,180 @@
+package keys
+
+// a one off full reconciliation of the keyset with each newly
+// connected mesh peer, instead of waiting on random gossip rounds
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	MaxHave    = 16384           // finger prints in one sync inventory
+	SyncWindow = 2 * time.Minute // keys from a peer we synced with skip the rate limit
+)
+
+// syncs are the peers we asked to reconcile with, how long and for
+// how many keys their answer skips the rate limit, and when we last
+// answered each peer that asked us
+type syncs struct {
+	mtx      sync.Mutex
+	windows  map[mesh.PeerName]*window
+	answered map[mesh.PeerName]time.Time
+}
+
+type window struct {
+	until time.Time
+	left  int // keys still taken without the rate limit
+}
+
+func newSyncs() *syncs {
+	return &syncs{
+		windows:  make(map[mesh.PeerName]*window),
+		answered: make(map[mesh.PeerName]time.Time),
+	}
+}
+
+// start a window for dst after we sent it an inventory of have keys,
+// it takes as many keys as we sent and at least a message of them
+func (s *syncs) start(dst mesh.PeerName, have int) {
+	if have < MaxKeys {
+		have = MaxKeys
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.windows[dst] = &window{until: time.Now().Add(SyncWindow), left: have}
+}
+
+// take : a key from src inside its sync window
+func (s *syncs) take(src mesh.PeerName) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, ok := s.windows[src]
+	if !ok {
+		return false
+	}
+	if time.Now().After(w.until) || w.left <= 0 {
+		delete(s.windows, src)
+		return false
+	}
+	w.left--
+	return true
+}
+
+// answer : may we answer an inventory from src, once a window
+func (s *syncs) answer(src mesh.PeerName) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	if last, ok := s.answered[src]; ok && now.Sub(last) < SyncWindow {
+		return false
+	}
+	if len(s.answered) >= maxLimiters {
+		for name, last := range s.answered {
+			if now.Sub(last) >= SyncWindow {
+				delete(s.answered, name)
+			}
+		}
+	}
+	s.answered[src] = now
+	return true
+}
+
+// SyncNeighbours starts a reconciliation with each neighbour that
+// was not connected last time it was called, call it when the
+// connections change.
+func (p *peer) SyncNeighbours() {
+	p.do(func() {
+		if p.neighbours == nil {
+			return
+		}
+		connected := make(map[mesh.PeerName]bool)
+		for _, name := range p.neighbours() {
+			connected[name] = true
+			if !p.connected[name] {
+				p.sync(name)
+			}
+		}
+		p.connected = connected
+	})
+}
+
+// sync sends dst our inventory, it answers with the keys we lack
+// and asks for the ones it lacks
+func (p *peer) sync(dst mesh.PeerName) {
+	if p.send == nil {
+		return
+	}
+	have := p.st.fingerPrints(MaxHave)
+	buf, err := encodeMessage(&message{Have: have})
+	if err != nil {
+		logger.Errorf("Sync %v", err)
+		return
+	}
+	logger.Infof("Key sync with %v, %d keys", dst, len(have))
+	p.syncing.start(dst, len(have))
+	if err := p.send.GossipUnicast(dst, buf); err != nil {
+		logger.Errorf("Sync with %v %v", dst, err)
+	}
+}
+
+// reconcile answers an inventory from src, run in the loop. A peer
+// is answered once a SyncWindow so it can not have us send our
+// whole state over and over.
+func (p *peer) reconcile(src mesh.PeerName, have []string) {
+	if !p.syncing.answer(src) {
+		logger.Debugf("Key sync from %v too soon", src)
+		return
+	}
+	theirs := make(map[string]bool, len(have))
+	for _, fp := range have {
+		theirs[fp] = true
+	}
+	ours := p.st.keys()
+	var want []string
+	for _, fp := range have {
+		if ours[fp] == nil && p.keyStore.refused(fp) == nil && !p.keyStore.Quarantined(fp) {
+			want = append(want, fp)
+		}
+	}
+	var fps []string
+	for fp := range ours {
+		if !theirs[fp] {
+			fps = append(fps, fp)
+		}
+	}
+	// the keys they lack and everything but keys, split as
+	// decodeMessage takes them, the wants ride along
+	msgs := p.st.batch(fps)
+	for i := 0; len(want) > 0; i++ {
+		if i == len(msgs) {
+			msgs = append(msgs, newMessage())
+		}
+		n := len(want)
+		if n > MaxWants {
+			n = MaxWants
+		}
+		msgs[i].Want, want = want[:n], want[n:]
+	}
+	for _, msg := range msgs {
+		if !msg.empty() {
+			p.unicast(src, msg)
+		}
+	}
+}
+
+// unicast sends msg to dst from the loop
+func (p *peer) unicast(dst mesh.PeerName, msg *message) {
+	buf, err := encodeMessage(msg)
+	if err != nil {
+		logger.Errorf("Unicast %v", err)
+		return
+	}
+	if p.send == nil {
+		return
+	}
+	if err := p.send.GossipUnicast(dst, buf); err != nil {
+		logger.Debugf("Unicast to %v %v", dst, err)
+	}
+}
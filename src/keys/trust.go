@@ -0,0 +1,413 @@
+package keys
+
+// web of trust, keys certify other keys and trust is
+// computed outward from our own key and the configured anchors
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+type Trust int
+
+const (
+	TrustUnknown Trust = iota
+	TrustMarginal
+	TrustFull
+)
+
+const (
+	MaxTrustDepth   = 5 // certification hops from an anchor
+	MarginalsNeeded = 3 // marginal certifications that add up to full
+	MaxCerts        = 4096
+	MaxIssuerCerts  = 256          // certifications held from one issuer
+	MaxHeldCerts    = 4 * MaxCerts // held in all before untrusted issuers are refused
+)
+
+var (
+	ErrBadCert      = errors.New("Bad certification")
+	ErrBadTrust     = errors.New("Unknown trust level")
+	ErrUntrusted    = errors.New("Key is not trusted enough")
+	ErrTooManyCerts = errors.New("Too many certifications")
+)
+
+func (t Trust) String() string {
+	switch t {
+	case TrustMarginal:
+		return "marginal"
+	case TrustFull:
+		return "full"
+	}
+	return "unknown"
+}
+
+// ParseTrust : a trust level from its name
+func ParseTrust(s string) (t Trust, err error) {
+	switch s {
+	case "unknown", "":
+		return TrustUnknown, nil
+	case "marginal":
+		return TrustMarginal, nil
+	case "full":
+		return TrustFull, nil
+	}
+	return TrustUnknown, ErrBadTrust
+}
+
+// Certification is one key vouching for another
+type Certification struct {
+	Issuer  string
+	Subject string
+	Level   Trust
+	Stamp   time.Time
+}
+
+// Certification signed by the issuer, for mesh gossip
+type SignedCertification struct {
+	Data      json.RawMessage
+	Signature string
+}
+
+// certID names a certification in the store and in gossip
+func certID(issuer, subject string) string {
+	return issuer + ":" + subject
+}
+
+// MakeCertification : vouch for subject with this key
+func (sk *StoredKey) MakeCertification(subject string, level Trust) (sc *SignedCertification, err error) {
+	c := &Certification{
+		Issuer:  sk.FingerPrint(),
+		Subject: subject,
+		Level:   level,
+		Stamp:   time.Now(),
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := sk.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	sc = &SignedCertification{
+		Data:      data,
+		Signature: signature,
+	}
+	return sc, nil
+}
+
+func (sc *SignedCertification) GetCertification() (c *Certification, err error) {
+	c = &Certification{}
+	err = json.Unmarshal(sc.Data, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ID : the issuer:subject name of the certification
+func (sc *SignedCertification) ID() (id string, err error) {
+	c, err := sc.GetCertification()
+	if err != nil {
+		return "", err
+	}
+	return certID(c.Issuer, c.Subject), nil
+}
+
+// Valid checks the structure of a certification, not the signature
+func (sc *SignedCertification) Valid() (err error) {
+	if len(sc.Data) == 0 || len(sc.Data) > MaxSignedKeySize {
+		return ErrTooBig
+	}
+	if len(sc.Signature) == 0 || len(sc.Signature) > MaxSignatureSize {
+		return ErrBadSignature
+	}
+	c, err := sc.GetCertification()
+	if err != nil {
+		return err
+	}
+	if c.Level < TrustUnknown || c.Level > TrustFull || c.Issuer == c.Subject {
+		return ErrBadCert
+	}
+	if err := ValidFingerPrint(c.Issuer); err != nil {
+		return err
+	}
+	return ValidFingerPrint(c.Subject)
+}
+
+func (sc *SignedCertification) Encode() (data []byte, err error) {
+	var b bytes.Buffer
+	err = gob.NewEncoder(&b).Encode(sc)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func DecodeSignedCertification(data []byte) (sc *SignedCertification, err error) {
+	err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&sc)
+	if err != nil {
+		return nil, err
+	}
+	err = sc.Valid()
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Certify : vouch for another key with the local key
+func (ks *KeyStore) Certify(subject string, level Trust) (sc *SignedCertification, err error) {
+	local, err := ks.LocalKey()
+	if err != nil {
+		return nil, err
+	}
+	if !ks.HaveKey(subject, "public") && !ks.Quarantined(subject) {
+		return nil, ErrNoKey
+	}
+	sc, err = local.MakeCertification(subject, level)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.putCertification(sc)
+	if err != nil {
+		return nil, err
+	}
+	ks.promote()
+	return sc, nil
+}
+
+// TryCertify : check a gossiped certification against its issuer
+func (ks *KeyStore) TryCertify(sc *SignedCertification) (c *Certification, err error) {
+	c, err = sc.GetCertification()
+	if err != nil {
+		return nil, err
+	}
+	issuer, ok := ks.CacheKey(c.Issuer, "public")
+	if !ok {
+		return nil, ErrNoKey
+	}
+	err = issuer.Verify(sc.Data, sc.Signature)
+	if err != nil {
+		return nil, err
+	}
+	// only a newer certification replaces an old one
+	cur, err := ks.GetCertification(certID(c.Issuer, c.Subject))
+	if err == nil {
+		old, err := cur.GetCertification()
+		if err == nil && !c.Stamp.After(old.Stamp) {
+			return old, nil
+		}
+	}
+	err = ks.putCertification(sc)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// putCertification stores sc, replacing one from the same issuer
+// for the same subject. A new one is refused past MaxIssuerCerts from
+// its issuer, or past MaxHeldCerts in all unless the issuer is trusted.
+func (ks *KeyStore) putCertification(sc *SignedCertification) (err error) {
+	id, err := sc.ID()
+	if err != nil {
+		return err
+	}
+	c, err := sc.GetCertification()
+	if err != nil {
+		return err
+	}
+	data, err := sc.Encode()
+	if err != nil {
+		return err
+	}
+	trusted := ks.Trust(c.Issuer) != TrustUnknown
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("certs"))
+		if err != nil {
+			return err
+		}
+		if bucket.Get([]byte(id)) == nil {
+			if issuerCerts(bucket, c.Issuer) >= MaxIssuerCerts {
+				return ErrTooManyCerts
+			}
+			if !trusted && bucket.Stats().KeyN >= MaxHeldCerts {
+				return ErrTooManyCerts
+			}
+		}
+		return bucket.Put([]byte(id), data)
+	})
+	if err != nil {
+		return err
+	}
+	ks.trust.dirty()
+	return nil
+}
+
+// issuerCerts : the certifications held from issuer
+func issuerCerts(bucket *bolt.Bucket, issuer string) (n int) {
+	prefix := []byte(certID(issuer, ""))
+	cur := bucket.Cursor()
+	for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+		n++
+	}
+	return n
+}
+
+// GetCertification : a certification by issuer:subject
+func (ks *KeyStore) GetCertification(id string) (sc *SignedCertification, err error) {
+	err = ks.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("certs"))
+		if bucket == nil {
+			return ErrNoKey
+		}
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return ErrNoKey
+		}
+		sc, err = DecodeSignedCertification(data)
+		return err
+	})
+	return sc, err
+}
+
+// SetAnchors : keys trusted fully without certification
+func (ks *KeyStore) SetAnchors(anchors []string) {
+	ks.trust.lock.Lock()
+	ks.trust.anchors = anchors
+	ks.trust.lock.Unlock()
+	ks.trust.dirty()
+}
+
+// Trust : the computed trust in a key
+func (ks *KeyStore) Trust(fp string) Trust {
+	ks.trust.lock.Lock()
+	defer ks.trust.lock.Unlock()
+	return ks.levels()[fp]
+}
+
+// TrustAll : the computed trust of every key we have a path to
+func (ks *KeyStore) TrustAll() (levels map[string]Trust) {
+	ks.trust.lock.Lock()
+	defer ks.trust.lock.Unlock()
+	held := ks.levels()
+	levels = make(map[string]Trust, len(held))
+	for i, j := range held {
+		levels[i] = j
+	}
+	return levels
+}
+
+// levels : the cached trust levels, computed when dirty,
+// hold ks.trust.lock
+func (ks *KeyStore) levels() map[string]Trust {
+	if ks.trust.levels == nil {
+		ks.trust.levels = ks.computeTrust(ks.trust.anchors)
+	}
+	return ks.trust.levels
+}
+
+// trustCache holds the computed levels until something changes
+type trustCache struct {
+	lock    sync.Mutex
+	anchors []string
+	levels  map[string]Trust
+}
+
+func (tc *trustCache) dirty() {
+	tc.lock.Lock()
+	tc.levels = nil
+	tc.lock.Unlock()
+}
+
+// computeTrust walks the certifications out from the roots.
+// Fully trusted keys pass on the level they certify, marginal keys
+// only pass on marginal, and enough marginals make a full.
+func (ks *KeyStore) computeTrust(anchors []string) (levels map[string]Trust) {
+	levels = make(map[string]Trust)
+	if local, err := ks.LocalKey(); err == nil {
+		levels[local.FingerPrint()] = TrustFull
+	}
+	for _, fp := range append(anchors, ks.trusted()...) {
+		levels[fp] = TrustFull
+	}
+	// certifications by issuer
+	certs := make(map[string][]*Certification)
+	ks.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("certs"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			sc, err := DecodeSignedCertification(v)
+			if err != nil {
+				return nil
+			}
+			c, err := sc.GetCertification()
+			if err != nil || !strings.HasPrefix(string(k), c.Issuer+":") {
+				return nil
+			}
+			certs[c.Issuer] = append(certs[c.Issuer], c)
+			return nil
+		})
+	})
+	for depth := 0; depth < MaxTrustDepth; depth++ {
+		full := make(map[string]bool)
+		marginals := make(map[string]int)
+		for issuer, level := range levels {
+			if ks.refused(issuer) != nil {
+				continue
+			}
+			for _, c := range certs[issuer] {
+				switch {
+				case c.Level == TrustFull && level == TrustFull:
+					full[c.Subject] = true
+				case c.Level != TrustUnknown:
+					marginals[c.Subject]++
+				}
+			}
+		}
+		changed := false
+		raise := func(fp string, t Trust) {
+			if ks.refused(fp) != nil {
+				return
+			}
+			if t > levels[fp] {
+				levels[fp] = t
+				changed = true
+			}
+		}
+		for fp := range full {
+			raise(fp, TrustFull)
+		}
+		for fp, n := range marginals {
+			if n >= MarginalsNeeded {
+				raise(fp, TrustFull)
+			} else {
+				raise(fp, TrustMarginal)
+			}
+		}
+		// a rotated key hands its trust to the successor
+		for fp, level := range levels {
+			if next := ks.Successor(fp); next != fp {
+				raise(next, level)
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	for fp := range levels {
+		if ks.refused(fp) != nil {
+			delete(levels, fp)
+		}
+	}
+	return levels
+}
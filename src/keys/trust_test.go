@@ -0,0 +1,86 @@
+package keys
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTrust(t *testing.T) {
+	anchor, _ := NewKeyStore(t.TempDir()+"/anchor", plaintext)
+	defer anchor.Close()
+	node, _ := NewKeyStore(t.TempDir()+"/node", plaintext)
+	defer node.Close()
+	anchorKey, _ := anchor.LocalKey()
+	anchorK, _ := anchorKey.MakeSigned()
+	b, _ := (&KeyStore{}).NewLocalKey()
+	bK, _ := b.MakeSigned()
+	c, _ := (&KeyStore{}).NewLocalKey()
+	cK, _ := c.MakeSigned()
+	for _, k := range []*SignedKey{anchorK, bK, cK} {
+		node.PutPublic(k, "public")
+		anchor.PutPublic(k, "public")
+	}
+
+	// the anchor vouches fully for b, b marginally for c
+	sc, err := anchor.Certify(b.FingerPrint(), TrustFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.TryCertify(sc); err != nil {
+		t.Fatal(err)
+	}
+	sc, _ = b.MakeCertification(c.FingerPrint(), TrustMarginal)
+	if _, err := node.TryCertify(sc); err != nil {
+		t.Fatal(err)
+	}
+	if got := node.Trust(b.FingerPrint()); got != TrustUnknown {
+		t.Errorf("trust without anchor %s", got)
+	}
+	node.SetAnchors([]string{anchorKey.FingerPrint()})
+	if got := node.Trust(b.FingerPrint()); got != TrustFull {
+		t.Errorf("trust in b %s", got)
+	}
+	if got := node.Trust(c.FingerPrint()); got != TrustMarginal {
+		t.Errorf("trust in c %s", got)
+	}
+
+	// a forged certification is refused
+	forged, _ := c.MakeCertification(b.FingerPrint(), TrustFull)
+	forged.Signature = sc.Signature
+	if _, err := node.TryCertify(forged); err == nil {
+		t.Errorf("forged certification accepted")
+	}
+
+	// revoking b drops the path to c
+	node.SetAdmins([]string{anchorKey.FingerPrint()})
+	sr, _ := anchor.Revoke(b.FingerPrint(), "")
+	if _, err := node.TryRevoke(sr); err != nil {
+		t.Fatal(err)
+	}
+	if got := node.Trust(c.FingerPrint()); got != TrustUnknown {
+		t.Errorf("trust in c after revoke %s", got)
+	}
+}
+
+func TestCertCaps(t *testing.T) {
+	node, _ := NewKeyStore(t.TempDir()+"/node", plaintext)
+	defer node.Close()
+	issuer, _ := (&KeyStore{}).NewLocalKey()
+	issuerK, _ := issuer.MakeSigned()
+	node.PutPublic(issuerK, "public")
+	for i := 0; i < MaxIssuerCerts; i++ {
+		sc, _ := issuer.MakeCertification(fmt.Sprintf("%032x", i), TrustMarginal)
+		if _, err := node.TryCertify(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sc, _ := issuer.MakeCertification(fmt.Sprintf("%032x", MaxIssuerCerts), TrustMarginal)
+	if _, err := node.TryCertify(sc); err != ErrTooManyCerts {
+		t.Errorf("certification past the issuer cap got %v", err)
+	}
+	// a newer one for a subject already held still replaces it
+	sc, _ = issuer.MakeCertification(fmt.Sprintf("%032x", 0), TrustFull)
+	if c, err := node.TryCertify(sc); err != nil || c.Level != TrustFull {
+		t.Errorf("renewed certification got %v %v", c, err)
+	}
+}
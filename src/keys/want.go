@@ -0,0 +1,153 @@
+package keys
+
+// asking neighbours for keys by finger print, so a subsystem that
+// meets an unknown key does not have to wait for it to come round
+// in a random gossip
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	LookupTimeout = 10 * time.Second // how long a want stays open
+	MaxWants      = 64               // finger prints in one request
+	maxPending    = 1024             // open wants before new ones are refused
+)
+
+var ErrLookupTimeout = errors.New("Key lookup timed out")
+
+// wants are the open lookups, each closes its channels when the
+// key arrives or the lookup times out
+type wants struct {
+	mtx     sync.Mutex
+	pending map[string]chan struct{}
+}
+
+func newWants() *wants {
+	return &wants{
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+// add opens a want for fp, first is true if it was not already open
+func (w *wants) add(fp string) (done <-chan struct{}, first bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if ch, ok := w.pending[fp]; ok {
+		return ch, false
+	}
+	ch := make(chan struct{})
+	if len(w.pending) >= maxPending {
+		close(ch)
+		return ch, false
+	}
+	w.pending[fp] = ch
+	time.AfterFunc(LookupTimeout, func() { w.resolve(fp) })
+	return ch, true
+}
+
+// resolve closes the want for fp if there is one
+func (w *wants) resolve(fp string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if ch, ok := w.pending[fp]; ok {
+		close(ch)
+		delete(w.pending, fp)
+	}
+}
+
+func (w *wants) has(fp string) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	_, ok := w.pending[fp]
+	return ok
+}
+
+func (w *wants) open() int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return len(w.pending)
+}
+
+// Wanting returns the number of open key lookups.
+func (p *peer) Wanting() int {
+	return p.wants.open()
+}
+
+// SetNeighbours gives the peer the mesh peers it can ask for keys.
+func (p *peer) SetNeighbours(neighbours func() []mesh.PeerName) {
+	p.do(func() { p.neighbours = neighbours })
+}
+
+// Want asks the neighbours for a key we do not hold, the channel
+// is closed when the key arrives or the lookup times out.
+func (p *peer) Want(fp string) <-chan struct{} {
+	if ValidFingerPrint(fp) != nil || p.keyStore.HaveKey(fp, "public") {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	done, first := p.wants.add(fp)
+	if first {
+		p.do(func() { p.ask([]string{fp}) })
+	}
+	return done
+}
+
+// Lookup waits on Want for the key.
+func (p *peer) Lookup(fp string) (sigK *SignedKey, err error) {
+	<-p.Want(fp)
+	if err := p.keyStore.refused(fp); err != nil {
+		return nil, err
+	}
+	sigK, ok := p.keyStore.CacheKey(fp, "public")
+	if !ok {
+		return nil, ErrLookupTimeout
+	}
+	return sigK, nil
+}
+
+// ask unicasts a request for the keys to every neighbour
+func (p *peer) ask(fps []string) {
+	if p.send == nil || p.neighbours == nil {
+		logger.Debugf("No neighbours to ask for %v", fps)
+		return
+	}
+	for _, dst := range p.neighbours() {
+		p.unicast(dst, &message{Want: fps})
+	}
+}
+
+// answer sends src the keys it wants that we hold,
+// with the revocations of those we have refused
+func (p *peer) answer(src mesh.PeerName, want []string) {
+	reply := &message{
+		Keys:    make(map[string]*SignedKey),
+		Revoked: make(map[string]*SignedRevocation),
+	}
+	for _, fp := range want {
+		if sigK, ok := p.keyStore.CacheKey(fp, "public"); ok {
+			reply.Keys[fp] = sigK
+		} else if sr, err := p.keyStore.GetRevocation(fp); err == nil {
+			reply.Revoked[fp] = sr
+		}
+	}
+	if len(reply.Keys) == 0 && len(reply.Revoked) == 0 {
+		return
+	}
+	p.do(func() { p.unicast(src, reply) })
+}
+
+func encodeMessage(msg *message) (buf []byte, err error) {
+	var b bytes.Buffer
+	err = gob.NewEncoder(&b).Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,199 @@
+package keys
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// wire delivers unicasts straight to the other peer
+type wire struct {
+	from mesh.PeerName
+	to   *peer
+}
+
+func (w *wire) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	go w.to.OnGossipUnicast(w.from, msg)
+	return nil
+}
+
+func (w *wire) GossipBroadcast(update mesh.GossipData) {}
+
+func TestWant(t *testing.T) {
+	dir := t.TempDir()
+	a := NewPeer(dir+"/a", plaintext, logger)
+	b := NewPeer(dir+"/b", plaintext, logger)
+	a.Register(&wire{from: 1, to: b})
+	b.Register(&wire{from: 2, to: a})
+	a.SetNeighbours(func() []mesh.PeerName { return []mesh.PeerName{2} })
+	local, _ := b.Store().LocalKey()
+	fp := local.FingerPrint()
+	sigK, err := a.Lookup(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sigK.GetFingerPrint(); got != fp {
+		t.Errorf("looked up %s got %s", fp, got)
+	}
+	if a.Wanting() != 0 {
+		t.Errorf("%d wants left open", a.Wanting())
+	}
+	// a known key needs no asking
+	select {
+	case <-a.Want(fp):
+	default:
+		t.Errorf("want for a held key left open")
+	}
+}
+
+func TestSync(t *testing.T) {
+	dir := t.TempDir()
+	a := NewPeer(dir+"/a", plaintext, logger)
+	b := NewPeer(dir+"/b", plaintext, logger)
+	a.Register(&wire{from: 1, to: b})
+	b.Register(&wire{from: 2, to: a})
+	a.SetNeighbours(func() []mesh.PeerName { return []mesh.PeerName{2} })
+	// more keys than one burst of the rate limit
+	for i := 0; i < DefaultBurst+8; i++ {
+		sigK, _ := gossipKey(t)
+		if err := b.Store().TryInsertFrom(sigK, "public", SourceImport, ""); err != nil {
+			t.Fatal(err)
+		}
+		b.st.insert(sigK)
+	}
+	a.SyncNeighbours()
+	want := len(b.st.keys())
+	for i := 0; i < 100 && len(a.st.keys()) <= want; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	// a holds its own key and everything b has
+	if got := len(a.st.keys()); got != want+1 {
+		t.Errorf("synced %d keys of %d", got-1, want)
+	}
+	// b asked a for the key it lacked
+	if got := len(b.st.keys()); got != want+1 {
+		t.Errorf("b has %d keys of %d", got, want+1)
+	}
+}
+
+func TestSyncWindow(t *testing.T) {
+	s := newSyncs()
+	// a have from a peer opens no window
+	if s.take(mesh.PeerName(1)) {
+		t.Errorf("key taken without a sync")
+	}
+	s.start(mesh.PeerName(1), 1)
+	for i := 0; i < MaxKeys; i++ {
+		if !s.take(mesh.PeerName(1)) {
+			t.Fatalf("window closed after %d keys", i)
+		}
+	}
+	if s.take(mesh.PeerName(1)) {
+		t.Errorf("window took more keys than it was opened for")
+	}
+	if !s.answer(mesh.PeerName(2)) || s.answer(mesh.PeerName(2)) {
+		t.Errorf("inventory answered twice in a window")
+	}
+	if !s.answer(mesh.PeerName(3)) {
+		t.Errorf("another peer not answered")
+	}
+}
+
+func TestGetRand(t *testing.T) {
+	st := newState()
+	for i := 0; i < 10; i++ {
+		sigK, _ := gossipKey(t)
+		st.insert(sigK)
+	}
+	newest := st.fingerPrints(1)[0]
+	part := st.GetRand(4).(*state)
+	if len(part.set) != 4 {
+		t.Errorf("sampled %d keys of 4", len(part.set))
+	}
+	if part.set[newest] == nil {
+		t.Errorf("newest key not sampled")
+	}
+	if all := st.GetRand(20).(*state); len(all.set) != 10 {
+		t.Errorf("sampled %d keys of 10", len(all.set))
+	}
+}
+
+// fakeClaim : a claim that decodes but is signed by nothing,
+// only good for filling a state
+func fakeClaim(i int) (name string, sc *SignedClaim) {
+	name = mesh.PeerName(i + 1).String()
+	data, _ := json.Marshal(&Claim{PeerName: name, FingerPrint: fmt.Sprintf("%032x", i), Stamp: time.Unix(int64(i), 0)})
+	return name, &SignedClaim{Data: data, Signature: "00"}
+}
+
+// fakeRevocation : the same for revocations
+func fakeRevocation(i int) *SignedRevocation {
+	data, _ := json.Marshal(&Revocation{FingerPrint: fmt.Sprint(i), Stamp: time.Unix(int64(i), 0)})
+	return &SignedRevocation{Data: data, Signature: "00"}
+}
+
+func TestBatches(t *testing.T) {
+	st := newState()
+	sigK, _ := gossipKey(t)
+	st.insert(sigK)
+	n := MaxClaims + 10
+	for i := 0; i < n; i++ {
+		st.insertClaim(fakeClaim(i))
+	}
+	revoked := MaxKeys + 10
+	for i := 0; i < revoked; i++ {
+		st.insertRevocation(fmt.Sprint(i), fakeRevocation(i))
+	}
+	part := st.GetRand(20).(*state)
+	if len(part.claims) != MaxClaims {
+		t.Errorf("sampled %d claims of %d", len(part.claims), MaxClaims)
+	}
+	newest, _ := fakeClaim(n - 1)
+	oldest, _ := fakeClaim(0)
+	if part.claims[newest] == nil || part.claims[oldest] != nil {
+		t.Errorf("sampled claims are not the newest")
+	}
+	if len(part.revoked) != MaxKeys || part.revoked[fmt.Sprint(revoked-1)] == nil {
+		t.Errorf("sampled %d revocations of %d", len(part.revoked), MaxKeys)
+	}
+	if size := len(part.Encode()[0]); size > MaxGossipSize {
+		t.Errorf("sample is %d bytes", size)
+	}
+	claims, revocations := 0, 0
+	for _, msg := range st.batch(nil) {
+		if len(msg.Claims) > MaxClaims || len(msg.Revoked) > MaxKeys {
+			t.Errorf("message over the caps")
+		}
+		claims += len(msg.Claims)
+		revocations += len(msg.Revoked)
+	}
+	if claims != n || revocations != revoked {
+		t.Errorf("sent %d claims of %d and %d revocations of %d", claims, n, revocations, revoked)
+	}
+}
+
+func TestEncodeSplit(t *testing.T) {
+	st := newState()
+	n := MaxClaims + 10
+	for i := 0; i < n; i++ {
+		st.insertClaim(fakeClaim(i))
+	}
+	bufs := st.Encode()
+	if len(bufs) != 2 {
+		t.Fatalf("%d messages for %d claims", len(bufs), n)
+	}
+	claims := 0
+	for _, buf := range bufs {
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims += len(msg.Claims)
+	}
+	if claims != n {
+		t.Errorf("encoded %d claims of %d", claims, n)
+	}
+}
@@ -0,0 +1,180 @@
+package metrics
+
+// counters, histograms and gauges written in the prometheus
+// text format, only what the replicator needs so there is no
+// client library to vendor
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the packages register with
+var Default = NewRegistry()
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics written out in name order
+type Registry struct {
+	mtx   sync.Mutex
+	names map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]collector)}
+}
+
+func (r *Registry) add(name string, c collector) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.names[name] = c
+}
+
+// Write : every metric in the text exposition format
+func (r *Registry) Write(w io.Writer) {
+	r.mtx.Lock()
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.names[name])
+	}
+	r.mtx.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler : serve the registry for a scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// vec is the labelled series of one metric
+type vec struct {
+	name, help, kind string
+	labels           []string
+	mtx              sync.Mutex
+	series           map[string]interface{}
+	keys             map[string][]string
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]interface{}),
+		keys:   make(map[string][]string),
+	}
+}
+
+func (v *vec) get(values []string, make func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + " wants " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = make()
+		v.series[key] = s
+		v.keys[key] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// each calls f on the series in label order
+func (v *vec) each(f func(values []string, s interface{})) {
+	v.mtx.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]interface{}, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		series[i] = v.series[k]
+		values[i] = v.keys[k]
+	}
+	v.mtx.Unlock()
+	for i := range keys {
+		f(values[i], series[i])
+	}
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.kind)
+}
+
+// labelString : {a="x",b="y"} with extra pairs on the end
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", n, escapeLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if len(names) > 0 || i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", extra[i], extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// %q escapes backslash, quote and newline as the format wants,
+// anything else unprintable is dropped first
+func escapeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := Default
+	Default = NewRegistry()
+	defer func() { Default = r }()
+	cv := NewCounterVec("test_total", "Things.\nCounted", "kind")
+	cv.With("a").Inc()
+	cv.With("b\"").Add(2.5)
+	hv := NewHistogramVec("test_seconds", "Latency.", []float64{1, 0.5}, "call")
+	hv.With("x").Observe(0.2)
+	hv.With("x").Observe(0.7)
+	hv.With("x").Observe(3)
+	g := NewGaugeFunc("test_gauge", "Level.", "")
+	g.Set(func() map[string]float64 { return map[string]float64{"": 7} })
+	NewGaugeFunc("test_unset", "Never set.", "")
+	var buf bytes.Buffer
+	Default.Write(&buf)
+	want := `# HELP test_gauge Level.
+# TYPE test_gauge gauge
+test_gauge 7
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{call="x",le="0.5"} 1
+test_seconds_bucket{call="x",le="1"} 2
+test_seconds_bucket{call="x",le="+Inf"} 3
+test_seconds_sum{call="x"} 3.9
+test_seconds_count{call="x"} 3
+# HELP test_total Things.\nCounted
+# TYPE test_total counter
+test_total{kind="a"} 1
+test_total{kind="b\""} 2.5
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := Default
+	Default = NewRegistry()
+	defer func() { Default = r }()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("no panic")
+		}
+	}()
+	NewCounterVec("twice", "")
+	NewCounterVec("twice", "")
+}
+
+func TestLabelCount(t *testing.T) {
+	r := Default
+	Default = NewRegistry()
+	defer func() { Default = r }()
+	cv := NewCounterVec("labels_total", "", "a", "b")
+	defer func() {
+		if p := recover(); p == nil || !strings.Contains(p.(string), "2 label") {
+			t.Errorf("panic %v", p)
+		}
+	}()
+	cv.With("only one")
+}
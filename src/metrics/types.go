@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter only goes up
+type Counter struct {
+	bits uint64 // float64 bits
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add : n must not be negative
+func (c *Counter) Add(n float64) {
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		nw := math.Float64bits(math.Float64frombits(old) + n)
+		if atomic.CompareAndSwapUint64(&c.bits, old, nw) {
+			return
+		}
+	}
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// CounterVec is a counter for each set of label values
+type CounterVec struct {
+	v *vec
+}
+
+// NewCounterVec : a counter family on the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{v: newVec(name, help, "counter", labels)}
+	Default.add(name, cv)
+	return cv
+}
+
+// With : the counter for the label values, in label order
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.v.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	cv.v.header(w)
+	cv.v.each(func(values []string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.v.name, labelString(cv.v.labels, values), formatFloat(s.(*Counter).Value()))
+	})
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	mtx     sync.Mutex
+	bounds  []float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.samples++
+}
+
+// HistogramVec is a histogram for each set of label values
+type HistogramVec struct {
+	v      *vec
+	bounds []float64
+}
+
+// NewHistogramVec : a histogram family on the default registry,
+// nil buckets takes DefBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	hv := &HistogramVec{v: newVec(name, help, "histogram", labels), bounds: bounds}
+	Default.add(name, hv)
+	return hv
+}
+
+// With : the histogram for the label values, in label order
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.v.get(values, func() interface{} {
+		return &Histogram{bounds: hv.bounds, counts: make([]uint64, len(hv.bounds))}
+	}).(*Histogram)
+}
+
+func (hv *HistogramVec) write(w io.Writer) {
+	name := hv.v.name
+	hv.v.header(w)
+	hv.v.each(func(values []string, s interface{}) {
+		h := s.(*Histogram)
+		h.mtx.Lock()
+		counts := append([]uint64(nil), h.counts...)
+		sum, samples := h.sum, h.samples
+		h.mtx.Unlock()
+		var total uint64
+		for i, le := range hv.bounds {
+			total += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(hv.v.labels, values, "le", formatFloat(le)), total)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(hv.v.labels, values, "le", "+Inf"), samples)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labelString(hv.v.labels, values), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labelString(hv.v.labels, values), samples)
+	})
+}
+
+// GaugeFunc is a gauge read when scraped, one value for each
+// label value f returns
+type GaugeFunc struct {
+	name, help, label string
+	mtx               sync.Mutex
+	f                 func() map[string]float64
+}
+
+// NewGaugeFunc : a gauge on the default registry, label is empty
+// for a single value under the key ""
+func NewGaugeFunc(name, help, label string) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, label: label}
+	Default.add(name, g)
+	return g
+}
+
+// Set : the function read on each scrape, nil stops the gauge
+func (g *GaugeFunc) Set(f func() map[string]float64) {
+	g.mtx.Lock()
+	g.f = f
+	g.mtx.Unlock()
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.mtx.Lock()
+	f := g.f
+	g.mtx.Unlock()
+	if f == nil {
+		return
+	}
+	values := f()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, escapeHelp(g.help), g.name)
+	for _, k := range keys {
+		labels := ""
+		if g.label != "" {
+			labels = labelString([]string{g.label}, []string{k})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(values[k]))
+	}
+}
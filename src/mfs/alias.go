@@ -0,0 +1,120 @@
+package mfs
+
+// human readable names for finger print folders
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// AliasFile sits in each share root, EscapeName never yields
+// a leading dot so it can not clash with a peer folder.
+const AliasFile = ".aliases"
+
+// MaxAliasFile bounds the index read back from a share
+const MaxAliasFile = 1 << 20
+
+// Aliases maps nicknames onto the finger print folders of a share.
+// Nicknames are chosen by each node so they can collide, the first
+// finger print seen keeps the plain name and later ones get a suffix.
+type Aliases struct {
+	lock  sync.Mutex
+	names map[string]string // alias -> finger print
+	owned map[string]string // finger print -> alias
+}
+
+func NewAliases() (a *Aliases) {
+	return &Aliases{
+		names: make(map[string]string),
+		owned: make(map[string]string),
+	}
+}
+
+// Set : record the nickname for a finger print,
+// returns the alias used and whether anything changed.
+func (a *Aliases) Set(fp, nickname string) (alias string, changed bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	alias = nickname
+	if len(alias) == 0 {
+		alias = short(fp)
+	}
+	if owner, ok := a.names[alias]; ok && owner != fp {
+		logger.Warningf("Nickname collision %q claimed by %s and %s", nickname, owner, fp)
+		alias = alias + "-" + short(fp)
+	}
+	if a.owned[fp] == alias {
+		return alias, false
+	}
+	// a node changed nickname, drop the old alias
+	if old, ok := a.owned[fp]; ok {
+		delete(a.names, old)
+	}
+	a.names[alias] = fp
+	a.owned[fp] = alias
+	return alias, true
+}
+
+// Move : hand the alias of a key over to the key it rotated to,
+// unless that key has one already
+func (a *Aliases) Move(old, fp string) (changed bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	alias, ok := a.owned[old]
+	if !ok {
+		return false
+	}
+	if _, taken := a.owned[fp]; taken {
+		return false
+	}
+	delete(a.owned, old)
+	a.names[alias] = fp
+	a.owned[fp] = alias
+	return true
+}
+
+// DecodeAliases : an index written by Encode, so a restart
+// gives each finger print the alias it had before
+func DecodeAliases(data []byte) (a *Aliases, err error) {
+	var names map[string]string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, err
+	}
+	aliases := make([]string, 0, len(names))
+	for alias := range names {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	a = NewAliases()
+	for _, alias := range aliases {
+		fp := names[alias]
+		if _, ok := a.owned[fp]; ok {
+			continue
+		}
+		a.names[alias] = fp
+		a.owned[fp] = alias
+	}
+	return a, nil
+}
+
+// Lookup : the finger print behind an alias
+func (a *Aliases) Lookup(alias string) (fp string, ok bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	fp, ok = a.names[alias]
+	return fp, ok
+}
+
+// Encode : the alias map as json for the index file
+func (a *Aliases) Encode() (data []byte, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return json.MarshalIndent(a.names, "", " ")
+}
+
+func short(fp string) string {
+	if len(fp) > 8 {
+		return fp[:8]
+	}
+	return fp
+}
@@ -0,0 +1,74 @@
+package mfs
+
+import (
+	"testing"
+)
+
+func TestAliases(t *testing.T) {
+	a := NewAliases()
+	bob := "0123456789abcdef0123456789abcdef"
+	eve := "fedcba9876543210fedcba9876543210"
+	if alias, changed := a.Set(bob, "bob"); alias != "bob" || !changed {
+		t.Errorf("first alias %q %v", alias, changed)
+	}
+	if _, changed := a.Set(bob, "bob"); changed {
+		t.Errorf("repeated alias changed")
+	}
+	// eve claims the same nickname
+	if alias, _ := a.Set(eve, "bob"); alias != "bob-fedcba98" {
+		t.Errorf("collision alias %q", alias)
+	}
+	if fp, _ := a.Lookup("bob"); fp != bob {
+		t.Errorf("alias taken over by %q", fp)
+	}
+	// bob renames and frees the plain name
+	a.Set(bob, "robert")
+	if _, ok := a.Lookup("bob"); ok {
+		t.Errorf("old alias kept")
+	}
+}
+
+func TestDecodeAliases(t *testing.T) {
+	a := NewAliases()
+	bob := "0123456789abcdef0123456789abcdef"
+	eve := "fedcba9876543210fedcba9876543210"
+	a.Set(bob, "bob")
+	a.Set(eve, "bob")
+	data, err := a.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after a restart the suffix stays with eve
+	b, err := DecodeAliases(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias, changed := b.Set(eve, "bob"); alias != "bob-fedcba98" || changed {
+		t.Errorf("eve got %q changed %v", alias, changed)
+	}
+	if alias, changed := b.Set(bob, "bob"); alias != "bob" || changed {
+		t.Errorf("bob got %q changed %v", alias, changed)
+	}
+	if _, err := DecodeAliases([]byte("[")); err == nil {
+		t.Errorf("bad index decoded")
+	}
+}
+
+func TestMoveAlias(t *testing.T) {
+	a := NewAliases()
+	old := "0123456789abcdef0123456789abcdef"
+	next := "fedcba9876543210fedcba9876543210"
+	a.Set(old, "bob")
+	if !a.Move(old, next) {
+		t.Fatalf("alias not moved")
+	}
+	if fp, _ := a.Lookup("bob"); fp != next {
+		t.Errorf("bob is %q", fp)
+	}
+	if alias, changed := a.Set(next, "bob"); alias != "bob" || changed {
+		t.Errorf("rotated key got %q changed %v", alias, changed)
+	}
+	if a.Move(old, next) {
+		t.Errorf("moved twice")
+	}
+}
@@ -0,0 +1,83 @@
+package mfs
+
+// listing the dated backup folders StampBackup makes
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+// backup folders are /yyyy/mm/dd/hh/mm
+var (
+	backupDepth = 5
+	backupName  = regexp.MustCompile(`^[0-9]{2,4}$`)
+)
+
+// Entry is an mfs folder entry
+type Entry struct {
+	Name string
+	Type int
+	Hash string
+}
+
+// Ls : the entries of an mfs folder
+func (fs *Share) Ls(path string) (entries []Entry, err error) {
+	val := url.Values{}
+	val.Set("arg", path)
+	val.Set("long", "true")
+	htr, err := fs.Request("files/ls", val)
+	if err != nil {
+		return nil, err
+	}
+	defer htr.Body.Close()
+	var ls struct {
+		Entries []Entry
+	}
+	err = json.NewDecoder(htr.Body).Decode(&ls)
+	if err != nil {
+		return nil, err
+	}
+	return ls.Entries, nil
+}
+
+// Backup is one dated backup folder
+type Backup struct {
+	Path string // /yyyy/mm/dd/hh/mm
+	Hash string
+}
+
+// Backups : the newest max backup folders, newest first
+func (fs *Share) Backups(max int) (backups []Backup, err error) {
+	err = fs.backups("", 0, max, &backups)
+	return backups, err
+}
+
+func (fs *Share) backups(path string, depth, max int, found *[]Backup) (err error) {
+	dir := path
+	if dir == "" {
+		dir = "/"
+	}
+	entries, err := fs.Ls(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name > entries[j].Name })
+	for _, e := range entries {
+		if len(*found) >= max {
+			return nil
+		}
+		if !backupName.MatchString(e.Name) {
+			continue
+		}
+		p := path + "/" + e.Name
+		if depth == backupDepth-1 {
+			*found = append(*found, Backup{Path: p, Hash: e.Hash})
+			continue
+		}
+		if err := fs.backups(p, depth+1, max, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func TestBasic(t *testing.T) {
-	j := NewIPfsfs()
+	j := NewShare(map[string]*Share{})
 	fmt.Println(j)
 	fmt.Println(j.Stat())
 	j.Mfs("share")
@@ -0,0 +1,43 @@
+package mfs
+
+// prometheus metrics of the ipfs api and the share updates
+import (
+	"time"
+
+	"metrics"
+)
+
+var (
+	ipfsSeconds = metrics.NewHistogramVec("repl_ipfs_request_seconds",
+		"Latency of ipfs api calls.", nil, "call")
+	ipfsErrors = metrics.NewCounterVec("repl_ipfs_errors_total",
+		"Failed ipfs api calls.", "call")
+	updatesTotal = metrics.NewCounterVec("repl_share_updates_total",
+		"Share updates by event, announced and received are counted as they arrive, the rest when applied.", "share", "event")
+	applySeconds = metrics.NewHistogramVec("repl_share_apply_seconds",
+		"Time to apply an update from a peer.", []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}, "share")
+)
+
+// update events past the outcomes
+const (
+	EventAnnounced = "announced"
+	EventReceived  = "received"
+)
+
+// observeCall : time and errors of one ipfs api call
+func observeCall(call string, start time.Time, err error) {
+	ipfsSeconds.With(call).Observe(time.Since(start).Seconds())
+	if err != nil {
+		ipfsErrors.With(call).Inc()
+	}
+}
+
+// shareLabel : names from the mesh are only labels if we hold the share
+func (fs *Share) shareLabel(name string) string {
+	fs.watchLock.Lock()
+	defer fs.watchLock.Unlock()
+	if _, ok := fs.watch[name]; ok {
+		return name
+	}
+	return "other"
+}
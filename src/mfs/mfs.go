@@ -1,10 +1,14 @@
 package mfs
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/op/go-logging"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"sync"
@@ -18,12 +22,20 @@ const (
 
 var logger = logging.MustGetLogger("mfs")
 
+var (
+	ErrTooLarge     = errors.New("File too large")
+	ErrOffline      = errors.New("ipfs api not reachable")
+	ErrClosed       = errors.New("Share is closed")
+	ErrDrainTimeout = errors.New("Updates still being applied")
+)
+
 type Update struct {
-	Path     string
-	PeerName string
-	NewHash  string
-	OldHash  string
-	Stamp    time.Time
+	Path        string
+	PeerName    string // nickname of the publisher
+	FingerPrint string // key of the publisher, names the folder
+	NewHash     string
+	OldHash     string
+	Stamp       time.Time
 }
 
 //Share : file system ROfs interface
@@ -33,7 +45,22 @@ type Share struct {
 	watch   map[string]string
 	paths   map[string]string
 	updates chan Update
+	aliases map[string]*Aliases // by share, read from its index on first use
 	lock    sync.Mutex
+	// successor follows key rotations, folders of retired keys
+	// move to the current key, nil keeps them where they are
+	successor func(fp string) string
+	history *history
+
+	inflight  sync.WaitGroup // updates being applied
+	closeLock sync.Mutex
+	closed    bool
+	stop      chan struct{} // closed by Close
+
+	scanLock  sync.Mutex // one scan at a time
+	watchLock sync.Mutex // watch, changed and checked
+	changed   map[string]time.Time
+	checked   time.Time
 }
 
 func init() {
@@ -45,15 +72,43 @@ func NewShare(bind map[string]*Share) (fs *Share) {
 	fs.watch = make(map[string]string)
 	fs.paths = make(map[string]string)
 	fs.updates = make(chan Update, 50)
+	fs.aliases = make(map[string]*Aliases)
+	fs.history = newHistory()
+	fs.changed = make(map[string]time.Time)
+	fs.stop = make(chan struct{})
 	for i, j := range bind {
-		fs.paths[i] = j.Source
-		logger.Debugf("%v", fs.paths)
-		fs.watch[i] = ""
-		fs.Mkdir("/"+i, true)
+		if err := fs.AddShare(i, j.Source); err != nil {
+			logger.Errorf("Share %q skipped %v", i, err)
+		}
 	}
 	return fs
 }
 
+// AddShare : start watching source as the share name
+func (fs *Share) AddShare(name, source string) (err error) {
+	if err := ValidName(name); err != nil {
+		return err
+	}
+	fs.watchLock.Lock()
+	fs.paths[name] = source
+	fs.watch[name] = ""
+	delete(fs.changed, name)
+	logger.Debugf("%v", fs.paths)
+	fs.watchLock.Unlock()
+	fs.Mkdir("/"+name, true)
+	return nil
+}
+
+// RemoveShare : stop watching the share and take no more updates
+// for it, what is already in mfs is left alone
+func (fs *Share) RemoveShare(name string) {
+	fs.watchLock.Lock()
+	defer fs.watchLock.Unlock()
+	delete(fs.paths, name)
+	delete(fs.watch, name)
+	delete(fs.changed, name)
+}
+
 type Stat struct {
 	Hash           string
 	Size           int
@@ -69,20 +124,66 @@ func (fs *Share) UpdateChannel() (c chan Update) {
 	return fs.updates
 }
 
-func (fs *Share) Watch(interval int) {
-	c := time.Tick(time.Duration(interval) * time.Second)
+// Watch : scan the shares every interval seconds until ctx is done
+func (fs *Share) Watch(ctx context.Context, interval int) {
+	c := time.NewTicker(time.Duration(interval) * time.Second)
+	defer c.Stop()
 	for {
 		select {
-		case <-c:
+		case <-c.C:
 			logger.Debug("WATCH")
 			fs.CheckChanges()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
+// Close : refuse new updates and wait up to timeout for the ones
+// being applied, ErrDrainTimeout if they did not all finish
+func (fs *Share) Close(timeout time.Duration) error {
+	fs.closeLock.Lock()
+	if !fs.closed {
+		fs.closed = true
+		close(fs.stop)
+	}
+	fs.closeLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		fs.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrDrainTimeout
+	}
+}
+
+// enter : count an update in unless the share is closed
+func (fs *Share) enter() bool {
+	fs.closeLock.Lock()
+	defer fs.closeLock.Unlock()
+	if fs.closed {
+		return false
+	}
+	fs.inflight.Add(1)
+	return true
+}
+
 func (fs *Share) CheckChanges() {
+	fs.scanLock.Lock()
+	defer fs.scanLock.Unlock()
 	if fs.Stat() {
+		// shares can come and go while the scan runs
+		fs.watchLock.Lock()
+		paths := make(map[string]string, len(fs.paths))
 		for i, j := range fs.paths {
+			paths[i] = j
+		}
+		fs.watchLock.Unlock()
+		for i, j := range paths {
 			logger.Debugf("Check changes %v , %v ", i, j)
 			stat, err := fs.Mfs(j)
 			if err != nil {
@@ -90,51 +191,219 @@ func (fs *Share) CheckChanges() {
 				continue
 			}
 			logger.Debugf("STAT %v", stat)
-			if fs.watch[i] != stat.Hash {
+			fs.watchLock.Lock()
+			old, ok := fs.watch[i]
+			if !ok {
+				// removed during the scan
+				fs.watchLock.Unlock()
+				continue
+			}
+			if old != stat.Hash {
+				fs.watch[i] = stat.Hash
+				fs.changed[i] = time.Now()
+			}
+			fs.watchLock.Unlock()
+			if old != stat.Hash {
 				update := Update{
 					Path:    i,
-					OldHash: fs.watch[i],
+					OldHash: old,
 					NewHash: stat.Hash,
 					Stamp:   time.Now(),
 				}
-				fs.updates <- update
-				fs.watch[i] = stat.Hash
+				select {
+				case fs.updates <- update:
+				case <-fs.stop:
+					return
+				}
+				updatesTotal.With(i, EventAnnounced).Inc()
 				logger.Info("HASH has changed! %v", update)
 			}
 		}
+		fs.watchLock.Lock()
+		fs.checked = time.Now()
+		fs.watchLock.Unlock()
 	}
 }
 
+// SubmitUpdate : copy a peer's published hash into its folder,
+// the outcome is kept for Events
 func (fs *Share) SubmitUpdate(u Update) (err error) {
-	if fs.Stat() {
-		fs.lock.Lock()
-		defer func() {
-			logger.Infof("UNLOCK")
-			fs.lock.Unlock()
-		}()
-		logger.Infof("LOCK")
-		logger.Infof("%v", u)
-		// do we have this share
-		_, ok := fs.watch[u.Path]
-		if ok {
-			// Make the target backup
-			backupPath := fs.StampBackup()
-			sourcePath := "/" + u.Path + "/" + u.PeerName
-			fs.Mkdir(backupPath+"/"+u.Path, true)
-			err = fs.Move(sourcePath, backupPath+sourcePath)
-			if err != nil {
-				logger.Errorf("Move %v", err)
-				fs.Mkdir(sourcePath, true)
-				return
-			}
-			err = fs.CopyHash(u.NewHash, sourcePath)
-			if err != nil {
-				logger.Errorf("Copy %v", err)
-				return
-			}
+	if !fs.enter() {
+		return ErrClosed
+	}
+	defer fs.inflight.Done()
+	id := fs.history.begin(u)
+	outcome := OutcomeApplied
+	share := fs.shareLabel(u.Path)
+	updatesTotal.With(share, EventReceived).Inc()
+	start := time.Now()
+	defer func() {
+		ev := fs.history.end(id, outcome, err)
+		updatesTotal.With(share, ev.Outcome).Inc()
+		if ev.Outcome != OutcomeIgnored {
+			applySeconds.With(share).Observe(time.Since(start).Seconds())
+		}
+	}()
+	if !fs.Stat() {
+		return ErrOffline
+	}
+	fs.lock.Lock()
+	defer func() {
+		logger.Infof("UNLOCK")
+		fs.lock.Unlock()
+	}()
+	logger.Infof("LOCK")
+	logger.Infof("%v", u)
+	// do we have this share, names from the mesh are untrusted
+	sourcePath, perr := fs.PeerPath(u.Path, u.FingerPrint)
+	if perr == ErrNoShare {
+		outcome = OutcomeIgnored
+		return nil
+	}
+	if perr != nil {
+		logger.Errorf("Bad update path %v", perr)
+		outcome = OutcomeRejected
+		return perr
+	}
+	if err = ValidHash(u.NewHash); err != nil {
+		logger.Errorf("Bad update hash %v", err)
+		outcome = OutcomeRejected
+		return err
+	}
+	if err := fs.followRotation(u.Path, u.FingerPrint, sourcePath); err != nil {
+		logger.Errorf("Rotated folder %v", err)
+	}
+	// Make the target backup
+	backupPath := fs.StampBackup()
+	fs.Mkdir(backupPath+"/"+u.Path, true)
+	err = fs.Move(sourcePath, backupPath+sourcePath)
+	if err != nil {
+		logger.Errorf("Move %v", err)
+		fs.Mkdir(sourcePath, true)
+		return
+	}
+	err = fs.CopyHash(u.NewHash, sourcePath)
+	if err != nil {
+		logger.Errorf("Copy %v", err)
+		return
+	}
+	fs.updateAlias(u)
+	return nil
+}
+
+// updateAlias records the nickname of the publisher and
+// rewrites the alias index of the share when it changes,
+// hold fs.lock
+func (fs *Share) updateAlias(u Update) {
+	aliases, err := fs.shareAliases(u.Path)
+	if err != nil {
+		logger.Errorf("Alias index %v", err)
+		return
+	}
+	alias, changed := aliases.Set(u.FingerPrint, u.PeerName)
+	if !changed {
+		return
+	}
+	logger.Infof("Alias %s -> %s", alias, u.FingerPrint)
+	fs.writeAliases(u.Path, aliases)
+}
+
+// writeAliases rewrites the alias index of a share
+func (fs *Share) writeAliases(share string, aliases *Aliases) {
+	data, err := aliases.Encode()
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	err = fs.Write("/"+share+"/"+AliasFile, data)
+	if err != nil {
+		logger.Errorf("Alias index %v", err)
+	}
+}
+
+// SetSuccessor : follow key rotations with f, the folder and alias
+// of a retired key move to its successor on the first update from it
+func (fs *Share) SetSuccessor(f func(fp string) string) {
+	fs.lock.Lock()
+	fs.successor = f
+	fs.lock.Unlock()
+}
+
+// followRotation moves the folder of a key the publisher rotated
+// away from to target, the folder of fp, when fp has none yet.
+// Hold fs.lock.
+func (fs *Share) followRotation(share, fp, target string) (err error) {
+	if fs.successor == nil {
+		return nil
+	}
+	entries, err := fs.Ls("/" + share)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if "/"+share+"/"+e.Name == target {
+			return nil
+		}
+	}
+	for _, e := range entries {
+		if e.Name == AliasFile || e.Name == fp || fs.successor(e.Name) != fp {
+			continue
+		}
+		old, err := peerPath(share, e.Name)
+		if err != nil {
+			continue
+		}
+		logger.Infof("Key %s rotated to %s, moving %s", e.Name, fp, old)
+		if err := fs.Move(old, target); err != nil {
+			return err
+		}
+		aliases, err := fs.shareAliases(share)
+		if err != nil {
+			return err
+		}
+		if aliases.Move(e.Name, fp) {
+			fs.writeAliases(share, aliases)
+		}
+		return nil
+	}
+	return nil
+}
+
+// shareAliases : the alias index of a share, read from the share
+// the first time so suffixes keep their owners across restarts,
+// hold fs.lock
+func (fs *Share) shareAliases(share string) (a *Aliases, err error) {
+	if a, ok := fs.aliases[share]; ok {
+		return a, nil
+	}
+	entries, err := fs.Ls("/" + share)
+	if err != nil {
+		return nil, err
+	}
+	a = NewAliases()
+	for _, e := range entries {
+		if e.Name != AliasFile {
+			continue
+		}
+		data, err := fs.Read("/"+share+"/"+AliasFile, MaxAliasFile)
+		if err != nil {
+			return nil, err
+		}
+		a, err = DecodeAliases(data)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return err
+	fs.aliases[share] = a
+	return a, nil
+}
+
+// Aliases : the nickname map for the peer folders of a share,
+// nil until an update for it has been applied
+func (fs *Share) Aliases(share string) *Aliases {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.aliases[share]
 }
 
 func (fs *Share) StampBackup() string {
@@ -174,6 +443,48 @@ func (fs *Share) Copy(source, destination string) (err error) {
 	return nil
 }
 
+// Read : the contents of the mfs file at path, refused past limit bytes
+func (fs *Share) Read(path string, limit int64) (data []byte, err error) {
+	val := url.Values{}
+	val.Set("arg", path)
+	htr, err := fs.Request("files/read", val)
+	if err != nil {
+		return nil, err
+	}
+	defer htr.Body.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(htr.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// Write : replace the mfs file at path with data
+func (fs *Share) Write(path string, data []byte) (err error) {
+	val := url.Values{}
+	val.Set("arg", path)
+	val.Set("create", "true")
+	val.Set("truncate", "true")
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormFile("file", "data")
+	if err != nil {
+		return err
+	}
+	part.Write(data)
+	mw.Close()
+	resp, err := fs.Post("files/write", val, mw.FormDataContentType(), body)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
 func (fs *Share) Mkdir(path string, parents bool) (err error) {
 	val := url.Values{}
 	val.Set("arg", path)
@@ -206,6 +517,44 @@ func (fs *Share) Mfs(path string) (s *Stat, err error) {
 	return s, err
 }
 
+// NodeID : the peer id of the local ipfs node
+func NodeID() (id string, err error) {
+	fs := &Share{}
+	htr, err := fs.Request("id", nil)
+	if err != nil {
+		return "", err
+	}
+	defer htr.Body.Close()
+	var info struct {
+		ID string
+	}
+	err = json.NewDecoder(htr.Body).Decode(&info)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// Cat : the contents of an ipfs path, refused past limit bytes
+func Cat(path string, limit int64) (data []byte, err error) {
+	fs := &Share{}
+	val := url.Values{}
+	val.Set("arg", path)
+	htr, err := fs.Request("cat", val)
+	if err != nil {
+		return nil, err
+	}
+	defer htr.Body.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(htr.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
 //Stat : Check if the file system exist
 func (fs *Share) Stat() (stat bool) {
 	_, err := fs.Request("id", nil)
@@ -215,8 +564,24 @@ func (fs *Share) Stat() (stat bool) {
 	return true
 }
 
-func (fs *Share) Request(path string, val url.Values) (resp *http.Response, err error) {
-	u := url.URL{}
+// Post : send a body to the ipfs api
+func (fs *Share) Post(path string, val url.Values, contentType string, body io.Reader) (resp *http.Response, err error) {
+	u := apiURL(path, val)
+	logger.Debugf("url post -> %s", u.String())
+	start := time.Now()
+	defer func() { observeCall(path, start, err) }()
+	resp, err = http.Post(u.String(), contentType, body)
+	if resp == nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return resp, errors.New(resp.Status)
+	}
+	return resp, err
+}
+
+func apiURL(path string, val url.Values) *url.URL {
+	u := &url.URL{}
 	u.Scheme = "http"
 	u.Host = ipfsHost
 	u.Path = api + path
@@ -225,7 +590,14 @@ func (fs *Share) Request(path string, val url.Values) (resp *http.Response, err
 	}
 	val.Set("encoding", "json")
 	u.RawQuery = val.Encode()
+	return u
+}
+
+func (fs *Share) Request(path string, val url.Values) (resp *http.Response, err error) {
+	u := apiURL(path, val)
 	logger.Debugf("url request -> %s", u.String())
+	start := time.Now()
+	defer func() { observeCall(path, start, err) }()
 	resp, err = http.Get(u.String())
 	if resp == nil {
 		return nil, err
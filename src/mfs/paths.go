@@ -0,0 +1,83 @@
+package mfs
+
+// path construction for anything built from remote input,
+// all mfs paths that include a name from the mesh go through here.
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var (
+	ErrNoShare  = errors.New("Share does not exist")
+	ErrBadPath  = errors.New("Path escapes the share root")
+	ErrNoEscape = errors.New("Name can not be escaped")
+)
+
+// EscapeName : make an arbitrary name safe as a single path element.
+// Bytes outside the share name charset are written as %XX, as is a
+// leading dot, so "." and ".." can never survive. The escaping is
+// reversible so different names can not collide.
+func EscapeName(name string) (string, error) {
+	if len(name) == 0 || len(name) > MaxNameLen {
+		return "", ErrNoEscape
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if safeByte(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String(), nil
+}
+
+func safeByte(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '.', c == '_', c == '-':
+		return true
+	}
+	return false
+}
+
+// ShareRoot : the mfs folder for a share name
+func ShareRoot(share string) (root string, err error) {
+	if err := ValidName(share); err != nil {
+		return "", err
+	}
+	return "/" + share, nil
+}
+
+// PeerPath : the folder a peer's copy of a share is written to.
+// The share must be one we hold and the result is checked to sit
+// directly inside its root.
+func (fs *Share) PeerPath(share, peer string) (p string, err error) {
+	fs.watchLock.Lock()
+	_, ok := fs.watch[share]
+	fs.watchLock.Unlock()
+	if !ok {
+		return "", ErrNoShare
+	}
+	return peerPath(share, peer)
+}
+
+func peerPath(share, peer string) (p string, err error) {
+	root, err := ShareRoot(share)
+	if err != nil {
+		return "", err
+	}
+	name, err := EscapeName(peer)
+	if err != nil {
+		return "", err
+	}
+	p = path.Join(root, name)
+	if path.Dir(p) != root || p != root+"/"+name {
+		return "", ErrBadPath
+	}
+	return p, nil
+}
@@ -0,0 +1,82 @@
+package mfs
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEscapeName(t *testing.T) {
+	cases := map[string]string{
+		"bob":      "bob",
+		"bob.host": "bob.host",
+		".":        "%2E",
+		"..":       "%2E.",
+		"../..":    "%2E.%2F..",
+		"a/b":      "a%2Fb",
+		"a\\b":     "a%5Cb",
+		"tab\tme":  "tab%09me",
+		"100%":     "100%25",
+	}
+	for in, want := range cases {
+		got, err := EscapeName(in)
+		if err != nil || got != want {
+			t.Errorf("EscapeName(%q) = %q, %v want %q", in, got, err, want)
+		}
+	}
+	if _, err := EscapeName(""); err == nil {
+		t.Errorf("empty name escaped")
+	}
+}
+
+func TestPeerPath(t *testing.T) {
+	fs := &Share{watch: map[string]string{"share": ""}}
+	p, err := fs.PeerPath("share", "bob")
+	if err != nil || p != "/share/bob" {
+		t.Errorf("PeerPath = %q, %v", p, err)
+	}
+	for _, share := range []string{"other", "..", "../share", "share/..", "/share", ""} {
+		if _, err := fs.PeerPath(share, "bob"); err == nil {
+			t.Errorf("share %q accepted", share)
+		}
+	}
+	for _, peer := range []string{"..", "../..", "/", "a/../../b", "\x00"} {
+		p, err := fs.PeerPath("share", peer)
+		if err != nil {
+			continue
+		}
+		if !inside(p, "/share") {
+			t.Errorf("peer %q escaped to %q", peer, p)
+		}
+	}
+}
+
+// inside checks p is a single element directly under root
+func inside(p, root string) bool {
+	return path.Clean(p) == p && path.Dir(p) == root && !strings.ContainsAny(path.Base(p), "/\\")
+}
+
+func FuzzPeerPath(f *testing.F) {
+	f.Add("share", "bob")
+	f.Add("share", "../..")
+	f.Add("..", "bob")
+	f.Add("share", "a/b\x00")
+	f.Fuzz(func(t *testing.T, share, peer string) {
+		p, err := peerPath(share, peer)
+		if err != nil {
+			return
+		}
+		root, err := ShareRoot(share)
+		if err != nil {
+			t.Fatalf("path built for invalid share %q", share)
+		}
+		if !inside(p, root) {
+			t.Errorf("share %q peer %q escaped to %q", share, peer, p)
+		}
+		for _, c := range []byte(path.Base(p)) {
+			if c < 0x20 || c == 0x7f {
+				t.Errorf("control character in %q", p)
+			}
+		}
+	})
+}
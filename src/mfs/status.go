@@ -0,0 +1,113 @@
+package mfs
+
+// what the share has seen, for the status api
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxEvents is the number of update outcomes kept
+const MaxEvents = 256
+
+// ShareStatus is the local state of one share
+type ShareStatus struct {
+	Name    string
+	Source  string
+	Hash    string    // local hash at the last scan, empty before the first
+	Changed time.Time // when the local hash last changed
+	Checked time.Time // last scan
+}
+
+// UpdateEvent is an update and what became of it
+type UpdateEvent struct {
+	Update
+	Outcome string // pending, applied, ignored, rejected or failed
+	Error   string `json:",omitempty"`
+	Done    time.Time
+}
+
+const (
+	OutcomePending  = "pending"
+	OutcomeApplied  = "applied"
+	OutcomeIgnored  = "ignored"  // not a share we hold
+	OutcomeRejected = "rejected" // bad path or hash
+	OutcomeFailed   = "failed"
+)
+
+// history is the updates being applied and the latest outcomes
+type history struct {
+	lock    sync.Mutex
+	pending map[int]Update
+	next    int
+	recent  []UpdateEvent
+}
+
+func newHistory() *history {
+	return &history{
+		pending: make(map[int]Update),
+	}
+}
+
+func (h *history) begin(u Update) (id int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.next++
+	h.pending[h.next] = u
+	return h.next
+}
+
+// end : record the outcome, an error fails an update
+// that was otherwise applied
+func (h *history) end(id int, outcome string, err error) (ev UpdateEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ev = UpdateEvent{
+		Update:  h.pending[id],
+		Outcome: outcome,
+		Done:    time.Now(),
+	}
+	if err != nil {
+		if outcome == OutcomeApplied {
+			ev.Outcome = OutcomeFailed
+		}
+		ev.Error = err.Error()
+	}
+	delete(h.pending, id)
+	h.recent = append(h.recent, ev)
+	if len(h.recent) > MaxEvents {
+		h.recent = h.recent[len(h.recent)-MaxEvents:]
+	}
+	return ev
+}
+
+// Events : the updates being applied and the recent outcomes, oldest first
+func (fs *Share) Events() (pending []UpdateEvent, recent []UpdateEvent) {
+	h := fs.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, u := range h.pending {
+		pending = append(pending, UpdateEvent{Update: u, Outcome: OutcomePending})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Stamp.Before(pending[j].Stamp)
+	})
+	recent = append(recent, h.recent...)
+	return pending, recent
+}
+
+// Status : the local state of each share, by name
+func (fs *Share) Status() (st []ShareStatus) {
+	fs.watchLock.Lock()
+	defer fs.watchLock.Unlock()
+	for name, source := range fs.paths {
+		s := ShareStatus{Name: name, Source: source, Hash: fs.watch[name]}
+		if c, ok := fs.changed[name]; ok {
+			s.Changed = c
+		}
+		s.Checked = fs.checked
+		st = append(st, s)
+	}
+	sort.Slice(st, func(i, j int) bool { return st[i].Name < st[j].Name })
+	return st
+}
@@ -0,0 +1,69 @@
+package mfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	fs := &Share{history: newHistory()}
+	a := fs.history.begin(Update{Path: "share", NewHash: "a"})
+	b := fs.history.begin(Update{Path: "share", NewHash: "b"})
+	pending, recent := fs.Events()
+	if len(pending) != 2 || len(recent) != 0 {
+		t.Fatalf("pending %d recent %d", len(pending), len(recent))
+	}
+	fs.history.end(a, OutcomeApplied, nil)
+	fs.history.end(b, OutcomeApplied, errors.New("copy"))
+	pending, recent = fs.Events()
+	if len(pending) != 0 || len(recent) != 2 {
+		t.Fatalf("pending %d recent %d", len(pending), len(recent))
+	}
+	if recent[0].NewHash != "a" || recent[0].Outcome != OutcomeApplied {
+		t.Errorf("first event %+v", recent[0])
+	}
+	if recent[1].Outcome != OutcomeFailed || recent[1].Error != "copy" {
+		t.Errorf("failed event %+v", recent[1])
+	}
+	for i := 0; i < MaxEvents+10; i++ {
+		fs.history.end(fs.history.begin(Update{}), OutcomeIgnored, nil)
+	}
+	if _, recent = fs.Events(); len(recent) != MaxEvents {
+		t.Errorf("kept %d events", len(recent))
+	}
+}
+
+func TestClose(t *testing.T) {
+	fs := NewShare(map[string]*Share{})
+	if !fs.enter() {
+		t.Fatalf("open share refused an update")
+	}
+	if err := fs.Close(10 * time.Millisecond); err != ErrDrainTimeout {
+		t.Errorf("close with an update in flight %v", err)
+	}
+	if err := fs.SubmitUpdate(Update{Path: "share"}); err != ErrClosed {
+		t.Errorf("update after close %v", err)
+	}
+	fs.inflight.Done()
+	if err := fs.Close(time.Second); err != nil {
+		t.Errorf("second close %v", err)
+	}
+}
+
+func TestAddRemoveShare(t *testing.T) {
+	fs := NewShare(map[string]*Share{})
+	if err := fs.AddShare("../up", "/tmp"); err == nil {
+		t.Errorf("bad share name taken")
+	}
+	fs.AddShare("photos", "/photos")
+	fs.AddShare("music", "/music")
+	fs.RemoveShare("music")
+	st := fs.Status()
+	if len(st) != 1 || st[0].Name != "photos" || st[0].Source != "/photos" {
+		t.Fatalf("status %+v", st)
+	}
+	if _, ok := fs.watch["music"]; ok {
+		t.Errorf("removed share still watched")
+	}
+}
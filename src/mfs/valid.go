@@ -0,0 +1,48 @@
+package mfs
+
+// validation for names and hashes that arrive from other nodes
+import (
+	"errors"
+	"regexp"
+)
+
+const (
+	MaxNameLen = 64
+	MaxHashLen = 128
+)
+
+var (
+	ErrBadName = errors.New("Bad share name")
+	ErrBadHash = errors.New("Bad content hash")
+)
+
+var (
+	// share names are a single plain path element
+	nameChars = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// CIDv0 is a base58 sha256 multihash
+	cidV0 = regexp.MustCompile(`^Qm[1-9A-HJ-NP-Za-km-z]{44}$`)
+	// CIDv1 in the multibases ipfs prints (base32, base58btc, base16)
+	cidV1 = regexp.MustCompile(`^(b[a-z2-7]{40,}|z[1-9A-HJ-NP-Za-km-z]{40,}|f[0-9a-f]{40,})$`)
+)
+
+// ValidName : check a share name is safe to use as a single mfs path element
+func ValidName(name string) error {
+	if len(name) == 0 || len(name) > MaxNameLen {
+		return ErrBadName
+	}
+	if !nameChars.MatchString(name) {
+		return ErrBadName
+	}
+	return nil
+}
+
+// ValidHash : check the syntax of a content identifier
+func ValidHash(hash string) error {
+	if len(hash) == 0 || len(hash) > MaxHashLen {
+		return ErrBadHash
+	}
+	if !cidV0.MatchString(hash) && !cidV1.MatchString(hash) {
+		return ErrBadHash
+	}
+	return nil
+}
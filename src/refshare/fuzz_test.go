@@ -0,0 +1,135 @@
+package refshare
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"testing"
+)
+
+const (
+	testHash = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+	testFp   = "0123456789abcdef0123456789abcdef"
+)
+
+// testRing signs with a plain digest of the payload and key
+type testRing struct {
+	fp   string
+	next map[string]string // rotations, old key to new
+}
+
+func (r *testRing) FingerPrint() string {
+	return r.fp
+}
+
+func (r *testRing) Sign(data []byte) (string, error) {
+	return fmt.Sprintf("%x", sha256.Sum256(append(data, r.fp...))), nil
+}
+
+func (r *testRing) Verify(fp string, data []byte, signature string) error {
+	if signature != fmt.Sprintf("%x", sha256.Sum256(append(data, fp...))) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+func (r *testRing) Successor(fp string) string {
+	if next, ok := r.next[fp]; ok {
+		return next
+	}
+	return fp
+}
+
+func (r *testRing) Await(fp string) <-chan struct{} {
+	return nil
+}
+
+func testEntry(fp string, r refs) *entry {
+	e := &entry{FingerPrint: fp, Nickname: "bob", Version: 1, Refs: r}
+	e.Signature, _ = (&testRing{fp: fp}).Sign(e.payload())
+	return e
+}
+
+func encodeSet(t testing.TB, set map[string]*entry) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(set); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeSet(t *testing.T) {
+	good := map[string]*entry{testFp: testEntry(testFp, refs{"share": testHash})}
+	if _, err := decodeSet(encodeSet(t, good)); err != nil {
+		t.Errorf("good set rejected %v", err)
+	}
+	bad := []map[string]*entry{
+		{testFp: testEntry(testFp, refs{"../..": testHash})},
+		{testFp: testEntry(testFp, refs{"a/b": testHash})},
+		{testFp: testEntry(testFp, refs{"share": "not a hash"})},
+		{testFp: testEntry(testFp, refs{"": testHash})},
+		{"other": testEntry(testFp, refs{"share": testHash})},
+		{"zz": testEntry("zz", refs{"share": testHash})},
+	}
+	for _, set := range bad {
+		if _, err := decodeSet(encodeSet(t, set)); err == nil {
+			t.Errorf("bad set accepted %v", set)
+		}
+	}
+	big := map[string]*entry{}
+	for i := 0; i <= MaxPeers; i++ {
+		fp := fmt.Sprintf("%032x", i)
+		big[fp] = testEntry(fp, refs{})
+	}
+	if _, err := decodeSet(encodeSet(t, big)); err != ErrTooMany {
+		t.Errorf("oversized set got %v", err)
+	}
+	if _, err := decodeSet(make([]byte, MaxGossipSize+1)); err != ErrTooBig {
+		t.Errorf("oversized message got %v", err)
+	}
+}
+
+func TestMergeVerified(t *testing.T) {
+	p := NewPeer(&testRing{fp: "ffffffffffffffffffffffffffffffff"}, "me", log)
+	e := testEntry(testFp, refs{"share": testHash})
+	forged := testEntry(testFp, refs{"share": testHash})
+	forged.Version = 2
+	if _, err := p.OnGossip(encodeSet(t, map[string]*entry{testFp: forged})); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.st.set) != 0 {
+		t.Errorf("forged entry merged")
+	}
+	delta, err := p.OnGossip(encodeSet(t, map[string]*entry{testFp: e}))
+	if err != nil || delta == nil {
+		t.Fatalf("signed entry not merged %v", err)
+	}
+	u := <-p.UpdateChannel()
+	if u.FingerPrint != testFp || u.PeerName != "bob" || u.NewHash != testHash {
+		t.Errorf("bad update %v", u)
+	}
+	// the same version again is not news
+	if delta, _ := p.OnGossip(encodeSet(t, map[string]*entry{testFp: e})); delta != nil {
+		t.Errorf("stale entry merged")
+	}
+}
+
+func FuzzDecodeSet(f *testing.F) {
+	f.Add(encodeSet(f, map[string]*entry{testFp: testEntry(testFp, refs{"share": testHash})}))
+	f.Add(encodeSet(f, map[string]*entry{}))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		set, err := decodeSet(buf)
+		if err != nil {
+			return
+		}
+		for _, e := range set {
+			for name := range e.Refs {
+				if name == "." || name == ".." || bytes.ContainsAny([]byte(name), "/\\") {
+					t.Errorf("unsafe name accepted %q", name)
+				}
+			}
+		}
+	})
+}
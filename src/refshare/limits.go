@@ -0,0 +1,114 @@
+package refshare
+
+// bounds and checks for gossip received from the mesh
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/weaveworks/mesh"
+	"mfs"
+)
+
+const (
+	MaxGossipSize    = 1 << 20 // largest accepted gossip message in bytes
+	MaxPeers         = 1024    // publishers in a single message
+	MaxRefs          = 256     // shares per publisher
+	MaxSignatureSize = 2048    // hex encoded signature
+	FingerPrintSize  = 32      // hex finger print of a publisher key
+)
+
+var (
+	ErrTooBig       = errors.New("Gossip message too large")
+	ErrTooMany      = errors.New("Too many entries in gossip")
+	ErrFingerPrint  = errors.New("Bad finger print")
+	ErrBadNickname  = errors.New("Bad nickname")
+	ErrBadSignature = errors.New("Bad signature encoding")
+)
+
+// decodeSet unpacks a gossip message and validates every entry,
+// any bad field rejects the whole message.
+func decodeSet(buf []byte) (set map[string]*entry, err error) {
+	if len(buf) > MaxGossipSize {
+		return nil, ErrTooBig
+	}
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
+		return nil, err
+	}
+	if len(set) > MaxPeers {
+		return nil, ErrTooMany
+	}
+	for fp, e := range set {
+		if err := e.valid(); err != nil {
+			return nil, err
+		}
+		if e.FingerPrint != fp {
+			return nil, ErrFingerPrint
+		}
+	}
+	return set, nil
+}
+
+// valid checks the fields of an entry, not the signature
+func (e *entry) valid() (err error) {
+	if e == nil {
+		return ErrFingerPrint
+	}
+	if len(e.FingerPrint) != FingerPrintSize {
+		return ErrFingerPrint
+	}
+	if _, err := hex.DecodeString(e.FingerPrint); err != nil {
+		return ErrFingerPrint
+	}
+	if len(e.Nickname) > mfs.MaxNameLen || !utf8.ValidString(e.Nickname) {
+		return ErrBadNickname
+	}
+	if len(e.Signature) == 0 || len(e.Signature) > MaxSignatureSize {
+		return ErrBadSignature
+	}
+	if len(e.Refs) > MaxRefs {
+		return ErrTooMany
+	}
+	for name, hash := range e.Refs {
+		if err := mfs.ValidName(name); err != nil {
+			return err
+		}
+		if err := mfs.ValidHash(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rejects counts the refs sets that did not decode, by the peer
+// that sent them. A set from periodic gossip has no sender and is
+// counted under mesh.UnknownPeerName.
+type rejects struct {
+	mtx   sync.Mutex
+	count map[mesh.PeerName]uint64
+}
+
+func newRejects() *rejects {
+	return &rejects{
+		count: make(map[mesh.PeerName]uint64),
+	}
+}
+
+func (r *rejects) add(src mesh.PeerName) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.count[src]++
+}
+
+func (r *rejects) get() (count map[mesh.PeerName]uint64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	count = make(map[mesh.PeerName]uint64)
+	for i, j := range r.count {
+		count[i] = j
+	}
+	return count
+}
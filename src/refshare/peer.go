@@ -3,25 +3,47 @@ package refshare
 import (
 	"github.com/op/go-logging"
 
-	"bytes"
-	"encoding/gob"
-	"fmt"
 	"github.com/weaveworks/mesh"
 	"mfs"
+	"sync"
 	"time"
 )
 
+// Keyring signs our refs and checks the refs of other nodes,
+// publishers are identified by the finger print of their key.
+type Keyring interface {
+	FingerPrint() string
+	Sign(data []byte) (signature string, err error)
+	Verify(fp string, data []byte, signature string) error
+	// Successor follows rotations from fp to the current key of the
+	// publisher, fp itself when it has not rotated
+	Successor(fp string) string
+	// Await asks for a key we do not hold, the channel closes when it
+	// arrives or the ask gives up. Nil if there is nothing to wait for.
+	Await(fp string) <-chan struct{}
+}
+
 // Peer encapsulates state and implements mesh.Gossiper.
 // It should be passed to mesh.Router.NewGossip,
 // and the resulting Gossip registered in turn,
 // before calling mesh.Router.Start.
 type Peer struct {
-	st      *state
-	send    mesh.Gossip
-	actions chan<- func()
-	quit    chan struct{}
-	update  chan mfs.Update
-	logger  *logging.Logger
+	st       *state
+	send     mesh.Gossip
+	actions  chan<- func()
+	quit     chan struct{}
+	stopOnce sync.Once
+	update   chan mfs.Update
+	logger   *logging.Logger
+	rejects  *rejects
+	ring     Keyring
+	nickname string
+
+	spoolLock sync.Mutex
+	spooled   map[string]refs // last refs sent on for each publisher
+
+	waitLock sync.Mutex
+	waiting  map[string]*entry // newest entry held for each key asked for
 }
 
 // peer implements mesh.Gossiper.
@@ -30,15 +52,20 @@ var _ mesh.Gossiper = &Peer{}
 // Construct a peer with empty state.
 // Be sure to register a channel, later,
 // so we can make outbound communication.
-func NewPeer(self mesh.PeerName, logger *logging.Logger) *Peer {
+func NewPeer(ring Keyring, nickname string, logger *logging.Logger) *Peer {
 	actions := make(chan func())
 	p := &Peer{
-		st:      newState(self),
-		send:    nil, // must .register() later
-		actions: actions,
-		quit:    make(chan struct{}),
-		update:  make(chan mfs.Update, 10),
-		logger:  logger,
+		st:       newState(ring.FingerPrint()),
+		send:     nil, // must .register() later
+		actions:  actions,
+		quit:     make(chan struct{}),
+		update:   make(chan mfs.Update, 10),
+		logger:   logger,
+		rejects:  newRejects(),
+		ring:     ring,
+		nickname: nickname,
+		spooled:  make(map[string]refs),
+		waiting:  make(map[string]*entry),
 	}
 	go p.loop(actions)
 	return p
@@ -50,6 +77,11 @@ func (p *Peer) UpdateChannel() (update chan mfs.Update) {
 	return p.update
 }
 
+// Rejected returns the count of refused gossip messages per source peer.
+func (p *Peer) Rejected() map[mesh.PeerName]uint64 {
+	return p.rejects.get()
+}
+
 func (p *Peer) loop(actions <-chan func()) {
 	for {
 		select {
@@ -63,7 +95,7 @@ func (p *Peer) loop(actions <-chan func()) {
 
 // register the result of a mesh.Router.NewGossip.
 func (p *Peer) Register(send mesh.Gossip) {
-	p.actions <- func() { p.send = send }
+	p.do(func() { p.send = send })
 }
 
 // Return the current value of the counter.
@@ -73,23 +105,40 @@ func (p *Peer) get() refs {
 
 func (p *Peer) Insert(name, value string) (result refs) {
 	c := make(chan struct{})
-	p.actions <- func() {
+	ok := p.do(func() {
 		defer close(c)
-		st := p.st.insert(name, value)
+		st, err := p.st.insert(name, value, p.nickname, p.ring)
+		if err != nil {
+			p.logger.Errorf("Sign refs %v", err)
+			return
+		}
 		//p.logger.Debugf("Insert data %v", st)
 		if p.send != nil {
 			p.send.GossipBroadcast(st)
 		} else {
 			p.logger.Critical("no sender configured; not broadcasting update right now")
 		}
-		result = st.get()
+		result = p.st.get()
+	})
+	if ok {
+		<-c
 	}
-	<-c
 	return result
 }
 
-func (p *Peer) stop() {
-	close(p.quit)
+// Stop ends the loop, the peer does nothing after it.
+func (p *Peer) Stop() {
+	p.stopOnce.Do(func() { close(p.quit) })
+}
+
+// do runs f in the loop, false once the peer has stopped
+func (p *Peer) do(f func()) bool {
+	select {
+	case p.actions <- f:
+		return true
+	case <-p.quit:
+		return false
+	}
 }
 
 // Return a copy of our complete state.
@@ -99,45 +148,127 @@ func (p *Peer) Gossip() (complete mesh.GossipData) {
 	return complete
 }
 
+// verified drops the entries whose signature does not check out.
+// Entries from keys we do not hold yet are held while the key is
+// asked for, and merged when it arrives. Nothing from a revoked key
+// verifies, what we held before the revocation is kept.
+func (p *Peer) verified(set map[string]*entry) map[string]*entry {
+	for fp, e := range set {
+		if err := p.ring.Verify(fp, e.payload(), e.Signature); err != nil {
+			p.logger.Debugf("Unverified refs from %s %v", fp, err)
+			delete(set, fp)
+			if wait := p.ring.Await(fp); wait != nil {
+				p.hold(fp, e, wait)
+			}
+		}
+	}
+	return set
+}
+
+// hold keeps the newest entry from a key being asked for,
+// one waiter for each key
+func (p *Peer) hold(fp string, e *entry, wait <-chan struct{}) {
+	p.waitLock.Lock()
+	defer p.waitLock.Unlock()
+	cur, ok := p.waiting[fp]
+	if ok {
+		if e.Version > cur.Version {
+			p.waiting[fp] = e
+		}
+		return
+	}
+	if len(p.waiting) >= MaxPeers {
+		return
+	}
+	p.waiting[fp] = e
+	go func() {
+		<-wait
+		p.waitLock.Lock()
+		e := p.waiting[fp]
+		delete(p.waiting, fp)
+		p.waitLock.Unlock()
+		if err := p.ring.Verify(fp, e.payload(), e.Signature); err != nil {
+			p.logger.Debugf("Held refs from %s %v", fp, err)
+			return
+		}
+		p.SpoolMerge(p.st.mergeDelta(map[string]*entry{fp: e}))
+	}()
+}
+
 // Merge the gossiped data represented by buf into our state.
 // Return the state information that was modified.
 func (p *Peer) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
-	var set map[mesh.PeerName]refs
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
+	set, err := decodeSet(buf)
+	if err != nil {
+		p.rejects.add(mesh.UnknownPeerName)
 		return nil, err
 	}
-	delta = p.st.mergeDelta(set)
+	delta = p.st.mergeDelta(p.verified(set))
 	p.SpoolMerge(delta)
 	return delta, nil
 }
 
+// SpoolMerge sends on the refs that changed for each publisher.
+// Refs of a key the publisher rotated away from are not sent, the
+// current key carries on from the refs sent for the old one.
 func (p *Peer) SpoolMerge(delta mesh.GossipData) {
-	if delta != nil {
-		for node, values := range delta.(*state).set {
-			//fmt.Println("source ->", node)
-			for key, value := range values {
-				//fmt.Println("delta ", key, value)
-				u := mfs.Update{
-					Path:     key,
-					NewHash:  value,
-					Stamp:    time.Now(),
-					PeerName: node.String(),
-				}
-				p.update <- u
+	if delta == nil {
+		return
+	}
+	p.spoolLock.Lock()
+	defer p.spoolLock.Unlock()
+	for fp, e := range delta.(*state).set {
+		if fp == p.st.self || p.ring.Successor(fp) != fp {
+			continue
+		}
+		last, ok := p.spooled[fp]
+		if !ok {
+			last = p.carried(fp)
+		}
+		for key, value := range e.Refs {
+			if last[key] == value {
+				continue
+			}
+			u := mfs.Update{
+				Path:        key,
+				NewHash:     value,
+				OldHash:     last[key],
+				Stamp:       time.Now(),
+				PeerName:    e.Nickname,
+				FingerPrint: fp,
 			}
+			select {
+			case p.update <- u:
+			case <-p.quit:
+				return
+			}
+		}
+		p.spooled[fp] = e.Refs
+	}
+}
+
+// carried : the refs last sent for a key that rotated to fp,
+// hold spoolLock
+func (p *Peer) carried(fp string) refs {
+	for old, last := range p.spooled {
+		if old != fp && p.ring.Successor(old) == fp {
+			delete(p.spooled, old)
+			return last
 		}
 	}
+	return nil
 }
 
 // Merge the gossiped data represented by buf into our state.
 // Return the state information that was modified.
 func (p *Peer) OnGossipBroadcast(src mesh.PeerName, buf []byte) (received mesh.GossipData, err error) {
-	var set map[mesh.PeerName]refs
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
-		fmt.Println(err)
+	set, err := decodeSet(buf)
+	if err != nil {
+		p.logger.Errorf("broadcast from %s rejected %v", src, err)
+		p.rejects.add(src)
 		return nil, err
 	}
-	received = p.st.mergeReceived(set)
+	received = p.st.mergeReceived(p.verified(set))
 	p.SpoolMerge(received)
 	return received, nil
 }
@@ -145,12 +276,13 @@ func (p *Peer) OnGossipBroadcast(src mesh.PeerName, buf []byte) (received mesh.G
 // Merge the gossiped data represented by buf into our state.
 func (p *Peer) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
 	p.logger.Info(" unicast , %s", src)
-	var set map[mesh.PeerName]refs
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
+	set, err := decodeSet(buf)
+	if err != nil {
+		p.rejects.add(src)
 		return err
 	}
 
-	complete := p.st.mergeComplete(set)
+	complete := p.st.mergeComplete(p.verified(set))
 	p.logger.Debug("OnGossipUnicast %s %v => complete %v", src, set, complete)
 	return nil
 }
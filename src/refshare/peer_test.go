@@ -0,0 +1,95 @@
+package refshare
+
+import (
+	"testing"
+	"time"
+
+	"keys"
+)
+
+// storeRing verifies with a key store as the daemon does
+type storeRing struct {
+	testRing
+	ks *keys.KeyStore
+}
+
+func (r *storeRing) Verify(fp string, data []byte, signature string) error {
+	return r.ks.VerifyBytes(fp, data, signature)
+}
+
+func TestRevokedRefs(t *testing.T) {
+	plain := &keys.Passphrase{Plaintext: true}
+	pub, err := keys.NewKeyStore(t.TempDir()+"/pub", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	ks, err := keys.NewKeyStore(t.TempDir()+"/node", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	local, _ := pub.LocalKey()
+	sigK, _ := local.MakeSigned()
+	ks.PutPublic(sigK, "public")
+	fp := local.FingerPrint()
+	signed := func(version int64) *entry {
+		e := &entry{FingerPrint: fp, Nickname: "bob", Version: version, Refs: refs{"share": testHash}}
+		e.Signature, _ = pub.SignBytes(e.payload())
+		return e
+	}
+
+	p := NewPeer(&storeRing{testRing{fp: "ffffffffffffffffffffffffffffffff"}, ks}, "me", log)
+	defer p.Stop()
+	held := signed(time.Now().UnixNano())
+	if delta, err := p.OnGossip(encodeSet(t, map[string]*entry{fp: held})); err != nil || delta == nil {
+		t.Fatalf("signed entry not merged %v", err)
+	}
+	sr, err := pub.Revoke(fp, "leaked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.TryRevoke(sr); err != nil {
+		t.Fatal(err)
+	}
+	// the leaked key stamps its refs just before the revocation
+	r, _ := sr.GetRevocation()
+	backdated := signed(r.Stamp.UnixNano() - 1)
+	if delta, _ := p.OnGossip(encodeSet(t, map[string]*entry{fp: backdated})); delta != nil {
+		t.Errorf("backdated entry from a revoked key merged")
+	}
+	if e := p.st.set[fp]; e == nil || e.Version != held.Version {
+		t.Errorf("held entry replaced by %v", e)
+	}
+}
+
+func TestRotatedSpool(t *testing.T) {
+	old, next := testFp, "fedcba9876543210fedcba9876543210"
+	ring := &testRing{fp: "ffffffffffffffffffffffffffffffff", next: map[string]string{}}
+	p := NewPeer(ring, "me", log)
+	spool := func(fp string, r refs) {
+		st := newState(ring.fp)
+		st.set[fp] = testEntry(fp, r)
+		p.SpoolMerge(st)
+	}
+	spool(old, refs{"share": testHash})
+	if u := <-p.UpdateChannel(); u.FingerPrint != old {
+		t.Fatalf("update from %s", u.FingerPrint)
+	}
+	ring.next[old] = next
+	// the new key carries on where the old one left off
+	spool(next, refs{"share": testHash})
+	moved := "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+	spool(next, refs{"share": moved})
+	u := <-p.UpdateChannel()
+	if u.FingerPrint != next || u.NewHash != moved || u.OldHash != testHash {
+		t.Errorf("update after rotation %+v", u)
+	}
+	// and the retired key is not sent on again
+	spool(old, refs{"share": testHash})
+	select {
+	case u := <-p.UpdateChannel():
+		t.Errorf("update from a retired key %+v", u)
+	default:
+	}
+}
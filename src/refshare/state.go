@@ -2,7 +2,9 @@ package refshare
 
 import (
 	"bytes"
+	"encoding/json"
 	"sync"
+	"time"
 
 	"encoding/gob"
 
@@ -14,11 +16,38 @@ var log = logging.MustGetLogger("state")
 
 type refs map[string]string
 
-// state is an implementation of a G-counter.
+// entry is the set of refs published by one node,
+// keyed and signed by the finger print of its key.
+type entry struct {
+	FingerPrint string
+	Nickname    string
+	Version     int64 // bigger wins
+	Refs        refs
+	Signature   string
+}
+
+// stamp is when the entry was signed, versions are nanosecond times
+func (e *entry) stamp() time.Time {
+	return time.Unix(0, e.Version)
+}
+
+// payload is the data covered by the signature,
+// json sorts the map keys so the encoding is stable.
+func (e *entry) payload() []byte {
+	data, _ := json.Marshal(&entry{
+		FingerPrint: e.FingerPrint,
+		Nickname:    e.Nickname,
+		Version:     e.Version,
+		Refs:        e.Refs,
+	})
+	return data
+}
+
+// state is a last writer wins map of entries.
 type state struct {
 	mtx  sync.RWMutex
-	set  map[mesh.PeerName]refs
-	self mesh.PeerName
+	set  map[string]*entry
+	self string
 }
 
 // state implements GossipData.
@@ -27,9 +56,9 @@ var _ mesh.GossipData = &state{}
 // Construct an empty state object, ready to receive updates.
 // This is suitable to use at program start.
 // Other peers will populate us with data.
-func newState(self mesh.PeerName) *state {
+func newState(self string) *state {
 	return &state{
-		set:  map[mesh.PeerName]refs{},
+		set:  map[string]*entry{},
 		self: self,
 	}
 }
@@ -37,8 +66,8 @@ func newState(self mesh.PeerName) *state {
 func (st *state) String() string {
 	s := "\n"
 	for i, j := range st.set {
-		s += i.String() + "\n"
-		for k, l := range j {
+		s += i + " (" + j.Nickname + ")\n"
+		for k, l := range j.Refs {
 			s += "\t" + k + " -> " + l + "\n"
 		}
 	}
@@ -48,30 +77,51 @@ func (st *state) String() string {
 func (st *state) get() (result refs) {
 	st.mtx.RLock()
 	defer st.mtx.RUnlock()
-	return st.set[st.self]
+	cur, ok := st.set[st.self]
+	if !ok {
+		return nil
+	}
+	return cur.Refs
 }
 
-func (st *state) insert(name, value string) (complete *state) {
+// insert a ref into our own entry and sign the new version
+func (st *state) insert(name, value, nickname string, ring Keyring) (complete *state, err error) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
-	cur, ok := st.set[st.self]
-	if ok {
-		cur[name] = value
-	} else {
-		r := refs{}
-		r[name] = value
-		st.set[st.self] = r
+	e := &entry{
+		FingerPrint: st.self,
+		Nickname:    nickname,
+		Version:     time.Now().UnixNano(),
+		Refs:        refs{},
 	}
-	return &state{
-		set: st.set,
+	if cur, ok := st.set[st.self]; ok {
+		for k, v := range cur.Refs {
+			e.Refs[k] = v
+		}
+		if e.Version <= cur.Version {
+			e.Version = cur.Version + 1
+		}
 	}
+	e.Refs[name] = value
+	e.Signature, err = ring.Sign(e.payload())
+	if err != nil {
+		return nil, err
+	}
+	st.set[st.self] = e
+	return &state{
+		set: map[string]*entry{st.self: e},
+	}, nil
 }
 
 func (st *state) copy() *state {
 	st.mtx.RLock()
 	defer st.mtx.RUnlock()
+	set := make(map[string]*entry, len(st.set))
+	for i, j := range st.set {
+		set[i] = j
+	}
 	return &state{
-		set: st.set,
+		set: set,
 	}
 }
 
@@ -93,54 +143,50 @@ func (st *state) Merge(other mesh.GossipData) (complete mesh.GossipData) {
 	return st.mergeComplete(other.(*state).copy().set)
 }
 
-// Merge the set into our state, abiding increment-only semantics.
+// merge keeps the newest version of each entry,
+// returns the entries that were novel to us.
+func (st *state) merge(set map[string]*entry) (novel map[string]*entry) {
+	novel = make(map[string]*entry)
+	for fp, v := range set {
+		if cur, ok := st.set[fp]; ok && cur.Version >= v.Version {
+			continue
+		}
+		st.set[fp] = v
+		novel[fp] = v
+	}
+	return novel
+}
+
+// Merge the set into our state, keeping the newest entries.
 // Return a non-nil mesh.GossipData representation of the received set.
-func (st *state) mergeReceived(set map[mesh.PeerName]refs) (received mesh.GossipData) {
+func (st *state) mergeReceived(set map[string]*entry) (received mesh.GossipData) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
-
-	for peer, v := range set {
-		st.set[peer] = v
-	}
-
 	return &state{
-		set: set, // all remaining elements were novel to us
+		set: st.merge(set), // stale entries are not passed on
 	}
 }
 
-// Return any key/values that have been mutated, or nil if nothing changed.
-// TODO this needs to check sub keys
-func (st *state) mergeDelta(set map[mesh.PeerName]refs) (delta mesh.GossipData) {
+// Return any entries that have been updated, or nil if nothing changed.
+func (st *state) mergeDelta(set map[string]*entry) (delta mesh.GossipData) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
-	for peer, v := range set {
-		// Do we have the key in our data
-		if _, ok := st.set[peer]; ok {
-			delete(set, peer) // requirement: it's not part of a delta
-			continue
-		}
-		st.set[peer] = v
-	}
-
+	novel := st.merge(set)
 	//log.Debugf("%v -> %v", set, delta)
-	if len(set) <= 0 {
+	if len(novel) <= 0 {
 		return nil // per OnGossip requirements
 	}
 	return &state{
-		set: set, // all remaining elements were novel to us
+		set: novel, // all remaining elements were novel to us
 	}
 }
 
-// Merge the set into our state, abiding increment-only semantics.
+// Merge the set into our state, keeping the newest entries.
 // Return our resulting, complete state.
-func (st *state) mergeComplete(set map[mesh.PeerName]refs) (complete mesh.GossipData) {
+func (st *state) mergeComplete(set map[string]*entry) (complete mesh.GossipData) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
-
-	for peer, v := range set {
-		st.set[peer] = v
-	}
-
+	st.merge(set)
 	return &state{
 		set: st.set, // n.b. can't .copy() due to lock contention
 	}
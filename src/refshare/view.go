@@ -0,0 +1,54 @@
+package refshare
+
+// a read only view of the refs we hold, for the status api
+import (
+	"sort"
+	"time"
+)
+
+// Published is the signed refs of one node as we hold them
+type Published struct {
+	FingerPrint string
+	Nickname    string
+	Version     int64
+	Stamp       time.Time // when the publisher signed it
+	Refs        map[string]string
+	Self        bool // our own entry
+}
+
+// State returns the refs of every publisher we hold, by finger print.
+func (p *Peer) State() (view []Published) {
+	st := p.st.copy()
+	for fp, e := range st.set {
+		r := make(map[string]string, len(e.Refs))
+		for k, v := range e.Refs {
+			r[k] = v
+		}
+		view = append(view, Published{
+			FingerPrint: fp,
+			Nickname:    e.Nickname,
+			Version:     e.Version,
+			Stamp:       e.stamp(),
+			Refs:        r,
+			Self:        fp == p.st.self,
+		})
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].FingerPrint < view[j].FingerPrint })
+	return view
+}
+
+// Held returns the publishers whose refs wait on their key.
+func (p *Peer) Held() (fps []string) {
+	p.waitLock.Lock()
+	defer p.waitLock.Unlock()
+	for fp := range p.waiting {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	return fps
+}
+
+// Queued returns the number of updates waiting to be applied.
+func (p *Peer) Queued() int {
+	return len(p.update)
+}
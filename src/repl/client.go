@@ -0,0 +1,139 @@
+package main
+
+// the client side of the control api, for the commands
+// that ask a running daemon
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const controlTimeout = 30 * time.Second
+
+var ErrNoDaemon = errors.New("No daemon answered")
+
+type controlClient struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+// dialControl : a client for the daemon of config c, ErrNoDaemon
+// when there is no token or nothing listening
+func dialControl(c *Config) (cl *controlClient, err error) {
+	network, addr, err := c.controlAddr()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(c.controlToken())
+	if os.IsNotExist(err) {
+		return nil, ErrNoDaemon
+	}
+	if err != nil {
+		return nil, err
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	return &controlClient{
+		http: &http.Client{
+			Timeout:   controlTimeout,
+			Transport: &http.Transport{DialContext: dial, DisableKeepAlives: true},
+		},
+		base:  "http://repl/v1/",
+		token: strings.TrimSpace(string(data)),
+	}, nil
+}
+
+// get : decode the reply to path into out
+func (cl *controlClient) get(path string, out interface{}) error {
+	return cl.do("GET", path, nil, out)
+}
+
+// post : send in as json to path, decode the reply into out
+func (cl *controlClient) post(path string, in, out interface{}) error {
+	return cl.do("POST", path, in, out)
+}
+
+func (cl *controlClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, cl.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cl.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" {
+			return ErrNoDaemon
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// askDaemon : a client for the daemon, or a message and exit code
+func askDaemon(name string, c *Config) (cl *controlClient, code int) {
+	cl, err := dialControl(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return nil, exitUnavailable
+	}
+	return cl, exitOK
+}
+
+// daemonError : the exit code for a failed request
+func daemonError(name string, err error) int {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	if err == ErrNoDaemon {
+		return exitUnavailable
+	}
+	return exitError
+}
+
+// fromDaemon : ask the running daemon for path, false
+// when the command should fall back to its offline view
+func fromDaemon(name string, c *Config, path string, out interface{}) bool {
+	cl, err := dialControl(c)
+	if err == nil {
+		err = cl.get(path, out)
+	}
+	if err == nil {
+		return true
+	}
+	if err != ErrNoDaemon && err != ErrControlOff {
+		fmt.Fprintf(os.Stderr, "%s: daemon %v, showing the offline view\n", name, err)
+	}
+	return false
+}
@@ -1,27 +1,35 @@
 package main
 
 import (
-	"crypto/rand"
-	"fmt"
+	"context"
 	"github.com/op/go-logging"
 	"github.com/weaveworks/mesh"
+	"keys"
 	"net"
 	"os"
-
+	"sort"
 	"strconv"
 	"time"
 )
 
+// keyChannel carries the key gossip
+const keyChannel = "keybase"
+
 type Cluster struct {
 	Name mesh.PeerName
 
-	config *Config
-	logger *logging.Logger
-	router *mesh.Router
-	names  map[string]string
+	config    *Config
+	logger    *logging.Logger
+	router    *mesh.Router
+	names     map[string]string
+	directory *keys.Directory
 }
 
-func NewCluster(config *Config, logger *logging.Logger) (cl *Cluster) {
+// NewCluster : the peer name comes from the key finger print,
+// a PeerID set in the config is kept and certified by our claim.
+// A derived name changes when the key rotates, set PeerID to keep
+// one name across rotations.
+func NewCluster(config *Config, fp string, logger *logging.Logger) (cl *Cluster) {
 	cl = &Cluster{config: config, logger: logger}
 	host, portStr, err := net.SplitHostPort(config.Listen)
 	if err != nil {
@@ -31,7 +39,12 @@ func NewCluster(config *Config, logger *logging.Logger) (cl *Cluster) {
 	if err != nil {
 		logger.Fatalf("mesh address: %s: %v", config.Listen, err)
 	}
-	name, err := mesh.PeerNameFromString(config.PeerID)
+	var name mesh.PeerName
+	if config.PeerID == "" {
+		name, err = keys.PeerNameFromFingerPrint(fp)
+	} else {
+		name, err = mesh.PeerNameFromString(config.PeerID)
+	}
 	if err != nil {
 		logger.Fatalf("%v", err)
 	}
@@ -67,9 +80,34 @@ type Widget interface {
 	Register(send mesh.Gossip)
 }
 
+// Attach : put the widget on a gossip channel, its traffic is counted
 func (cl *Cluster) Attach(widget Widget, channel string) {
-	gossip, _ := cl.router.NewGossip(channel, widget)
-	widget.Register(gossip)
+	counted := &countedWidget{Widget: widget, channel: channel}
+	gossip, _ := cl.router.NewGossip(channel, counted)
+	counted.Register(gossip)
+}
+
+// SetDirectory : attach the verified identities of peers
+func (cl *Cluster) SetDirectory(d *keys.Directory) {
+	cl.directory = d
+}
+
+// Identity : the verified identity of a mesh peer, for any widget
+func (cl *Cluster) Identity(name mesh.PeerName) (c *keys.Claim, ok bool) {
+	if cl.directory == nil {
+		return nil, false
+	}
+	return cl.directory.Lookup(name)
+}
+
+// Neighbours : the peers we are connected to directly
+func (cl *Cluster) Neighbours() []mesh.PeerName {
+	return cl.router.Routes.Broadcast(cl.Name)
+}
+
+// OnConnect : call f when the mesh connections change
+func (cl *Cluster) OnConnect(f func()) {
+	cl.router.Routes.OnChange(func() { go f() })
 }
 
 func (cl *Cluster) GetNames() {
@@ -80,6 +118,58 @@ func (cl *Cluster) GetNames() {
 
 }
 
+// Status : the mesh as the router sees it
+func (cl *Cluster) Status() *mesh.Status {
+	return mesh.NewStatus(cl.router)
+}
+
+// Connect : add a peer address to the ones the router dials
+func (cl *Cluster) Connect(addr string) error {
+	errs := cl.router.ConnectionMaker.InitiateConnections([]string{addr}, false)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Forget : stop dialing addr, a live connection stays up
+func (cl *Cluster) Forget(addr string) {
+	cl.router.ConnectionMaker.ForgetConnections([]string{addr})
+}
+
+// PeerInfo : the peers the router knows with their verified keys
+func (cl *Cluster) PeerInfo() (peers []peerInfo) {
+	connected := make(map[mesh.PeerName]bool)
+	for _, name := range cl.Neighbours() {
+		connected[name] = true
+	}
+	status := cl.Status()
+	addrs := make(map[string]string)
+	for _, p := range status.Peers {
+		if p.Name != status.Name {
+			continue
+		}
+		for _, c := range p.Connections {
+			addrs[c.Name] = c.Address
+		}
+	}
+	for _, p := range status.Peers {
+		if p.Name == status.Name {
+			continue
+		}
+		info := peerInfo{Name: p.Name, NickName: p.NickName, Address: addrs[p.Name]}
+		if name, err := mesh.PeerNameFromString(p.Name); err == nil {
+			info.Connected = connected[name]
+			if c, ok := cl.Identity(name); ok {
+				info.FingerPrint = c.FingerPrint
+			}
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers
+}
+
 func (cl *Cluster) Start() {
 	if len(cl.config.Peers) > 0 {
 		cl.router.ConnectionMaker.InitiateConnections(cl.config.Peers, true)
@@ -88,25 +178,37 @@ func (cl *Cluster) Start() {
 	cl.router.Start()
 }
 
+// Stop : stop dialling and stop the router, the vendored
+// router has no way to drop the connections it holds
 func (cl *Cluster) Stop() {
 	cl.logger.Critical("mesh router stopping")
+	cm := cl.router.ConnectionMaker
+	cm.ForgetConnections(cm.Targets(false))
 	cl.router.Stop()
 }
 
 func (cl *Cluster) Peers() {
 	cl.GetNames()
 	for i, j := range cl.router.Peers.Descriptions() {
-		cl.logger.Infof(" %v , %v [%v] ", i, j.NickName, j.Name)
+		fp := "unverified"
+		if c, ok := cl.Identity(j.Name); ok {
+			fp = c.FingerPrint
+		}
+		cl.logger.Infof(" %v , %v [%v] %s", i, j.NickName, j.Name, fp)
 		//cl.logger.Infof("NAMES %v", cl.names)
 	}
 }
 
-func (cl *Cluster) Info(interval int) {
-	c := time.Tick(time.Duration(interval) * time.Second)
+// Info : log the peers every interval seconds until ctx is done
+func (cl *Cluster) Info(ctx context.Context, interval int) {
+	c := time.NewTicker(time.Duration(interval) * time.Second)
+	defer c.Stop()
 	for {
 		select {
-		case <-c:
+		case <-c.C:
 			cl.Peers()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -118,15 +220,3 @@ func mustHostname() string {
 	}
 	return hostname
 }
-
-func genMac() (s string) {
-	buf := make([]byte, 6)
-	_, err := rand.Read(buf)
-	if err != nil {
-		fmt.Println("error:", err)
-		return ""
-	}
-	buf[0] |= 2
-	s = fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5])
-	return s
-}
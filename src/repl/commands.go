@@ -0,0 +1,540 @@
+package main
+
+// commands that ask a running daemon, or work offline
+// on the config and key store
+import (
+	"flag"
+	"fmt"
+	"keys"
+	"mfs"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// nodeFlags are the flags every node command takes
+type nodeFlags struct {
+	config *string
+	keys   *string
+	json   *bool
+}
+
+func addNodeFlags(flags *flag.FlagSet) *nodeFlags {
+	return &nodeFlags{
+		config: flags.String("config", defaultConfig, "config file path"),
+		keys:   flags.String("keys", defaultKeys, "key store path"),
+		json:   flags.Bool("json", false, "machine readable output"),
+	}
+}
+
+// readConfig : the config or a message and exit code
+func (nf *nodeFlags) readConfig() (c *Config, code int) {
+	c, err := ReadConfig(*nf.config)
+	if err != nil {
+		printConfigError(*nf.config, err)
+		return nil, exitError
+	}
+	return c, exitOK
+}
+
+// printConfigError : a line for each problem with the config at path
+func printConfigError(path string, err error) {
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return
+	}
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, e)
+	}
+}
+
+func initCommand(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	nf := addNodeFlags(flags)
+	var (
+		password   = flags.String("password", "", "password for mesh")
+		peer       = flags.String("peer", "", "peer address")
+		nickname   = flags.String("nickname", "", "Nickname for the node")
+		passphrase = addPassFlags(flags)
+	)
+	flags.Parse(args)
+	if _, err := os.Stat(*nf.config); err == nil {
+		fmt.Fprintf(os.Stderr, "init: %s exists, not overwriting it\n", *nf.config)
+		return exitError
+	}
+	pass, err := passphrase.Passphrase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	ks, err := keys.NewKeyStore(*nf.keys, pass)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init: %v\n", err)
+		return exitError
+	}
+	local, err := ks.LocalKey()
+	ks.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init: %v\n", err)
+		return exitError
+	}
+	c := NewConfig(*peer, *password, *nickname)
+	c.Save(*nf.config)
+	if *nf.json {
+		return printJSON(map[string]string{
+			"Config":      *nf.config,
+			"Keys":        *nf.keys,
+			"FingerPrint": local.FingerPrint(),
+		})
+	}
+	fmt.Printf("wrote %s\n", *nf.config)
+	fmt.Printf("key store %s, local key %s\n", *nf.keys, local.FingerPrint())
+	return exitOK
+}
+
+// statusInfo is what status shows
+type statusInfo struct {
+	Daemon      bool // false when the status was read offline
+	Config      string
+	Nickname    string
+	Listen      string
+	Channel     string
+	PeerName    string
+	FingerPrint string
+	Peers       []string
+	Shares      []string
+}
+
+func statusCommand(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	nf := addNodeFlags(flags)
+	flags.Parse(args)
+	c, code := nf.readConfig()
+	if c == nil {
+		return code
+	}
+	ds := &daemonStatus{}
+	if !fromDaemon("status", c, "status", ds) {
+		ds.statusInfo = offlineStatus(c, *nf.keys)
+	}
+	ds.Config = *nf.config
+	if *nf.json {
+		if !ds.Daemon {
+			return printJSON(&ds.statusInfo)
+		}
+		return printJSON(ds)
+	}
+	st := &ds.statusInfo
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "daemon\t%s\n", map[bool]string{true: "running", false: "not contacted, offline view"}[st.Daemon])
+	fmt.Fprintf(w, "config\t%s\n", st.Config)
+	fmt.Fprintf(w, "nickname\t%s\n", st.Nickname)
+	fmt.Fprintf(w, "peer name\t%s\n", st.PeerName)
+	fmt.Fprintf(w, "key\t%s\n", st.FingerPrint)
+	fmt.Fprintf(w, "listen\t%s\n", st.Listen)
+	fmt.Fprintf(w, "channel\t%s\n", st.Channel)
+	fmt.Fprintf(w, "peers\t%d configured\n", len(st.Peers))
+	if ds.Mesh != nil {
+		fmt.Fprintf(w, "mesh\t%d peers, %d connections\n", len(ds.Mesh.Peers)-1, len(ds.Mesh.Connections))
+		fmt.Fprintf(w, "key lookups\t%d open\n", ds.KeyLookups)
+	}
+	fmt.Fprintf(w, "shares\t%d\n", len(st.Shares))
+	w.Flush()
+	return exitOK
+}
+
+// offlineStatus : what the config and key store say
+func offlineStatus(c *Config, keyPath string) statusInfo {
+	st := statusInfo{
+		Nickname: c.Nickname,
+		Listen:   c.Listen,
+		Channel:  c.Channel,
+		Peers:    c.Peers,
+		PeerName: c.PeerID,
+	}
+	for name := range c.Shares {
+		st.Shares = append(st.Shares, name)
+	}
+	sort.Strings(st.Shares)
+	fp, err := keys.LocalFingerPrint(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status: key store %s %v\n", keyPath, err)
+		return st
+	}
+	st.FingerPrint = fp
+	if st.PeerName == "" {
+		if name, err := keys.PeerNameFromFingerPrint(fp); err == nil {
+			st.PeerName = name.String()
+		}
+	}
+	return st
+}
+
+// peerInfo is a mesh peer as peers shows it
+type peerInfo struct {
+	Name        string `json:",omitempty"`
+	NickName    string `json:",omitempty"`
+	Address     string `json:",omitempty"`
+	FingerPrint string `json:",omitempty"`
+	Connected   bool
+}
+
+func peersCommand(args []string) int {
+	flags := flag.NewFlagSet("peers", flag.ExitOnError)
+	nf := addNodeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: repl peers [flags] [list | known | add <address>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	c, code := nf.readConfig()
+	if c == nil {
+		return code
+	}
+	switch flags.Arg(0) {
+	case "", "list":
+	case "add":
+		if flags.NArg() != 2 {
+			flags.Usage()
+			return exitUsage
+		}
+		cl, code := askDaemon("peers add", c)
+		if cl == nil {
+			return code
+		}
+		if err := cl.post("peers", &addPeer{Address: flags.Arg(1)}, nil); err != nil {
+			return daemonError("peers add", err)
+		}
+		fmt.Printf("connecting to %s\n", flags.Arg(1))
+		return exitOK
+	case "known":
+		return peersKnown(c, *nf.json)
+	default:
+		flags.Usage()
+		return exitUsage
+	}
+	var peers []peerInfo
+	daemon := fromDaemon("peers", c, "peers", &peers)
+	if !daemon {
+		// offline only the seed addresses are known
+		for _, addr := range c.Peers {
+			peers = append(peers, peerInfo{Address: addr})
+		}
+	}
+	if *nf.json {
+		return printJSON(peers)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !daemon {
+		fmt.Fprintln(w, "ADDRESS\tSTATE")
+		for _, p := range peers {
+			fmt.Fprintf(w, "%s\t%s\n", p.Address, "configured")
+		}
+		w.Flush()
+		return exitOK
+	}
+	fmt.Fprintln(w, "NAME\tNICKNAME\tADDRESS\tKEY\tSTATE")
+	for _, p := range peers {
+		state := "known"
+		if p.Connected {
+			state = "connected"
+		}
+		fp := p.FingerPrint
+		if fp == "" {
+			fp = "unverified"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.NickName, p.Address, fp, state)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// peersKnown : the addresses the daemon has learned and dials
+func peersKnown(c *Config, asJSON bool) int {
+	cl, code := askDaemon("peers known", c)
+	if cl == nil {
+		return code
+	}
+	var known []knownPeer
+	if err := cl.get("peers/known", &known); err != nil {
+		return daemonError("peers known", err)
+	}
+	if asJSON {
+		return printJSON(known)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tSOURCE\tNICKNAME\tCONNECTED\tFAILURES")
+	for _, p := range known {
+		nick := p.NickName
+		if nick == "" {
+			nick = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", p.Address, p.Source, nick, showTime(p.Connected), p.Failures)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// shareInfo is a share as shares shows it,
+// the daemon adds what it has seen
+type shareInfo struct {
+	Name    string
+	Path    string
+	Source  string     `json:",omitempty"`
+	Hash    string     `json:",omitempty"`
+	Changed *time.Time `json:",omitempty"`
+	Checked *time.Time `json:",omitempty"`
+}
+
+func sharesCommand(args []string) int {
+	flags := flag.NewFlagSet("shares", flag.ExitOnError)
+	nf := addNodeFlags(flags)
+	failed := flags.Bool("failed", false, "updates: only the failed ones")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: repl shares [flags] [list | rescan | updates | apply <share> <fingerprint> <hash>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	c, code := nf.readConfig()
+	if c == nil {
+		return code
+	}
+	switch flags.Arg(0) {
+	case "", "list":
+	case "rescan":
+		return sharesRescan(c, *nf.json)
+	case "updates":
+		return sharesUpdates(c, *failed, *nf.json)
+	case "apply":
+		if flags.NArg() != 4 {
+			flags.Usage()
+			return exitUsage
+		}
+		return sharesApply(c, flags.Args()[1:], *nf.json)
+	default:
+		flags.Usage()
+		return exitUsage
+	}
+	var shares []shareInfo
+	if !fromDaemon("shares", c, "shares", &shares) {
+		shares = nil
+		for name, s := range c.Shares {
+			shares = append(shares, shareInfo{Name: name, Path: s.Path, Source: s.Source})
+		}
+		sort.Slice(shares, func(i, j int) bool { return shares[i].Name < shares[j].Name })
+	}
+	if *nf.json {
+		return printJSON(shares)
+	}
+	printShares(shares)
+	return exitOK
+}
+
+func printShares(shares []shareInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPATH\tHASH\tCHANGED")
+	for _, s := range shares {
+		changed := "-"
+		if s.Changed != nil {
+			changed = showTime(*s.Changed)
+		}
+		hash := s.Hash
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Path, hash, changed)
+	}
+	w.Flush()
+}
+
+func sharesRescan(c *Config, asJSON bool) int {
+	cl, code := askDaemon("shares rescan", c)
+	if cl == nil {
+		return code
+	}
+	var shares []shareInfo
+	if err := cl.post("shares/rescan", nil, &shares); err != nil {
+		return daemonError("shares rescan", err)
+	}
+	if asJSON {
+		return printJSON(shares)
+	}
+	printShares(shares)
+	return exitOK
+}
+
+func sharesUpdates(c *Config, failed, asJSON bool) int {
+	cl, code := askDaemon("shares updates", c)
+	if cl == nil {
+		return code
+	}
+	path := "updates"
+	if failed {
+		path += "?outcome=" + mfs.OutcomeFailed
+	}
+	var view updatesView
+	if err := cl.get(path, &view); err != nil {
+		return daemonError("shares updates", err)
+	}
+	if asJSON {
+		return printJSON(&view)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STAMP\tSHARE\tPUBLISHER\tHASH\tOUTCOME")
+	for _, ev := range append(view.Recent, view.Pending...) {
+		outcome := ev.Outcome
+		if ev.Error != "" {
+			outcome += ": " + ev.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", showTime(ev.Stamp), ev.Path, ev.FingerPrint, ev.NewHash, outcome)
+	}
+	w.Flush()
+	fmt.Printf("%d queued\n", view.Queued)
+	return exitOK
+}
+
+func sharesApply(c *Config, args []string, asJSON bool) int {
+	cl, code := askDaemon("shares apply", c)
+	if cl == nil {
+		return code
+	}
+	req := &applyUpdate{Path: args[0], FingerPrint: args[1], NewHash: args[2]}
+	var u mfs.Update
+	if err := cl.post("updates", req, &u); err != nil {
+		return daemonError("shares apply", err)
+	}
+	if asJSON {
+		return printJSON(&u)
+	}
+	fmt.Printf("applied %s from %s\n", u.NewHash, u.FingerPrint)
+	return exitOK
+}
+
+func configCommand(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	nf := addNodeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: repl config [flags] [show | check | reload]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	switch flags.Arg(0) {
+	case "", "show", "reload":
+	case "check":
+		return configCheck(*nf.config, *nf.json)
+	default:
+		flags.Usage()
+		return exitUsage
+	}
+	c, code := nf.readConfig()
+	if c == nil {
+		return code
+	}
+	if flags.Arg(0) == "reload" {
+		return configReload(c, *nf.json)
+	}
+	// the mesh password is not for the terminal
+	if c.Password != "" {
+		c.Password = "********"
+	}
+	if *nf.json {
+		return printJSON(c)
+	}
+	c.Print()
+	return exitOK
+}
+
+// checkResult is what config check found
+type checkResult struct {
+	Path     string
+	Version  int      // layout of the file
+	Migrate  bool     // the daemon will migrate it to the current layout
+	Problems []string `json:",omitempty"`
+}
+
+// configCheck : parse and validate the config without starting anything
+func configCheck(path string, asJSON bool) int {
+	res := &checkResult{Path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = ErrNoConfig
+	}
+	if err == nil {
+		_, res.Version, _, err = decodeConfig(data, envOverrides(startEnv))
+		res.Migrate = err == nil && res.Version < configVersion
+	}
+	if errs, ok := err.(ConfigErrors); ok {
+		for _, e := range errs {
+			res.Problems = append(res.Problems, e.Error())
+		}
+	} else if err != nil {
+		res.Problems = append(res.Problems, err.Error())
+	}
+	if asJSON {
+		printJSON(res)
+	} else {
+		if err != nil {
+			printConfigError(path, err)
+		}
+		if len(res.Problems) == 0 {
+			fmt.Printf("%s: ok, version %d\n", path, res.Version)
+		}
+		if res.Migrate {
+			fmt.Printf("%s: the daemon migrates it to version %d, keeping the original as %s.v%d\n", path, configVersion, path, res.Version)
+		}
+	}
+	if len(res.Problems) > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// configReload : have the daemon apply the config file again
+func configReload(c *Config, asJSON bool) int {
+	cl, code := askDaemon("config reload", c)
+	if cl == nil {
+		return code
+	}
+	var res reloaded
+	if err := cl.post("config/reload", nil, &res); err != nil {
+		return daemonError("config reload", err)
+	}
+	if asJSON {
+		return printJSON(&res)
+	}
+	if len(res.Changes) == 0 {
+		fmt.Println("no changes")
+	}
+	for _, ch := range res.Changes {
+		fmt.Println(ch)
+	}
+	return exitOK
+}
+
+func dashboardCommand(args []string) int {
+	flags := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	nf := addNodeFlags(flags)
+	flags.Parse(args)
+	c, code := nf.readConfig()
+	if c == nil {
+		return code
+	}
+	if c.Dashboard == "" {
+		fmt.Fprintf(os.Stderr, "dashboard: set Dashboard in %s and restart the daemon\n", *nf.config)
+		return exitError
+	}
+	data, err := os.ReadFile(c.controlToken())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dashboard: %v\n", ErrNoDaemon)
+		return exitUnavailable
+	}
+	link := "http://" + c.Dashboard + "/?token=" + strings.TrimSpace(string(data))
+	if *nf.json {
+		return printJSON(map[string]string{"URL": link})
+	}
+	fmt.Println(link)
+	return exitOK
+}
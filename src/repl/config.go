@@ -3,41 +3,73 @@ package main
 // config object
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/op/go-logging"
+	"keys"
 	"mfs"
 	"os"
+	"sort"
+	"strings"
 )
 
 var confLogger = logging.MustGetLogger("config")
 
+// configVersion is the layout this build writes, older ones are migrated
+const configVersion = 1
+
+var (
+	ErrNoConfig    = errors.New("No config file, run repl init")
+	ErrNewerConfig = errors.New("Config is from a newer version of repl")
+)
+
 type Remote struct {
 	Pin       bool
 	Replicate bool
 }
 
 type Config struct {
-	Listen    string
-	Nickname  string
-	Discovery bool
-	Peers     []string
-	Shares    map[string]*mfs.Share
-	PeerID    string
-	Password  string
-	Remotes   map[string]*Remote
-	Channel   string
+	Version      int // layout of the file, see configVersion
+	Listen       string
+	Nickname     string
+	Discovery    bool
+	Peers        []string
+	Shares       map[string]*mfs.Share
+	PeerID       string // empty derives the mesh name from our key, a rotation changes it
+	Password     string
+	PasswordFile string // file holding the mesh password, read at start
+	Remotes      map[string]*Remote
+	Channel      string
+	Admins       []string     // key finger prints that may revoke any key
+	Anchors      []string     // key finger prints trusted without certification
+	MinTrust     string       // unknown, marginal or full, refs from less trusted publishers are refused
+	KeysetCID    string       // seed a keystore holding only our own key from this keyset
+	Admission    *keys.Policy // limits on keys taken from gossip, empty for the defaults
+
+	Control      string // control api, a loopback host:port or unix:path, off to disable
+	ControlToken string // file the control api token is written to
+	Dashboard    string // web dashboard, a loopback host:port, empty for none
+	Metrics      string // host:port serving /metrics to prometheus, empty for none
+
+	PeerStore string   // file the learned peer addresses are kept in, off to disable
+	SeedFile  string   // file of extra seed addresses, one a line
+	SeedDNS   []string // names whose SRV (starting with _) or TXT records list seeds
 }
 
 func NewConfig(peer, password, nickname string) (c *Config) {
 	c = &Config{
+		Version:  configVersion,
 		Peers:    make([]string, 0),
-		PeerID:   genMac(),
 		Remotes:  make(map[string]*Remote),
 		Shares:   make(map[string]*mfs.Share),
 		Listen:   "0.0.0.0:6783",
 		Channel:  "share",
 		Nickname: mustHostname(),
+
+		Control:      defaultControl,
+		ControlToken: defaultControlToken,
+		PeerStore:    defaultPeerStore,
 	}
 	if peer != "" {
 		c.Peers = append(c.Peers, peer)
@@ -53,14 +85,143 @@ func NewConfig(peer, password, nickname string) (c *Config) {
 	return c
 }
 
-func LoadConfig(path, peer, password, nickname string) (c *Config) {
-	if _, err := toml.DecodeFile(path, &c); err != nil {
-		fmt.Println(c, err)
-		c = NewConfig(peer, password, nickname)
-		fmt.Println(c)
-		c.Save(path)
+// ReadConfig : the config at path with the environment over it,
+// never written, an older layout is migrated in memory only
+func ReadConfig(path string) (c *Config, err error) {
+	return readConfigWith(path, envOverrides(startEnv))
+}
+
+func readConfigWith(path string, ov []override) (c *Config, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoConfig
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, _, _, err = decodeConfig(data, ov)
+	return c, err
+}
+
+// LoadConfig : the config for the daemon with ov over it, a missing
+// file is written with the defaults and an older layout is migrated
+// and saved with the original kept as path.v<version>. A file that
+// does not parse or validate is an error and is left alone.
+func LoadConfig(path string, ov []override) (c *Config, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		confLogger.Infof("No config, writing the defaults to %s", path)
+		if err := NewConfig("", "", "").Save(path); err != nil {
+			return nil, err
+		}
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, from, migrated, err := decodeConfig(data, ov)
+	if err != nil {
+		return nil, err
+	}
+	if migrated != nil {
+		backup := fmt.Sprintf("%s.v%d", path, from)
+		if err := os.WriteFile(backup, data, 0600); err != nil {
+			return nil, err
+		}
+		if err := writeConfig(path, migrated); err != nil {
+			return nil, err
+		}
+		confLogger.Infof("Config migrated from version %d to %d, the old file is %s", from, configVersion, backup)
+	}
+	return c, nil
+}
+
+// decodeConfig : parse and migrate the file, put the overrides and
+// secrets over it and validate. from is the version the file was
+// written as, migrated the file in the current layout when it is older.
+func decodeConfig(data []byte, ov []override) (c *Config, from int, migrated []byte, err error) {
+	// errors are placed by the lines of the file as written
+	orig := data
+	var raw map[string]interface{}
+	if _, err := toml.Decode(string(data), &raw); err != nil {
+		return nil, 0, nil, parseError(err)
+	}
+	if v, ok := raw["Version"].(int64); ok {
+		from = int(v)
+	}
+	if from > configVersion {
+		return nil, from, nil, ErrNewerConfig
+	}
+	// a migrated layout is checked as it will be written
+	if from < configVersion {
+		for v := from; v < configVersion; v++ {
+			migrations[v](raw)
+		}
+		raw["Version"] = int64(configVersion)
+		buf := new(bytes.Buffer)
+		if err := toml.NewEncoder(buf).Encode(raw); err != nil {
+			return nil, from, nil, err
+		}
+		data = buf.Bytes()
+		migrated = data
+	}
+	md, err := toml.Decode(string(data), &c)
+	if err != nil {
+		return nil, from, nil, &ConfigError{Err: err}
+	}
+	var errs ConfigErrors
+	for _, key := range md.Undecoded() {
+		errs = append(errs, &ConfigError{Key: key.String(), Err: ErrUnknownKey})
+	}
+	sources, oerrs := c.apply(ov)
+	errs = append(errs, oerrs...)
+	if err := c.readSecrets(); err != nil {
+		errs = append(errs, &ConfigError{Key: "PasswordFile", Err: err})
+	}
+	errs = append(errs, c.check()...)
+	if len(errs) > 0 {
+		// a value from an override is reported by where it came from
+		for _, e := range errs {
+			if src, ok := sources[strings.SplitN(e.Key, ".", 2)[0]]; ok {
+				e.Key = src
+				continue
+			}
+			e.Line = keyLine(orig, e.Key)
+		}
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+		return nil, from, nil, errs
+	}
+	return c, from, migrated, nil
+}
+
+// migrations[v] moves a version v layout to version v+1
+var migrations = []func(raw map[string]interface{}){
+	// 0 is everything before the version key, the settings
+	// added since are written out with their defaults
+	func(raw map[string]interface{}) {
+		defaults := map[string]string{
+			"Listen":       "0.0.0.0:6783",
+			"Channel":      "share",
+			"Control":      defaultControl,
+			"ControlToken": defaultControlToken,
+		}
+		for key, value := range defaults {
+			if s, ok := raw[key].(string); !ok || s == "" {
+				raw[key] = value
+			}
+		}
+	},
+}
+
+// peerStore : the peer book path, empty when it is off
+func (c *Config) peerStore() string {
+	switch c.PeerStore {
+	case "":
+		return defaultPeerStore
+	case controlOff:
+		return ""
 	}
-	return
+	return c.PeerStore
 }
 
 func (c *Config) Print() {
@@ -72,16 +233,24 @@ func (c *Config) Print() {
 	fmt.Println(buf.String())
 }
 
-func (c *Config) Save(path string) {
+func (c *Config) Save(path string) (err error) {
 	buf := new(bytes.Buffer)
-	err := toml.NewEncoder(buf).Encode(c)
-	if err != nil {
-		confLogger.Errorf("%v", err)
+	if err := toml.NewEncoder(buf).Encode(c); err != nil {
+		return err
 	}
-	f, err := os.Create(path)
-	defer f.Close()
-	if err != nil {
-		confLogger.Errorf("%v", err)
+	return writeConfig(path, buf.Bytes())
+}
+
+// writeConfig : write through a temporary file so a failed
+// write never leaves a truncated config behind
+func writeConfig(path string, data []byte) (err error) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-	f.Write(buf.Bytes())
+	return nil
 }
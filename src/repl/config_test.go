@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testConfig = `Version = 1
+Listen = "0.0.0.0:6783"
+Nickname = "bob"
+Channel = "share"
+`
+
+func TestDecodeConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		key  string // of the first error, empty for none
+		line int
+	}{
+		{"valid", testConfig, "", 0},
+		{"unknown key", testConfig + "Colour = \"red\"\n", "Colour", 5},
+		{"unknown nested key", testConfig + "[Admission]\n  Speed = 1\n", "Admission.Speed", 6},
+		{"bad peer", testConfig + "Peers = [\":6783\"]\n", "Peers", 5},
+		{"bad channel", strings.Replace(testConfig, `"share"`, `"keybase"`, 1), "Channel", 4},
+		{"parse error", testConfig + "Peers = [\n", "", -1},
+		{"newer", "Version = 99\n", "", -1},
+	} {
+		c, _, _, err := decodeConfig([]byte(tc.data), nil)
+		switch {
+		case tc.line < 0:
+			if err == nil {
+				t.Errorf("%s: decoded", tc.name)
+			}
+			continue
+		case tc.key == "":
+			if err != nil || c == nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		errs, ok := err.(ConfigErrors)
+		if !ok || len(errs) == 0 {
+			t.Errorf("%s: got %v", tc.name, err)
+			continue
+		}
+		if errs[0].Key != tc.key || errs[0].Line != tc.line {
+			t.Errorf("%s: got %q line %d, want %q line %d", tc.name, errs[0].Key, errs[0].Line, tc.key, tc.line)
+		}
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	// a file from before the version key
+	old := "Nickname = \"bob\"\nPeers = [\"10.0.0.2\"]\n"
+	c, from, migrated, err := decodeConfig([]byte(old), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 || migrated == nil {
+		t.Fatalf("from %d migrated %q", from, migrated)
+	}
+	if c.Version != configVersion || c.Listen != "0.0.0.0:6783" || c.Channel != "share" || c.Control != defaultControl {
+		t.Errorf("migrated config %+v", c)
+	}
+	// the written layout decodes as it is
+	if _, from, again, err := decodeConfig(migrated, nil); err != nil || from != configVersion || again != nil {
+		t.Errorf("migrated file from %d again %v %v", from, again != nil, err)
+	}
+	// errors point at the lines of the file as it was written
+	_, _, _, err = decodeConfig([]byte("Nickname = \"bob\"\n\n\nPeers = [\":6783\"]\n"), nil)
+	if errs, ok := err.(ConfigErrors); !ok || errs[0].Key != "Peers" || errs[0].Line != 4 {
+		t.Errorf("migrated error %v", err)
+	}
+}
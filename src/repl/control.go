@@ -0,0 +1,478 @@
+package main
+
+// the local control api, json over http on a unix socket or a
+// loopback port, every request carries the token the daemon writes
+// to a file only its user can read
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+	"keys"
+	"mfs"
+	"refshare"
+)
+
+const (
+	defaultControl      = "127.0.0.1:6790"
+	defaultControlToken = "control.token"
+	controlOff          = "off"
+	unixPrefix          = "unix:"
+	maxControlBody      = 64 << 10
+)
+
+var (
+	ErrControlOff    = errors.New("Control api is off")
+	ErrNotLoopback   = errors.New("Only loopback addresses are served")
+	ErrNoRefs        = errors.New("Refs are not shared, run the daemon with -refs")
+	ErrUnauthorized  = errors.New("Bad or missing control token")
+	ErrMissingFields = errors.New("Missing fields in request")
+	ErrNoPeerBook    = errors.New("Peer book is off, set PeerStore")
+)
+
+// controlAddr : the network and address of the control api
+func (c *Config) controlAddr() (network, addr string, err error) {
+	addr = c.Control
+	if addr == "" {
+		addr = defaultControl
+	}
+	if addr == controlOff {
+		return "", "", ErrControlOff
+	}
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix), nil
+	}
+	if err := loopback(addr); err != nil {
+		return "", "", err
+	}
+	return "tcp", addr, nil
+}
+
+// loopback : is addr a host:port only this machine can reach
+func loopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return ErrNotLoopback
+	}
+	return nil
+}
+
+// controlToken : the path of the token file
+func (c *Config) controlToken() string {
+	if c.ControlToken == "" {
+		return defaultControlToken
+	}
+	return c.ControlToken
+}
+
+// keySource is the part of the key peer the api shows
+type keySource interface {
+	Store() *keys.KeyStore
+	Wanting() int
+	Rejected() map[mesh.PeerName]uint64
+}
+
+// control serves the api for one daemon, refPeer and
+// share are nil when refs are not shared
+type control struct {
+	confLock sync.RWMutex
+	config   *Config // swapped on reload
+	reload   func() ([]string, error)
+	cluster  *Cluster
+	keyPeer  keySource
+	refPeer  *refshare.Peer
+	share    *mfs.Share
+	book     *peerBook // nil when PeerStore is off
+	local    string    // finger print of our key
+	token    string
+	listener net.Listener
+	server   *http.Server
+}
+
+// conf : the running config
+func (ctl *control) conf() *Config {
+	ctl.confLock.RLock()
+	defer ctl.confLock.RUnlock()
+	return ctl.config
+}
+
+func (ctl *control) setConfig(c *Config) {
+	ctl.confLock.Lock()
+	ctl.config = c
+	ctl.confLock.Unlock()
+}
+
+// startControl : write a new token and serve the api,
+// the token file is removed by close
+func startControl(ctl *control) (err error) {
+	network, addr, err := ctl.config.controlAddr()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	ctl.token = hex.EncodeToString(buf)
+	path := ctl.config.controlToken()
+	if err := os.WriteFile(path, []byte(ctl.token+"\n"), 0600); err != nil {
+		return err
+	}
+	// an existing file keeps its mode on write
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	if network == "unix" {
+		// a socket left by a daemon that did not stop cleanly
+		if _, err := net.Dial("unix", addr); err != nil {
+			os.Remove(addr)
+		}
+	}
+	ctl.listener, err = net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0600); err != nil {
+			ctl.listener.Close()
+			return err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", ctl.method("GET", ctl.status))
+	mux.HandleFunc("/v1/peers", ctl.peers)
+	mux.HandleFunc("/v1/peers/known", ctl.method("GET", ctl.knownPeers))
+	mux.HandleFunc("/v1/shares", ctl.method("GET", ctl.shares))
+	mux.HandleFunc("/v1/shares/rescan", ctl.method("POST", ctl.rescan))
+	mux.HandleFunc("/v1/refs", ctl.method("GET", ctl.refs))
+	mux.HandleFunc("/v1/updates", ctl.updates)
+	mux.HandleFunc("/v1/keys", ctl.method("GET", ctl.keys))
+	mux.HandleFunc("/v1/config/reload", ctl.method("POST", ctl.reloadConfig))
+	ctl.server = &http.Server{
+		Handler:           ctl.auth(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Infof("Control api on %s %s", network, addr)
+	go func() {
+		if err := ctl.server.Serve(ctl.listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("Control api %v", err)
+		}
+	}()
+	return nil
+}
+
+// close stops the api and removes the token
+func (ctl *control) close() {
+	if ctl.server != nil {
+		ctl.server.Close()
+	}
+	os.Remove(ctl.config.controlToken())
+}
+
+func (ctl *control) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ctl.validToken(given) {
+			replyError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ctl *control) validToken(given string) bool {
+	return ctl.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(ctl.token)) == 1
+}
+
+// method : only let the one http method through
+func (ctl *control) method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			replyError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Errorf("Control reply %v", err)
+	}
+}
+
+// apiError is the body of every failed request
+type apiError struct {
+	Error string
+}
+
+func replyError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&apiError{Error: err.Error()})
+}
+
+func readBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxControlBody)).Decode(v)
+}
+
+// daemonStatus is status with the mesh as the router sees it
+type daemonStatus struct {
+	statusInfo
+	Mesh       *mesh.Status
+	KeyLookups int               // open asks for keys
+	KeyRejects map[string]uint64 // refused key gossip by source peer
+}
+
+func (ctl *control) status(w http.ResponseWriter, r *http.Request) {
+	c := ctl.conf()
+	st := &daemonStatus{
+		statusInfo: statusInfo{
+			Daemon:      true,
+			Nickname:    c.Nickname,
+			Listen:      c.Listen,
+			Channel:     c.Channel,
+			Peers:       c.Peers,
+			PeerName:    ctl.cluster.Name.String(),
+			FingerPrint: ctl.local,
+		},
+		Mesh:       ctl.cluster.Status(),
+		KeyLookups: ctl.keyPeer.Wanting(),
+		KeyRejects: rejectedView(ctl.keyPeer.Rejected()),
+	}
+	for name := range c.Shares {
+		st.Shares = append(st.Shares, name)
+	}
+	sort.Strings(st.Shares)
+	reply(w, st)
+}
+
+// addPeer is the body of a peer to connect to
+type addPeer struct {
+	Address string
+}
+
+func (ctl *control) peers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		reply(w, ctl.cluster.PeerInfo())
+	case "POST":
+		var req addPeer
+		if err := readBody(w, r, &req); err != nil {
+			replyError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Address == "" {
+			replyError(w, http.StatusBadRequest, ErrMissingFields)
+			return
+		}
+		if err := ctl.cluster.Connect(req.Address); err != nil {
+			replyError(w, http.StatusBadRequest, err)
+			return
+		}
+		logger.Infof("Control api added peer %s", req.Address)
+		reply(w, &req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		replyError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+func (ctl *control) knownPeers(w http.ResponseWriter, r *http.Request) {
+	if ctl.book == nil {
+		replyError(w, http.StatusNotFound, ErrNoPeerBook)
+		return
+	}
+	reply(w, ctl.book.Known())
+}
+
+// shareList : the configured shares with what the daemon has seen
+func (ctl *control) shareList() (shares []shareInfo) {
+	local := make(map[string]mfs.ShareStatus)
+	if ctl.share != nil {
+		for _, s := range ctl.share.Status() {
+			local[s.Name] = s
+		}
+	}
+	for name, s := range ctl.conf().Shares {
+		info := shareInfo{Name: name, Path: s.Path, Source: s.Source}
+		if st, ok := local[name]; ok {
+			info.Hash = st.Hash
+			if !st.Changed.IsZero() {
+				info.Changed = &st.Changed
+			}
+			if !st.Checked.IsZero() {
+				info.Checked = &st.Checked
+			}
+		}
+		shares = append(shares, info)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Name < shares[j].Name })
+	return shares
+}
+
+func (ctl *control) shares(w http.ResponseWriter, r *http.Request) {
+	reply(w, ctl.shareList())
+}
+
+func (ctl *control) rescan(w http.ResponseWriter, r *http.Request) {
+	if ctl.share == nil {
+		replyError(w, http.StatusNotFound, ErrNoRefs)
+		return
+	}
+	logger.Info("Control api rescan")
+	ctl.share.CheckChanges()
+	reply(w, ctl.shareList())
+}
+
+// reloaded is what a config reload changed
+type reloaded struct {
+	Changes []string
+}
+
+func (ctl *control) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	logger.Info("Control api config reload")
+	changes, err := ctl.reload()
+	if err != nil {
+		logger.Errorf("Config reload %v", err)
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, &reloaded{Changes: changes})
+}
+
+// refsView is the refshare state
+type refsView struct {
+	Publishers []refshare.Published
+	Held       []string // publishers waiting on their key
+	Queued     int      // updates waiting to be applied
+	Rejected   map[string]uint64
+}
+
+func (ctl *control) refs(w http.ResponseWriter, r *http.Request) {
+	if ctl.refPeer == nil {
+		replyError(w, http.StatusNotFound, ErrNoRefs)
+		return
+	}
+	reply(w, &refsView{
+		Publishers: ctl.refPeer.State(),
+		Held:       ctl.refPeer.Held(),
+		Queued:     ctl.refPeer.Queued(),
+		Rejected:   rejectedView(ctl.refPeer.Rejected()),
+	})
+}
+
+func rejectedView(r map[mesh.PeerName]uint64) map[string]uint64 {
+	view := make(map[string]uint64, len(r))
+	for name, n := range r {
+		view[name.String()] = n
+	}
+	return view
+}
+
+// updatesView is what became of the updates from other nodes,
+// ?outcome= filters the recent ones
+type updatesView struct {
+	Queued  int
+	Pending []mfs.UpdateEvent
+	Recent  []mfs.UpdateEvent
+}
+
+// applyUpdate is the body of a forced update,
+// the share folder of FingerPrint is set to NewHash
+type applyUpdate struct {
+	Path        string
+	FingerPrint string
+	NewHash     string
+}
+
+func (ctl *control) updates(w http.ResponseWriter, r *http.Request) {
+	if ctl.refPeer == nil || ctl.share == nil {
+		replyError(w, http.StatusNotFound, ErrNoRefs)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		pending, recent := ctl.share.Events()
+		if outcome := r.URL.Query().Get("outcome"); outcome != "" {
+			var keep []mfs.UpdateEvent
+			for _, ev := range recent {
+				if ev.Outcome == outcome {
+					keep = append(keep, ev)
+				}
+			}
+			recent = keep
+		}
+		reply(w, &updatesView{
+			Queued:  ctl.refPeer.Queued(),
+			Pending: pending,
+			Recent:  recent,
+		})
+	case "POST":
+		var req applyUpdate
+		if err := readBody(w, r, &req); err != nil {
+			replyError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Path == "" || req.FingerPrint == "" || req.NewHash == "" {
+			replyError(w, http.StatusBadRequest, ErrMissingFields)
+			return
+		}
+		u := mfs.Update{
+			Path:        req.Path,
+			FingerPrint: req.FingerPrint,
+			NewHash:     req.NewHash,
+			Stamp:       time.Now(),
+		}
+		// keep the folder alias of a publisher we know
+		for _, pub := range ctl.refPeer.State() {
+			if pub.FingerPrint == u.FingerPrint {
+				u.PeerName = pub.Nickname
+				u.OldHash = pub.Refs[u.Path]
+			}
+		}
+		logger.Warningf("Control api forced update %s %s -> %s", u.Path, u.FingerPrint, u.NewHash)
+		if err := ctl.share.SubmitUpdate(u); err != nil {
+			replyError(w, http.StatusBadGateway, err)
+			return
+		}
+		reply(w, &u)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		replyError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+func (ctl *control) keys(w http.ResponseWriter, r *http.Request) {
+	infos, err := ctl.keyPeer.Store().List()
+	if err != nil {
+		replyError(w, http.StatusInternalServerError, err)
+		return
+	}
+	views := make([]keyView, 0, len(infos))
+	for _, i := range infos {
+		views = append(views, newKeyView(i))
+	}
+	reply(w, views)
+}
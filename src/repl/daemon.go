@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/op/go-logging"
+	"os"
+	"time"
+
+	"keys"
+	"mfs"
+	"refshare"
+)
+
+// daemonCommand : join the mesh and replicate the shares
+func daemonCommand(args []string) int {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	var (
+		configPath = flags.String("config", defaultConfig, "config file path")
+		keyPath    = flags.String("keys", defaultKeys, "key store path")
+		password   = flags.String("password", "", "password for mesh (visible to ps, prefer PasswordFile or MFSREPL_PASSWORD)")
+		peer       = flags.String("peer", "", "peer address")
+		nickname   = flags.String("nickname", "", "Nickname for the node")
+		level      = flags.Int("log", 2, "Logging Level")
+		refs       = flags.Bool("refs", false, "share refs, not only keys")
+		passphrase = addPassFlags(flags)
+	)
+	flags.Parse(args)
+	pass, err := passphrase.Passphrase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	// flags beat the environment which beats the file
+	ov := envOverrides(startEnv)
+	for _, f := range []override{
+		{key: "Peers", source: "-peer", value: *peer},
+		{key: "Password", source: "-password", value: *password},
+		{key: "Nickname", source: "-nickname", value: *nickname},
+	} {
+		if f.value != "" {
+			ov = append(ov, f)
+		}
+	}
+	config, err := LoadConfig(*configPath, ov)
+	if err != nil {
+		printConfigError(*configPath, err)
+		return exitError
+	}
+	LogSetup(*level, "mfsrepl")
+	logging.SetLevel(logging.DEBUG, "mfs")
+
+	logger := GetLogger("cluster")
+	logger.Critical("MFS replicator")
+	lc := newLifecycle()
+	// fail : stop what has started and give up
+	fail := func(format string, args ...interface{}) int {
+		logger.Criticalf(format, args...)
+		lc.shutdown(drainTimeout)
+		return exitError
+	}
+	keyPeer := keys.NewPeer(*keyPath, pass, logger)
+	lc.onStop("key store", func() error {
+		keyPeer.Store().Close()
+		return nil
+	})
+	keyPeer.Store().SetAdmins(config.Admins)
+	keyPeer.Store().SetAnchors(config.Anchors)
+	if config.Admission != nil {
+		keyPeer.SetPolicy(*config.Admission)
+	}
+	minTrust, err := keys.ParseTrust(config.MinTrust)
+	if err != nil {
+		return fail("MinTrust %q %v", config.MinTrust, err)
+	}
+	local, err := keyPeer.Store().LocalKey()
+	if err != nil {
+		return fail("Local key %v", err)
+	}
+	if !local.Expires.IsZero() && time.Now().Add(expiryWarning).After(local.Expires) {
+		logger.Warningf("Local key expires %s, run repl keys rotate", local.Expires)
+	}
+	if sigK, err := local.MakeSigned(); err == nil {
+		if dk, err := sigK.GetDistKey(); err == nil && dk.Weak() {
+			logger.Warning("Local key is weak legacy rsa, run repl keys rotate")
+		}
+	}
+	if config.KeysetCID != "" {
+		seedKeyset(keyPeer, config.KeysetCID)
+	}
+	cluster := NewCluster(config, local.FingerPrint(), logger)
+
+	// Attach the widgets
+	cluster.Attach(keyPeer, keyChannel)
+	lc.onStop("key gossip", func() error {
+		keyPeer.Stop()
+		return nil
+	})
+	keyPeer.SetNeighbours(cluster.Neighbours)
+	cluster.OnConnect(keyPeer.SyncNeighbours)
+	cluster.SetDirectory(keyPeer.Directory())
+	ipfsID, err := mfs.NodeID()
+	if err != nil {
+		logger.Errorf("ipfs id %v", err)
+	}
+	err = keyPeer.Claim(cluster.Name, config.Nickname, ipfsID)
+	if err != nil {
+		logger.Errorf("Identity claim %v", err)
+	}
+
+	var (
+		refPeer *refshare.Peer
+		ring    *keyring
+	)
+	if *refs {
+		ring, err = NewKeyring(keyPeer.Store(), keyPeer, minTrust)
+		if err != nil {
+			return fail("Local key %v", err)
+		}
+		refPeer = refshare.NewPeer(ring, config.Nickname, logger)
+		cluster.Attach(refPeer, config.Channel)
+		lc.onStop("ref gossip", func() error {
+			refPeer.Stop()
+			return nil
+		})
+	}
+	// Spin up the mesh, it stops before the widgets
+	cluster.Start()
+	lc.onStop("mesh router", func() error {
+		cluster.Stop()
+		return nil
+	})
+
+	// Dial the peers learned before, and the seeds
+	var book *peerBook
+	if path := config.peerStore(); path != "" {
+		if book, err = openPeerBook(path, cluster); err != nil {
+			logger.Errorf("Peer book %v", err)
+		} else {
+			lc.onStop("peer book", book.close)
+			book.setSeeds(config.SeedFile, config.SeedDNS)
+			lc.loop("peer book", book.run)
+		}
+	}
+
+	// Show the current peers
+	cluster.Peers()
+	// Show a list every 30 seconds
+	lc.loop("peer list", func(ctx context.Context) { cluster.Info(ctx, 30) })
+
+	var shares *mfs.Share
+	if *refs {
+		// Create the Shares
+		shares = mfs.NewShare(config.Shares)
+		shares.SetSuccessor(keyPeer.Store().Successor)
+		// updates being applied get what is left of the drain time
+		lc.onStop("shares", func() error {
+			return shares.Close(lc.remaining())
+		})
+		// Watch the shares
+		lc.loop("share watch", func(ctx context.Context) { shares.Watch(ctx, 10) })
+		// Run the primary event loop
+		lc.loop("update loop", func(ctx context.Context) { Process(ctx, cluster, refPeer, shares, 10) })
+	}
+
+	// The local control api
+	ctl := &control{
+		config:  config,
+		cluster: cluster,
+		keyPeer: keyPeer,
+		refPeer: refPeer,
+		share:   shares,
+		book:    book,
+		local:   local.FingerPrint(),
+	}
+	// SIGHUP or the control api reload the config
+	rl := &reloader{
+		path:    *configPath,
+		ov:      ov,
+		running: config,
+		cluster: cluster,
+		store:   keyPeer.Store(),
+		ring:    ring,
+		share:   shares,
+		book:    book,
+		ctl:     ctl,
+	}
+	ctl.reload = rl.reload
+	lc.loop("config reload", rl.hangups)
+	if err := startControl(ctl); err == ErrControlOff {
+		logger.Info("Control api off")
+	} else if err != nil {
+		logger.Errorf("Control api %v", err)
+	} else {
+		lc.onStop("control api", func() error {
+			ctl.close()
+			return nil
+		})
+	}
+	setGauges(cluster, keyPeer, refPeer)
+	if config.Metrics != "" {
+		if server, err := startMetrics(config.Metrics); err != nil {
+			logger.Errorf("Metrics %v", err)
+		} else {
+			lc.onStop("metrics", server.Close)
+		}
+	}
+	if config.Dashboard != "" {
+		if d, err := startDashboard(ctl); err != nil {
+			logger.Errorf("Dashboard %v", err)
+		} else {
+			lc.onStop("dashboard", func() error {
+				d.close()
+				return nil
+			})
+		}
+	}
+	// Run and Wait
+	logger.Criticalf("%s, shutting down", lc.wait())
+	if !lc.shutdown(drainTimeout) {
+		return exitError
+	}
+	logger.Critical("Stopped")
+	return exitOK
+}
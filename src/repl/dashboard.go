@@ -0,0 +1,454 @@
+package main
+
+// an optional web dashboard of the replication state, the page
+// follows a server sent event stream of snapshots
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"mfs"
+)
+
+const (
+	dashboardInterval = 2 * time.Second  // snapshot rate while someone watches
+	dashboardSlow     = 30 * time.Second // keys and backups are read this often
+	dashboardPing     = 30 * time.Second // keeps idle streams open
+	dashboardEvents   = 50               // update events shown
+	dashboardBackups  = 20               // backup folders shown
+	maxWatchers       = 16
+	tokenCookie       = "repl_token"
+)
+
+var (
+	ErrNoControl   = errors.New("Dashboard needs the control api for its token")
+	ErrTooManyWait = errors.New("Too many dashboards open")
+)
+
+// dashboard serves the page and the snapshot stream
+type dashboard struct {
+	ctl    *control
+	server *http.Server
+	quit   chan struct{}
+
+	lock     sync.Mutex
+	watchers map[chan []byte]bool
+	last     []byte
+
+	slowAt  time.Time // keys and backups below were read
+	keys    []keyView
+	backups []mfs.Backup
+}
+
+// dashState is one snapshot of the node
+type dashState struct {
+	Node     statusInfo
+	Topology []meshPeer
+	Peers    []peerInfo
+	Shares   []shareMatrix
+	Pending  []mfs.UpdateEvent
+	Events   []mfs.UpdateEvent // newest first
+	Queued   int
+	Backups  []mfs.Backup
+	Keys     []keyView
+}
+
+// meshPeer is a mesh peer and who it is connected to
+type meshPeer struct {
+	Name        string
+	NickName    string
+	Connections []string
+}
+
+// shareMatrix is who holds which version of a share
+type shareMatrix struct {
+	Name  string
+	Local string // our hash
+	Rows  []shareCell
+}
+
+type shareCell struct {
+	FingerPrint string
+	Nickname    string
+	Hash        string
+	Stamp       time.Time // when the publisher signed it
+	Self        bool
+	Current     bool // same hash as ours
+}
+
+// startDashboard : serve the dashboard on the configured address,
+// the control api must be up as the page uses its token
+func startDashboard(ctl *control) (d *dashboard, err error) {
+	if ctl.token == "" {
+		return nil, ErrNoControl
+	}
+	addr := ctl.config.Dashboard
+	if err := loopback(addr); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d = &dashboard{
+		ctl:      ctl,
+		quit:     make(chan struct{}),
+		watchers: make(map[chan []byte]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.page)
+	mux.HandleFunc("/state", d.state)
+	mux.HandleFunc("/events", d.events)
+	d.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Infof("Dashboard on http://%s/", addr)
+	go func() {
+		if err := d.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("Dashboard %v", err)
+		}
+	}()
+	go d.loop()
+	return d, nil
+}
+
+func (d *dashboard) close() {
+	close(d.quit)
+	d.server.Close()
+}
+
+// allowed : a request with the token in the cookie or the query,
+// the query sets the cookie so the link only has to be opened once
+func (d *dashboard) allowed(w http.ResponseWriter, r *http.Request) bool {
+	if c, err := r.Cookie(tokenCookie); err == nil && d.ctl.validToken(c.Value) {
+		return true
+	}
+	if given := r.URL.Query().Get("token"); d.ctl.validToken(given) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookie,
+			Value:    given,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		return true
+	}
+	http.Error(w, "open the link repl dashboard prints", http.StatusUnauthorized)
+	return false
+}
+
+func (d *dashboard) page(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !d.allowed(w, r) {
+		return
+	}
+	if r.URL.Query().Get("token") != "" {
+		// keep the token out of the address bar
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	fmt.Fprint(w, dashboardPage)
+}
+
+func (d *dashboard) state(w http.ResponseWriter, r *http.Request) {
+	if !d.allowed(w, r) {
+		return
+	}
+	reply(w, d.snapshot())
+}
+
+func (d *dashboard) events(w http.ResponseWriter, r *http.Request) {
+	if !d.allowed(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, err := d.watch()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer d.unwatch(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	data, err := json.Marshal(d.snapshot())
+	if err != nil {
+		logger.Errorf("Dashboard %v", err)
+		return
+	}
+	fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+	flusher.Flush()
+	ping := time.NewTicker(dashboardPing)
+	defer ping.Stop()
+	for {
+		select {
+		case data := <-ch:
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-d.quit:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (d *dashboard) watch() (ch chan []byte, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.watchers) >= maxWatchers {
+		return nil, ErrTooManyWait
+	}
+	ch = make(chan []byte, 1)
+	d.watchers[ch] = true
+	return ch, nil
+}
+
+func (d *dashboard) unwatch(ch chan []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.watchers, ch)
+}
+
+// loop sends a snapshot to the watchers when it changes
+func (d *dashboard) loop() {
+	tick := time.NewTicker(dashboardInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-d.quit:
+			return
+		}
+		d.lock.Lock()
+		n := len(d.watchers)
+		d.lock.Unlock()
+		if n == 0 {
+			continue
+		}
+		data, err := json.Marshal(d.snapshot())
+		if err != nil {
+			logger.Errorf("Dashboard %v", err)
+			continue
+		}
+		d.lock.Lock()
+		if !bytes.Equal(data, d.last) {
+			d.last = data
+			for ch := range d.watchers {
+				// a slow page skips to the newest snapshot
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- data
+			}
+		}
+		d.lock.Unlock()
+	}
+}
+
+// slow : keys and backups, read again when they are old
+func (d *dashboard) slow() (keys []keyView, backups []mfs.Backup) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if time.Since(d.slowAt) < dashboardSlow {
+		return d.keys, d.backups
+	}
+	d.slowAt = time.Now()
+	d.keys = nil
+	if infos, err := d.ctl.keyPeer.Store().List(); err == nil {
+		for _, i := range infos {
+			d.keys = append(d.keys, newKeyView(i))
+		}
+	} else {
+		logger.Errorf("Dashboard keys %v", err)
+	}
+	if d.ctl.share != nil {
+		backups, err := d.ctl.share.Backups(dashboardBackups)
+		if err != nil {
+			logger.Debugf("Dashboard backups %v", err)
+		}
+		d.backups = backups
+	}
+	return d.keys, d.backups
+}
+
+// snapshot : the node as the page shows it
+func (d *dashboard) snapshot() *dashState {
+	ctl := d.ctl
+	st := &dashState{
+		Peers: ctl.cluster.PeerInfo(),
+	}
+	c := ctl.conf()
+	st.Node = statusInfo{
+		Daemon:      true,
+		Nickname:    c.Nickname,
+		Listen:      c.Listen,
+		Channel:     c.Channel,
+		Peers:       c.Peers,
+		PeerName:    ctl.cluster.Name.String(),
+		FingerPrint: ctl.local,
+	}
+	for _, p := range ctl.cluster.Status().Peers {
+		mp := meshPeer{Name: p.Name, NickName: p.NickName}
+		for _, conn := range p.Connections {
+			if conn.Established {
+				mp.Connections = append(mp.Connections, conn.Name)
+			}
+		}
+		sort.Strings(mp.Connections)
+		st.Topology = append(st.Topology, mp)
+	}
+	sort.Slice(st.Topology, func(i, j int) bool { return st.Topology[i].Name < st.Topology[j].Name })
+	st.Keys, st.Backups = d.slow()
+	for _, s := range ctl.shareList() {
+		st.Node.Shares = append(st.Node.Shares, s.Name)
+		st.Shares = append(st.Shares, shareMatrix{Name: s.Name, Local: s.Hash})
+	}
+	if ctl.refPeer == nil || ctl.share == nil {
+		return st
+	}
+	published := ctl.refPeer.State()
+	for i := range st.Shares {
+		m := &st.Shares[i]
+		for _, pub := range published {
+			hash, ok := pub.Refs[m.Name]
+			if !ok {
+				continue
+			}
+			m.Rows = append(m.Rows, shareCell{
+				FingerPrint: pub.FingerPrint,
+				Nickname:    pub.Nickname,
+				Hash:        hash,
+				Stamp:       pub.Stamp,
+				Self:        pub.Self,
+				Current:     hash == m.Local,
+			})
+		}
+	}
+	st.Queued = ctl.refPeer.Queued()
+	pending, recent := ctl.share.Events()
+	st.Pending = pending
+	for i := len(recent) - 1; i >= 0 && len(st.Events) < dashboardEvents; i-- {
+		st.Events = append(st.Events, recent[i])
+	}
+	return st
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mfs replicator</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; font-size: 0.9em; }
+th { background: #eee; }
+.mono { font-family: monospace; }
+.ok { background: #dfd; }
+.old { background: #ffd; }
+.bad { background: #fdd; }
+#live { float: right; font-size: 0.8em; }
+</style>
+</head>
+<body>
+<span id="live">connecting</span>
+<h1 id="title">mfs replicator</h1>
+<div id="node"></div>
+<h2>Shares</h2><div id="shares"></div>
+<h2>Mesh</h2><div id="mesh"></div>
+<h2>Updates</h2><div id="updates"></div>
+<h2>Backups</h2><div id="backups"></div>
+<h2>Keys</h2><div id="keys"></div>
+<script>
+function esc(s) {
+	return String(s == null ? "" : s).replace(/[&<>"']/g, function (c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+	});
+}
+function age(t) {
+	var s = Math.round((Date.now() - new Date(t)) / 1000);
+	if (!t || t.indexOf("0001-") == 0) return "-";
+	if (s < 120) return s + "s";
+	if (s < 7200) return Math.round(s / 60) + "m";
+	if (s < 172800) return Math.round(s / 3600) + "h";
+	return Math.round(s / 86400) + "d";
+}
+function table(head, rows) {
+	if (!rows || rows.length == 0) return "<p>none</p>";
+	var h = "<table><tr>" + head.map(function (c) { return "<th>" + esc(c) + "</th>"; }).join("") + "</tr>";
+	rows.forEach(function (r) {
+		h += "<tr" + (r.cls ? ' class="' + r.cls + '"' : "") + ">" +
+			r.cells.map(function (c) { return '<td class="mono">' + esc(c) + "</td>"; }).join("") + "</tr>";
+	});
+	return h + "</table>";
+}
+function render(st) {
+	var n = st.Node;
+	document.getElementById("title").textContent = "mfs replicator " + n.Nickname;
+	document.getElementById("node").innerHTML = table(["peer name", "key", "listen", "channel"],
+		[{cells: [n.PeerName, n.FingerPrint, n.Listen, n.Channel]}]);
+	var shares = "";
+	(st.Shares || []).forEach(function (s) {
+		shares += "<h3>" + esc(s.Name) + ' <span class="mono">' + esc(s.Local || "not scanned") + "</span></h3>";
+		shares += table(["publisher", "key", "hash", "age"], (s.Rows || []).map(function (r) {
+			return {cls: r.Current ? "ok" : "old",
+				cells: [r.Nickname + (r.Self ? " (us)" : ""), r.FingerPrint, r.Hash, age(r.Stamp)]};
+		}));
+	});
+	document.getElementById("shares").innerHTML = shares || "<p>none</p>";
+	var conn = {};
+	(st.Peers || []).forEach(function (p) { conn[p.Name] = p; });
+	document.getElementById("mesh").innerHTML = table(["peer", "nickname", "key", "address", "connected to"],
+		(st.Topology || []).map(function (p) {
+			var info = conn[p.Name] || {};
+			return {cls: p.Name == n.PeerName || info.Connected ? "ok" : "",
+				cells: [p.Name, p.NickName, info.FingerPrint || (p.Name == n.PeerName ? n.FingerPrint : "unverified"),
+					info.Address || "", (p.Connections || []).join(", ")]};
+		}));
+	var events = (st.Pending || []).concat(st.Events || []);
+	document.getElementById("updates").innerHTML = "<p>" + st.Queued + " queued</p>" +
+		table(["when", "share", "publisher", "hash", "outcome"], events.map(function (e) {
+			return {cls: e.Outcome == "failed" ? "bad" : e.Outcome == "applied" ? "ok" : "",
+				cells: [age(e.Done && e.Outcome != "pending" ? e.Done : e.Stamp), e.Path,
+					e.PeerName || e.FingerPrint, e.NewHash, e.Outcome + (e.Error ? ": " + e.Error : "")]};
+		}));
+	document.getElementById("backups").innerHTML = table(["folder", "hash"],
+		(st.Backups || []).map(function (b) { return {cells: [b.Path, b.Hash]}; }));
+	document.getElementById("keys").innerHTML = table(["key", "algorithm", "source", "trust", "mark", "state", "first seen"],
+		(st.Keys || []).map(function (k) {
+			return {cls: k.State == "ok" ? "" : "bad",
+				cells: [k.FingerPrint, k.Algorithm, k.Source, k.Trust, k.Mark, k.State, age(k.FirstSeen)]};
+		}));
+}
+var live = document.getElementById("live");
+var source = new EventSource("/events");
+source.addEventListener("state", function (ev) {
+	live.textContent = "live " + new Date().toLocaleTimeString();
+	render(JSON.parse(ev.data));
+});
+source.onerror = function () { live.textContent = "disconnected, retrying"; };
+</script>
+</body>
+</html>
+`
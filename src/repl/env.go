@@ -0,0 +1,231 @@
+package main
+
+// the settings above the config file, MFSREPL_ variables and then
+// the daemon flags, each names a config key and the last one wins
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"mfs"
+)
+
+const envPrefix = "MFSREPL_"
+
+var (
+	ErrNotSettable = errors.New("Key can not be set from the environment")
+	ErrBadRemote   = errors.New("Remote flags are pin and replicate")
+)
+
+// startEnv is the environment at start, the password is
+// taken out of it so nothing we run can see it
+var startEnv = os.Environ()
+
+func init() {
+	os.Unsetenv(envPrefix + "PASSWORD")
+}
+
+// override sets one config key, Admission.Rate for a nested one
+type override struct {
+	key    string // empty for a variable that names no key
+	source string // the variable or flag
+	value  string
+}
+
+// envOverrides : the MFSREPL_ variables in environ, in name order
+func envOverrides(environ []string) (ov []override) {
+	names := envNames()
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], envPrefix) || kv[:i] == passphraseEnv {
+			continue
+		}
+		ov = append(ov, override{key: names[kv[:i]], source: kv[:i], value: kv[i+1:]})
+	}
+	sort.Slice(ov, func(i, j int) bool { return ov[i].source < ov[j].source })
+	return ov
+}
+
+// envNames : the config key for each variable
+func envNames() map[string]string {
+	names := make(map[string]string)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Name == "Version" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Struct {
+			for j := 0; j < f.Type.Elem().NumField(); j++ {
+				key := f.Name + "." + f.Type.Elem().Field(j).Name
+				names[envName(key)] = key
+			}
+			continue
+		}
+		names[envName(f.Name)] = f.Name
+	}
+	return names
+}
+
+// envName : MFSREPL_ and the key in upper snake case,
+// KeysetCID is MFSREPL_KEYSET_CID and Admission.Rate MFSREPL_ADMISSION_RATE
+func envName(key string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, part := range strings.Split(key, ".") {
+		if i > 0 {
+			b.WriteByte('_')
+		}
+		prev := ' '
+		for _, r := range part {
+			if unicode.IsUpper(r) && unicode.IsLower(prev) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToUpper(r))
+			prev = r
+		}
+	}
+	return b.String()
+}
+
+// apply : set the overridden keys, sources has where each
+// top level key got its value
+func (c *Config) apply(ov []override) (sources map[string]string, errs ConfigErrors) {
+	sources = make(map[string]string)
+	for _, o := range ov {
+		if o.key == "" {
+			errs = append(errs, &ConfigError{Key: o.source, Err: ErrUnknownKey})
+			continue
+		}
+		if err := c.set(o.key, o.value); err != nil {
+			errs = append(errs, &ConfigError{Key: o.source, Err: err})
+			continue
+		}
+		sources[strings.SplitN(o.key, ".", 2)[0]] = o.source
+	}
+	return sources, errs
+}
+
+// set : one key from its text form, lists are comma separated
+func (c *Config) set(key, text string) (err error) {
+	parts := strings.SplitN(key, ".", 2)
+	f := reflect.ValueOf(c).Elem().FieldByName(parts[0])
+	if !f.IsValid() {
+		return ErrUnknownKey
+	}
+	if len(parts) == 2 {
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		f = f.Elem().FieldByName(parts[1])
+	}
+	switch key {
+	case "Shares":
+		c.Shares = parseShares(text)
+		return nil
+	case "Remotes":
+		c.Remotes, err = parseRemotes(text)
+		return err
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		f.Set(reflect.ValueOf(splitList(text)))
+	default:
+		return ErrNotSettable
+	}
+	// the password comes from one place, the higher layer
+	switch key {
+	case "Password":
+		c.PasswordFile = ""
+	case "PasswordFile":
+		c.Password = ""
+	}
+	return nil
+}
+
+// readSecrets : the password from PasswordFile when it is set
+func (c *Config) readSecrets() error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	f, err := os.Open(c.PasswordFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	secret, err := readPassphrase(f)
+	if err != nil {
+		return err
+	}
+	if len(secret) == 0 {
+		return ErrEmpty
+	}
+	c.Password = string(secret)
+	return nil
+}
+
+func splitList(text string) (list []string) {
+	list = []string{}
+	for _, s := range strings.Split(text, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// parseShares : name=source pairs, the share path is /name
+func parseShares(text string) map[string]*mfs.Share {
+	shares := make(map[string]*mfs.Share)
+	for _, s := range splitList(text) {
+		name, source, _ := strings.Cut(s, "=")
+		shares[name] = &mfs.Share{Path: "/" + name, Source: source}
+	}
+	return shares
+}
+
+// parseRemotes : name=pin+replicate, either flag or none
+func parseRemotes(text string) (map[string]*Remote, error) {
+	remotes := make(map[string]*Remote)
+	for _, s := range splitList(text) {
+		name, flags, _ := strings.Cut(s, "=")
+		r := &Remote{}
+		for _, flag := range strings.Split(flags, "+") {
+			switch flag {
+			case "":
+			case "pin":
+				r.Pin = true
+			case "replicate":
+				r.Replicate = true
+			default:
+				return nil, ErrBadRemote
+			}
+		}
+		remotes[name] = r
+	}
+	return remotes, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	for key, name := range map[string]string{
+		"Listen":         "MFSREPL_LISTEN",
+		"KeysetCID":      "MFSREPL_KEYSET_CID",
+		"PeerID":         "MFSREPL_PEER_ID",
+		"PasswordFile":   "MFSREPL_PASSWORD_FILE",
+		"SeedDNS":        "MFSREPL_SEED_DNS",
+		"Admission.Rate": "MFSREPL_ADMISSION_RATE",
+	} {
+		if got := envName(key); got != name {
+			t.Errorf("envName(%q) = %q, want %q", key, got, name)
+		}
+	}
+	names := envNames()
+	if names["MFSREPL_KEYSET_CID"] != "KeysetCID" || names["MFSREPL_ADMISSION_MAX_UNTRUSTED"] != "Admission.MaxUntrusted" {
+		t.Errorf("envNames %v", names)
+	}
+	if _, ok := names["MFSREPL_VERSION"]; ok {
+		t.Errorf("Version can be set from the environment")
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	file := testConfig + "Peers = [\"10.0.0.1\"]\n"
+	env := envOverrides([]string{"MFSREPL_NICKNAME=env", "MFSREPL_PEERS=10.0.0.2,10.0.0.3", "HOME=/root"})
+	flag := override{key: "Nickname", source: "-nickname", value: "flag"}
+	for _, tc := range []struct {
+		name     string
+		ov       []override
+		nickname string
+		peers    int
+	}{
+		{"file", nil, "bob", 1},
+		{"env", env, "env", 2},
+		{"flag", append(env, flag), "flag", 2},
+	} {
+		c, _, _, err := decodeConfig([]byte(file), tc.ov)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if c.Nickname != tc.nickname || len(c.Peers) != tc.peers {
+			t.Errorf("%s: nickname %q peers %v", tc.name, c.Nickname, c.Peers)
+		}
+	}
+	// a bad value is reported by the variable that set it
+	_, _, _, err := decodeConfig([]byte(file), envOverrides([]string{"MFSREPL_PEERS=:6783"}))
+	if errs, ok := err.(ConfigErrors); !ok || errs[0].Key != "MFSREPL_PEERS" {
+		t.Errorf("bad variable got %v", err)
+	}
+	_, _, _, err = decodeConfig([]byte(file), envOverrides([]string{"MFSREPL_COLOUR=red"}))
+	if errs, ok := err.(ConfigErrors); !ok || errs[0].Key != "MFSREPL_COLOUR" || errs[0].Err != ErrUnknownKey {
+		t.Errorf("unknown variable got %v", err)
+	}
+}
+
+func TestPasswordSource(t *testing.T) {
+	secret := t.TempDir() + "/password"
+	if err := os.WriteFile(secret, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := testConfig + "PasswordFile = \"" + secret + "\"\n"
+	c, _, _, err := decodeConfig([]byte(file), nil)
+	if err != nil || c.Password != "from file" {
+		t.Fatalf("password %q %v", c.Password, err)
+	}
+	// a password from a higher layer clears the file
+	flag := override{key: "Password", source: "-password", value: "from flag"}
+	c, _, _, err = decodeConfig([]byte(file), []override{flag})
+	if err != nil || c.Password != "from flag" || c.PasswordFile != "" {
+		t.Errorf("flag password %q file %q %v", c.Password, c.PasswordFile, err)
+	}
+	// and a file from a higher layer clears the password
+	withPassword := testConfig + "Password = \"in config\"\n"
+	env := envOverrides([]string{"MFSREPL_PASSWORD_FILE=" + secret})
+	c, _, _, err = decodeConfig([]byte(withPassword), env)
+	if err != nil || c.Password != "from file" {
+		t.Errorf("env password file %q %v", c.Password, err)
+	}
+	empty := t.TempDir() + "/empty"
+	os.WriteFile(empty, nil, 0600)
+	_, _, _, err = decodeConfig([]byte(testConfig+"PasswordFile = \""+empty+"\"\n"), nil)
+	if errs, ok := err.(ConfigErrors); !ok || errs[0].Key != "PasswordFile" {
+		t.Errorf("empty password file got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"keys"
+	"sync"
+)
+
+// keyWanter fetches keys we do not hold from the mesh
+type keyWanter interface {
+	Want(fp string) <-chan struct{}
+}
+
+// keyring signs our refs with the local key
+// and checks the refs of others against the keystore
+type keyring struct {
+	local *keys.StoredKey
+	store *keys.KeyStore
+	wants keyWanter
+
+	trustLock sync.RWMutex
+	minTrust  keys.Trust // publishers below this are refused
+}
+
+func NewKeyring(store *keys.KeyStore, wants keyWanter, minTrust keys.Trust) (k *keyring, err error) {
+	local, err := store.LocalKey()
+	if err != nil {
+		return nil, err
+	}
+	k = &keyring{
+		local:    local,
+		store:    store,
+		wants:    wants,
+		minTrust: minTrust,
+	}
+	return k, nil
+}
+
+// SetMinTrust : refuse refs from publishers trusted less than t
+func (k *keyring) SetMinTrust(t keys.Trust) {
+	k.trustLock.Lock()
+	k.minTrust = t
+	k.trustLock.Unlock()
+}
+
+func (k *keyring) MinTrust() keys.Trust {
+	k.trustLock.RLock()
+	defer k.trustLock.RUnlock()
+	return k.minTrust
+}
+
+func (k *keyring) FingerPrint() string {
+	return k.local.FingerPrint()
+}
+
+func (k *keyring) Sign(data []byte) (signature string, err error) {
+	return k.store.SignBytes(data)
+}
+
+// Verify refs signed by fp, revoked keys verify nothing
+func (k *keyring) Verify(fp string, data []byte, signature string) error {
+	if min := k.MinTrust(); min > keys.TrustUnknown && k.store.Trust(fp) < min {
+		return keys.ErrUntrusted
+	}
+	return k.store.VerifyBytes(fp, data, signature)
+}
+
+// Successor : the key fp rotated to, fp when it has not
+func (k *keyring) Successor(fp string) string {
+	return k.store.Successor(fp)
+}
+
+// Await asks the mesh for a key we do not hold
+func (k *keyring) Await(fp string) <-chan struct{} {
+	if k.wants == nil || k.store.HaveKey(fp, "public") {
+		return nil
+	}
+	if _, ok := k.store.Revoked(fp); ok {
+		return nil
+	}
+	return k.wants.Want(fp)
+}
@@ -0,0 +1,429 @@
+package main
+
+// key management commands, these work on the keystore
+// directly so the daemon must be stopped
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"keys"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func keysUsage() {
+	fmt.Fprintln(os.Stderr, "usage: repl keys [-keys path] [-json] [passphrase flags] <command>")
+	fmt.Fprintln(os.Stderr, "  list [bucket]")
+	fmt.Fprintln(os.Stderr, "           list public and quarantined keys, or the entries of another bucket")
+	fmt.Fprintln(os.Stderr, "  show <fingerprint>")
+	fmt.Fprintln(os.Stderr, "  export [pem] <fingerprint>...")
+	fmt.Fprintln(os.Stderr, "           write a signed bundle, or plain public key pem, to stdout")
+	fmt.Fprintln(os.Stderr, "  import <file>")
+	fmt.Fprintln(os.Stderr, "           add the keys of a bundle, - reads stdin")
+	fmt.Fprintln(os.Stderr, "  publish [mfs dir]")
+	fmt.Fprintln(os.Stderr, "           write every public key to ipfs and print the hash")
+	fmt.Fprintln(os.Stderr, "  import-cid <hash>")
+	fmt.Fprintln(os.Stderr, "           add the keys of a published keyset")
+	fmt.Fprintln(os.Stderr, "  trust|block|unmark <fingerprint>")
+	fmt.Fprintln(os.Stderr, "           mark a key trusted as an anchor, refused, or clear the mark")
+	fmt.Fprintln(os.Stderr, "  delete <fingerprint>")
+	fmt.Fprintln(os.Stderr, "           drop a public key, block it too or gossip brings it back")
+	fmt.Fprintln(os.Stderr, "  rotate [ed25519|rsa]")
+	fmt.Fprintln(os.Stderr, "           replace the local key with a successor signed by the old one")
+	fmt.Fprintln(os.Stderr, "  revoke <fingerprint> [reason]")
+	fmt.Fprintln(os.Stderr, "           revoke a retired local key, or any key as an admin")
+	fmt.Fprintln(os.Stderr, "  certify <fingerprint> <marginal|full|unknown>")
+	fmt.Fprintln(os.Stderr, "           vouch for another key with the local key")
+	fmt.Fprintln(os.Stderr, "  passwd [plaintext]")
+	fmt.Fprintln(os.Stderr, "           seal the private keys under a new passphrase read from stdin")
+}
+
+func keysCommand(args []string) int {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	keyPath := flags.String("keys", defaultKeys, "key store path")
+	passphrase := addPassFlags(flags)
+	asJSON := flags.Bool("json", false, "machine readable output for list and show")
+	flags.Usage = func() {
+		keysUsage()
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	pass, err := passphrase.Passphrase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ks, err := keys.NewKeyStore(*keyPath, pass)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "key store %s: %v (is the daemon running?)\n", *keyPath, err)
+		return 1
+	}
+	defer ks.Close()
+	switch flags.Arg(0) {
+	case "rotate":
+		return keysRotate(ks, flags.Args()[1:])
+	case "revoke":
+		return keysRevoke(ks, flags.Args()[1:])
+	case "certify":
+		return keysCertify(ks, flags.Args()[1:])
+	case "passwd":
+		return keysPasswd(ks, flags.Args()[1:])
+	case "list":
+		return keysList(ks, flags.Args()[1:], *asJSON)
+	case "show":
+		return keysShow(ks, flags.Args()[1:], *asJSON)
+	case "export":
+		return keysExport(ks, flags.Args()[1:])
+	case "import":
+		return keysImport(ks, flags.Args()[1:])
+	case "publish":
+		return keysPublish(ks, flags.Args()[1:])
+	case "import-cid":
+		return keysImportCID(ks, flags.Args()[1:])
+	case "trust", "block", "unmark":
+		return keysMark(ks, flags.Arg(0), flags.Args()[1:])
+	case "delete":
+		return keysDelete(ks, flags.Args()[1:])
+	}
+	keysUsage()
+	return 2
+}
+
+func keysRotate(ks *keys.KeyStore, args []string) int {
+	alg := keys.DefaultAlgorithm
+	if len(args) > 0 {
+		alg = args[0]
+	}
+	sr, err := ks.RotateAlg(alg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate: %v\n", err)
+		return 1
+	}
+	r, _ := sr.GetRotation()
+	next, err := r.NewKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate: %v\n", err)
+		return 1
+	}
+	fp, _ := next.GetFingerPrint()
+	dk, _ := next.GetDistKey()
+	fmt.Printf("retired %s\n", r.Old)
+	fmt.Printf("new %s key %s expires %s\n", dk.Algorithm, fp, dk.Expires.Format("2006-01-02"))
+	return 0
+}
+
+func keysRevoke(ks *keys.KeyStore, args []string) int {
+	if len(args) < 1 {
+		keysUsage()
+		return 2
+	}
+	reason := strings.Join(args[1:], " ")
+	sr, err := ks.Revoke(args[0], reason)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "revoke: %v\n", err)
+		return 1
+	}
+	r, _ := sr.GetRevocation()
+	fmt.Printf("revoked %s signed by %s\n", r.FingerPrint, r.Signer)
+	if r.Signer != r.FingerPrint {
+		fmt.Println("other nodes only accept this if the signer is in their Admins")
+	}
+	return 0
+}
+
+func keysCertify(ks *keys.KeyStore, args []string) int {
+	if len(args) != 2 {
+		keysUsage()
+		return 2
+	}
+	level, err := keys.ParseTrust(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "certify: %v\n", err)
+		return 2
+	}
+	_, err = ks.Certify(args[0], level)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "certify: %v\n", err)
+		return 1
+	}
+	fmt.Printf("certified %s as %s, computed trust %s\n", args[0], level, ks.Trust(args[0]))
+	return 0
+}
+
+func keysPasswd(ks *keys.KeyStore, args []string) int {
+	fmt.Fprintln(os.Stderr, "new passphrase:")
+	secret, err := readPassphrase(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+	pass := &keys.Passphrase{Secret: secret}
+	if len(secret) == 0 {
+		// an empty passphrase only leaves keys unsealed if asked to
+		if len(args) == 0 || args[0] != "plaintext" {
+			fmt.Fprintln(os.Stderr, "passwd: empty passphrase, use passwd plaintext to store keys unencrypted")
+			return 2
+		}
+		pass.Plaintext = true
+	}
+	err = ks.Passwd(pass)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+	if pass.Plaintext {
+		fmt.Println("private keys stored unencrypted")
+	} else {
+		fmt.Println("private keys sealed under the new passphrase")
+	}
+	return 0
+}
+
+func keysList(ks *keys.KeyStore, args []string, asJSON bool) int {
+	if len(args) > 0 && args[0] != "public" {
+		items, err := ks.ListKeys(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "list: %v\n", err)
+			return 1
+		}
+		if asJSON {
+			return printJSON(items)
+		}
+		for _, i := range items {
+			fmt.Println(i)
+		}
+		return 0
+	}
+	infos, err := ks.List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list: %v\n", err)
+		return 1
+	}
+	if asJSON {
+		views := make([]keyView, 0, len(infos))
+		for _, i := range infos {
+			views = append(views, newKeyView(i))
+		}
+		return printJSON(views)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FINGERPRINT\tALG\tFIRST SEEN\tSOURCE\tTRUST\tMARK\tSTATE")
+	for _, i := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.FingerPrint, i.Algorithm,
+			showTime(i.FirstSeen), i.Source, i.Trust, i.Mark, keyState(i))
+	}
+	w.Flush()
+	return 0
+}
+
+func keysShow(ks *keys.KeyStore, args []string, asJSON bool) int {
+	if len(args) != 1 {
+		keysUsage()
+		return 2
+	}
+	i, err := ks.Info(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "show: %v\n", err)
+		return 1
+	}
+	if asJSON {
+		return printJSON(newKeyView(i))
+	}
+	fmt.Printf("fingerprint %s\n", i.FingerPrint)
+	fmt.Printf("algorithm   %s weak %v box key %v\n", i.Algorithm, i.Weak, i.BoxKey)
+	fmt.Printf("expires     %s\n", showTime(i.Expires))
+	fmt.Printf("first seen  %s from %s %s\n", showTime(i.FirstSeen), i.Source, i.Peer)
+	fmt.Printf("last seen   %s, gossiped again %d times\n", showTime(i.LastSeen), i.Seen)
+	for _, c := range i.Claims {
+		fmt.Printf("claim       %s %s %s\n", c.PeerName, c.Nickname, showTime(c.Stamp))
+	}
+	fmt.Printf("trust       %s\n", i.Trust)
+	fmt.Printf("mark        %s\n", i.Mark)
+	fmt.Printf("state       %s\n", keyState(i))
+	if i.Revoked != nil {
+		fmt.Printf("revoked     %s by %s %s\n", showTime(i.Revoked.Stamp), i.Revoked.Signer, i.Revoked.Reason)
+	}
+	if next := ks.Successor(i.FingerPrint); next != i.FingerPrint {
+		fmt.Printf("rotated to  %s\n", next)
+	}
+	return 0
+}
+
+func keysExport(ks *keys.KeyStore, args []string) int {
+	plain := len(args) > 0 && args[0] == "pem"
+	if plain {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		keysUsage()
+		return 2
+	}
+	if !plain {
+		data, err := ks.ExportBundle(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: %v\n", err)
+			return 1
+		}
+		os.Stdout.Write(data)
+		return 0
+	}
+	for _, fp := range args {
+		data, err := ks.ExportPEM(fp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export %s: %v\n", fp, err)
+			return 1
+		}
+		os.Stdout.Write(data)
+	}
+	return 0
+}
+
+func keysImport(ks *keys.KeyStore, args []string) int {
+	if len(args) != 1 {
+		keysUsage()
+		return 2
+	}
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	added, err := ks.Import(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	for _, fp := range added {
+		fmt.Printf("added %s\n", fp)
+	}
+	return 0
+}
+
+func keysPublish(ks *keys.KeyStore, args []string) int {
+	dir := defaultKeysetDir()
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	hash, err := publishKeyset(ks, dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v (is ipfs running?)\n", err)
+		return 1
+	}
+	fmt.Printf("published %s as %s\n", dir, hash)
+	return 0
+}
+
+func keysImportCID(ks *keys.KeyStore, args []string) int {
+	if len(args) != 1 {
+		keysUsage()
+		return 2
+	}
+	data, env, err := fetchKeyset(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import-cid: %v\n", err)
+		return 1
+	}
+	added, err := ks.Import(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import-cid: %v\n", err)
+		return 1
+	}
+	for _, fp := range added {
+		fmt.Printf("added %s\n", fp)
+	}
+	fmt.Println(keysetSigner(ks, data, env))
+	return 0
+}
+
+// keysetSigner : who published a keyset, checked after import
+// so a publisher inside the set can be verified
+func keysetSigner(ks *keys.KeyStore, data []byte, env *keys.Envelope) string {
+	if env == nil {
+		return "keyset is not signed"
+	}
+	err := ks.Verify(env, keysetPurpose, data)
+	if err != nil {
+		return fmt.Sprintf("keyset signature by %s does not check: %v", env.Signer, err)
+	}
+	return fmt.Sprintf("keyset signed by %s, trust %s", env.Signer, ks.Trust(env.Signer))
+}
+
+func keysMark(ks *keys.KeyStore, command string, args []string) int {
+	if len(args) != 1 {
+		keysUsage()
+		return 2
+	}
+	mark := map[string]keys.Mark{
+		"trust":  keys.MarkTrusted,
+		"block":  keys.MarkBlocked,
+		"unmark": keys.MarkNone,
+	}[command]
+	err := ks.SetMark(args[0], mark)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return 1
+	}
+	fmt.Printf("%s %s, computed trust %s\n", command, args[0], ks.Trust(args[0]))
+	return 0
+}
+
+func keysDelete(ks *keys.KeyStore, args []string) int {
+	if len(args) != 1 {
+		keysUsage()
+		return 2
+	}
+	err := ks.Delete(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "delete: %v\n", err)
+		return 1
+	}
+	fmt.Printf("deleted %s\n", args[0])
+	if ks.Marked(args[0]) != keys.MarkBlocked {
+		fmt.Println("gossip will bring it back unless it is blocked")
+	}
+	return 0
+}
+
+// keyView is a key for json output, trust and state by name
+type keyView struct {
+	*keys.KeyInfo
+	Trust string
+	State string
+}
+
+func newKeyView(i *keys.KeyInfo) keyView {
+	return keyView{KeyInfo: i, Trust: i.Trust.String(), State: keyState(i)}
+}
+
+func keyState(i *keys.KeyInfo) string {
+	switch {
+	case i.Revoked != nil:
+		return "revoked"
+	case i.Mark == keys.MarkBlocked:
+		return "blocked"
+	case i.Quarantined:
+		return "quarantined"
+	case !i.Expires.IsZero() && time.Now().After(i.Expires):
+		return "expired"
+	}
+	return "ok"
+}
+
+func showTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,119 @@
+package main
+
+// keyset snapshots in ipfs, a bundle of every public key
+// signed by the node that published it
+import (
+	"bytes"
+	"errors"
+	"keys"
+	"mfs"
+	"time"
+)
+
+const (
+	keysetDir     = "/keysets"
+	keysetFile    = "keyset.pem"
+	keysetSig     = "keyset.sig"
+	keysetPurpose = "keyset"
+
+	// a keyset is a bundle of pem blocks each holding at most
+	// keys.MaxGossipSize bytes, base64 armour adds a third
+	keysetBlocks    = 64
+	keysetBlockSize = keys.MaxGossipSize/3*4 + 4096
+)
+
+var ErrKeysetBlocks = errors.New("Keyset has too many blocks")
+
+// publishKeyset : write the keyset into an mfs directory, returns its hash
+func publishKeyset(ks *keys.KeyStore, dir string) (hash string, err error) {
+	data, err := ks.ExportAll()
+	if err != nil {
+		return "", err
+	}
+	if bytes.Count(data, []byte("-----BEGIN ")) > keysetBlocks {
+		return "", ErrKeysetBlocks
+	}
+	env, err := ks.Sign(keysetPurpose, data)
+	if err != nil {
+		return "", err
+	}
+	sig, err := env.Encode()
+	if err != nil {
+		return "", err
+	}
+	fs := &mfs.Share{}
+	err = fs.Mkdir(dir, true)
+	if err != nil {
+		return "", err
+	}
+	err = fs.Write(dir+"/"+keysetFile, data)
+	if err != nil {
+		return "", err
+	}
+	err = fs.Write(dir+"/"+keysetSig, sig)
+	if err != nil {
+		return "", err
+	}
+	stat, err := fs.Mfs(dir)
+	if err != nil {
+		return "", err
+	}
+	return stat.Hash, nil
+}
+
+// fetchKeyset : the keyset and its publisher signature from a hash,
+// the signature is nil if the snapshot has none. The read is capped
+// by block, each block is checked again when it is imported.
+func fetchKeyset(hash string) (data []byte, env *keys.Envelope, err error) {
+	err = mfs.ValidHash(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = mfs.Cat("/ipfs/"+hash+"/"+keysetFile, keysetBlocks*keysetBlockSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Count(data, []byte("-----BEGIN ")) > keysetBlocks {
+		return nil, nil, ErrKeysetBlocks
+	}
+	sig, err := mfs.Cat("/ipfs/"+hash+"/"+keysetSig, keys.MaxSignedKeySize)
+	if err != nil {
+		return data, nil, nil
+	}
+	env, err = keys.DecodeEnvelope(sig)
+	if err != nil {
+		return data, nil, nil
+	}
+	return data, env, nil
+}
+
+// defaultKeysetDir : a dated folder for each publish
+func defaultKeysetDir() string {
+	return keysetDir + "/" + time.Now().UTC().Format("20060102T150405Z")
+}
+
+// seedKeyset : import a keyset into a keystore that has only our key
+func seedKeyset(keyPeer keysPeer, hash string) {
+	store := keyPeer.Store()
+	have, err := store.ListKeys("public")
+	if err != nil || len(have) > 1 {
+		return
+	}
+	data, env, err := fetchKeyset(hash)
+	if err != nil {
+		logger.Errorf("Keyset %s %v", hash, err)
+		return
+	}
+	added, err := keyPeer.Import(data)
+	if err != nil {
+		logger.Errorf("Keyset %s %v", hash, err)
+		return
+	}
+	logger.Infof("Keyset %s seeded %d keys, %s", hash, len(added), keysetSigner(store, data, env))
+}
+
+// keysPeer is the part of the keys peer seeding needs
+type keysPeer interface {
+	Store() *keys.KeyStore
+	Import(data []byte) ([]string, error)
+}
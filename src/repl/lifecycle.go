@@ -0,0 +1,105 @@
+package main
+
+// the daemon components start in order and stop in reverse, the
+// loops share a context that SIGINT or SIGTERM cancels
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how long shutdown waits for the loops and the updates being applied
+const drainTimeout = 30 * time.Second
+
+type lifecycle struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	loops    sync.WaitGroup
+	stops    []stopStep
+	signals  chan os.Signal
+	deadline time.Time
+}
+
+type stopStep struct {
+	name string
+	stop func() error
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	lc := &lifecycle{
+		ctx:     ctx,
+		cancel:  cancel,
+		signals: make(chan os.Signal, 2),
+	}
+	signal.Notify(lc.signals, syscall.SIGINT, syscall.SIGTERM)
+	return lc
+}
+
+// onStop : run f at shutdown, before the steps added earlier
+func (lc *lifecycle) onStop(name string, f func() error) {
+	lc.stops = append(lc.stops, stopStep{name: name, stop: f})
+}
+
+// loop : run f until the context is done, shutdown waits for it
+func (lc *lifecycle) loop(name string, f func(ctx context.Context)) {
+	lc.loops.Add(1)
+	go func() {
+		defer lc.loops.Done()
+		f(lc.ctx)
+		logger.Debugf("%s stopped", name)
+	}()
+}
+
+// wait : block until we are told to stop
+func (lc *lifecycle) wait() os.Signal {
+	return <-lc.signals
+}
+
+// remaining : the time left to drain before shutdown gives up
+func (lc *lifecycle) remaining() time.Duration {
+	if d := time.Until(lc.deadline); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// shutdown : cancel the loops, wait until the timeout for them to
+// finish, then run the stop steps in reverse. Another signal while
+// it waits stops waiting, one after that exits at once.
+func (lc *lifecycle) shutdown(timeout time.Duration) (clean bool) {
+	clean = true
+	lc.deadline = time.Now().Add(timeout)
+	lc.cancel()
+	done := make(chan struct{})
+	go func() {
+		lc.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warningf("Loops still running after %s", timeout)
+		clean = false
+	case sig := <-lc.signals:
+		logger.Warningf("%s, not waiting for the loops", sig)
+		clean = false
+	}
+	go func() {
+		sig := <-lc.signals
+		logger.Criticalf("%s, exiting now", sig)
+		os.Exit(exitError)
+	}()
+	for i := len(lc.stops) - 1; i >= 0; i-- {
+		step := lc.stops[i]
+		logger.Infof("Stopping %s", step.name)
+		if err := step.stop(); err != nil {
+			logger.Errorf("Stop %s %v", step.name, err)
+			clean = false
+		}
+	}
+	return clean
+}
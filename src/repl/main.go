@@ -1,77 +1,89 @@
 package main
 
+// repl is a set of subcommands, the daemon joins the mesh and
+// the rest work offline on the config and key store
 import (
-	"flag"
+	"encoding/json"
 	"fmt"
 	"github.com/op/go-logging"
 	"os"
-	"os/signal"
-	"syscall"
-
-	"keys"
-	"mfs"
-	"refshare"
+	"strings"
+	"time"
 )
 
 var logger = logging.MustGetLogger("main")
 
-func main() {
-	var (
-		configPath = flag.String("config", "./repl.toml", "config file path")
-		password   = flag.String("password", "", "password for mesh")
-		peer       = flag.String("peer", "", "peer address")
-		nickname   = flag.String("nickname", "", "Nickname for the node")
-		level      = flag.Int("log", 2, "Logging Level")
-		refs       = flag.Bool("refs", false, "refs active")
-	)
-	flag.Parse()
+// warn this long before the local key expires
+const expiryWarning = 30 * 24 * time.Hour
 
-	config := LoadConfig(*configPath, *peer, *password, *nickname)
-	LogSetup(*level, "mfsrepl")
-	logging.SetLevel(logging.DEBUG, "mfs")
+const (
+	defaultConfig = "./repl.toml"
+	defaultKeys   = "keys"
+)
 
-	logger := GetLogger("cluster")
-	logger.Critical("MFS replicator")
-	cluster := NewCluster(config, logger)
+// exit codes shared by every command
+const (
+	exitOK          = 0
+	exitError       = 1 // the command failed
+	exitUsage       = 2 // bad arguments
+	exitUnavailable = 3 // needs a running daemon and none answered
+)
 
-	// Attach the widgets
-	var refPeer *refshare.Peer
-	if *refs {
-		refPeer = refshare.NewPeer(cluster.Name, logger)
-		cluster.Attach(refPeer, config.Channel)
-	}
+type command struct {
+	run   func(args []string) int
+	usage string
+}
 
-	keyPeer := keys.NewPeer("keys", logger)
-	cluster.Attach(keyPeer, "keybase")
-	// Spin up the mesh
-	go func() {
-		cluster.Start()
-	}()
+var commands = map[string]command{
+	"daemon":    {daemonCommand, "join the mesh and replicate the shares"},
+	"init":      {initCommand, "write a new config and create the key store"},
+	"status":    {statusCommand, "show the node identity and what it shares"},
+	"peers":     {peersCommand, "list the mesh peers"},
+	"shares":    {sharesCommand, "list the shares"},
+	"keys":      {keysCommand, "manage the key store, repl keys -h for more"},
+	"config":    {configCommand, "show the config"},
+	"dashboard": {dashboardCommand, "print the link to the web dashboard"},
+}
 
-	// Defer the Mesh Close
-	defer func() {
-		cluster.Stop()
-	}()
+var commandOrder = []string{"daemon", "init", "status", "peers", "shares", "keys", "config", "dashboard"}
 
-	// Show the current peers
-	cluster.Peers()
-	// Show a list every 10 seconds
-	go cluster.Info(30)
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: repl <command> [flags]")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "repl <command> -h shows the flags of a command")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	name, args := os.Args[1], os.Args[2:]
+	// the daemon used to be the whole binary
+	if strings.HasPrefix(name, "-") {
+		fmt.Fprintln(os.Stderr, "repl: flags without a command are deprecated, use repl daemon")
+		name, args = "daemon", os.Args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		if name != "help" {
+			fmt.Fprintf(os.Stderr, "repl: unknown command %q\n", name)
+		}
+		usage()
+		os.Exit(exitUsage)
+	}
+	os.Exit(cmd.run(args))
+}
 
-	if *refs {
-		// Create the Shares
-		shares := mfs.NewShare(config.Shares)
-		// Watch the shares
-		go shares.Watch(10)
-		// Run the primary event loop
-		go Process(cluster, refPeer, shares, 10)
+// printJSON : v indented on stdout, for the -json flags
+func printJSON(v interface{}) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
 	}
-	// Run and Wait
-	errs := make(chan error, 1)
-	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT)
-		errs <- fmt.Errorf("%s", <-c)
-	}()
-	logger.Critical(<-errs)
+	return exitOK
 }
@@ -0,0 +1,181 @@
+package main
+
+// prometheus metrics of the mesh, the gossip channels and the
+// key store, the ipfs and share metrics live in mfs
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/weaveworks/mesh"
+	"metrics"
+	"refshare"
+)
+
+var (
+	gossipMessages = metrics.NewCounterVec("repl_gossip_messages_total",
+		"Gossip messages by channel, direction and kind.", "channel", "direction", "kind")
+	gossipBytes = metrics.NewCounterVec("repl_gossip_bytes_total",
+		"Gossip bytes by channel, direction and kind.", "channel", "direction", "kind")
+	meshPeers = metrics.NewGaugeFunc("repl_mesh_peers",
+		"Peers the mesh router knows, ourself included.", "")
+	meshConnections = metrics.NewGaugeFunc("repl_mesh_connections",
+		"Mesh connections by state.", "state")
+	keystoreKeys = metrics.NewGaugeFunc("repl_keystore_keys",
+		"Entries in each key store bucket.", "bucket")
+	keyLookups = metrics.NewGaugeFunc("repl_key_lookups",
+		"Open asks to neighbours for keys.", "")
+	refPublishers = metrics.NewGaugeFunc("repl_refs_publishers",
+		"Nodes whose refs we hold, ourself included.", "")
+	updatesQueued = metrics.NewGaugeFunc("repl_updates_queued",
+		"Updates from peers waiting to be applied.", "")
+)
+
+const (
+	kindGossip    = "gossip"
+	kindBroadcast = "broadcast"
+	kindUnicast   = "unicast"
+)
+
+// setGauges : read the gauges from the running node,
+// refPeer is nil when refs are not shared
+func setGauges(cl *Cluster, keyPeer keySource, refPeer *refshare.Peer) {
+	meshPeers.Set(func() map[string]float64 {
+		return map[string]float64{"": float64(len(cl.router.Peers.Descriptions()))}
+	})
+	meshConnections.Set(func() map[string]float64 {
+		counts := map[string]float64{"established": 0, "pending": 0}
+		for _, c := range cl.Status().Connections {
+			counts[c.State]++
+		}
+		return counts
+	})
+	keystoreKeys.Set(func() map[string]float64 {
+		counts := make(map[string]float64)
+		for bucket, n := range keyPeer.Store().Counts() {
+			counts[bucket] = float64(n)
+		}
+		return counts
+	})
+	keyLookups.Set(func() map[string]float64 {
+		return map[string]float64{"": float64(keyPeer.Wanting())}
+	})
+	if refPeer == nil {
+		return
+	}
+	refPublishers.Set(func() map[string]float64 {
+		return map[string]float64{"": float64(len(refPeer.State()))}
+	})
+	updatesQueued.Set(func() map[string]float64 {
+		return map[string]float64{"": float64(refPeer.Queued())}
+	})
+}
+
+// startMetrics : serve /metrics on addr for prometheus
+func startMetrics(addr string) (server *http.Server, err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Infof("Metrics on http://%s/metrics", addr)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("Metrics %v", err)
+		}
+	}()
+	return server, nil
+}
+
+// countedWidget counts the gossip of one channel on the way
+// through, the data it hands the mesh is wrapped so sends are
+// counted when the mesh encodes them
+type countedWidget struct {
+	Widget
+	channel string
+}
+
+func (cw *countedWidget) in(kind string, buf []byte) {
+	gossipMessages.With(cw.channel, "in", kind).Inc()
+	gossipBytes.With(cw.channel, "in", kind).Add(float64(len(buf)))
+}
+
+func (cw *countedWidget) Register(send mesh.Gossip) {
+	cw.Widget.Register(&countedGossip{Gossip: send, channel: cw.channel})
+}
+
+func (cw *countedWidget) Gossip() mesh.GossipData {
+	return countData(cw.Widget.Gossip(), cw.channel, kindGossip)
+}
+
+func (cw *countedWidget) OnGossip(buf []byte) (mesh.GossipData, error) {
+	cw.in(kindGossip, buf)
+	delta, err := cw.Widget.OnGossip(buf)
+	return countData(delta, cw.channel, kindGossip), err
+}
+
+func (cw *countedWidget) OnGossipBroadcast(src mesh.PeerName, buf []byte) (mesh.GossipData, error) {
+	cw.in(kindBroadcast, buf)
+	received, err := cw.Widget.OnGossipBroadcast(src, buf)
+	return countData(received, cw.channel, kindBroadcast), err
+}
+
+func (cw *countedWidget) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	cw.in(kindUnicast, buf)
+	return cw.Widget.OnGossipUnicast(src, buf)
+}
+
+// countedGossip counts what the widget sends
+type countedGossip struct {
+	mesh.Gossip
+	channel string
+}
+
+func (cg *countedGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	gossipMessages.With(cg.channel, "out", kindUnicast).Inc()
+	gossipBytes.With(cg.channel, "out", kindUnicast).Add(float64(len(msg)))
+	return cg.Gossip.GossipUnicast(dst, msg)
+}
+
+func (cg *countedGossip) GossipBroadcast(update mesh.GossipData) {
+	cg.Gossip.GossipBroadcast(countData(update, cg.channel, kindBroadcast))
+}
+
+// countedData counts its encodings as sent messages
+type countedData struct {
+	mesh.GossipData
+	channel, kind string
+}
+
+// countData : wrap d, nil stays nil as the mesh checks for it
+func countData(d mesh.GossipData, channel, kind string) mesh.GossipData {
+	if d == nil {
+		return nil
+	}
+	if cd, ok := d.(*countedData); ok {
+		d = cd.GossipData
+	}
+	return &countedData{GossipData: d, channel: channel, kind: kind}
+}
+
+func (cd *countedData) Encode() [][]byte {
+	bufs := cd.GossipData.Encode()
+	gossipMessages.With(cd.channel, "out", cd.kind).Add(float64(len(bufs)))
+	for _, buf := range bufs {
+		gossipBytes.With(cd.channel, "out", cd.kind).Add(float64(len(buf)))
+	}
+	return bufs
+}
+
+// Merge : the widget data only merges with its own kind
+func (cd *countedData) Merge(other mesh.GossipData) mesh.GossipData {
+	if o, ok := other.(*countedData); ok {
+		other = o.GossipData
+	}
+	return countData(cd.GossipData.Merge(other), cd.channel, cd.kind)
+}
@@ -0,0 +1,61 @@
+package main
+
+// where the key store passphrase comes from
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"keys"
+	"os"
+	"strings"
+)
+
+// passphraseEnv holds the passphrase when no flag gives it
+const passphraseEnv = "MFSREPL_PASSPHRASE"
+
+var ErrNoPassphrase = errors.New("No passphrase, use -passphrase, -passphrase-fd, " + passphraseEnv + " or -plaintext-keys")
+
+type passFlags struct {
+	phrase    *string
+	fd        *int
+	plaintext *bool
+}
+
+func addPassFlags(flags *flag.FlagSet) *passFlags {
+	return &passFlags{
+		phrase:    flags.String("passphrase", "", "key store passphrase (visible to ps, prefer the fd or env)"),
+		fd:        flags.Int("passphrase-fd", -1, "read the key store passphrase from this file descriptor"),
+		plaintext: flags.Bool("plaintext-keys", false, "keep private keys unencrypted on disk"),
+	}
+}
+
+// Passphrase : from the flag, then the fd, then the environment
+func (pf *passFlags) Passphrase() (pass *keys.Passphrase, err error) {
+	pass = &keys.Passphrase{Plaintext: *pf.plaintext}
+	switch {
+	case *pf.phrase != "":
+		pass.Secret = []byte(*pf.phrase)
+	case *pf.fd >= 0:
+		pass.Secret, err = readPassphrase(os.NewFile(uintptr(*pf.fd), "passphrase"))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		pass.Secret = []byte(os.Getenv(passphraseEnv))
+	}
+	os.Unsetenv(passphraseEnv)
+	if len(pass.Secret) == 0 && !pass.Plaintext {
+		return nil, ErrNoPassphrase
+	}
+	return pass, nil
+}
+
+// readPassphrase : the first line from r
+func readPassphrase(r io.Reader) (secret []byte, err error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
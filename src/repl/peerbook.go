@@ -0,0 +1,524 @@
+package main
+
+// the peer book keeps the addresses the mesh has been reached on so
+// a restart is not left with only the configured peers, the ones it
+// knows are dialled with backoff and seeds can come from a file or dns
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	defaultPeerStore = "peers.db"
+
+	dialInterval = 10 * time.Second // between rounds of dialling
+	dialTimeout  = 30 * time.Second // a dial not connected by then failed
+	dialBase     = 10 * time.Second // wait after the first failure, doubled after each
+	dialMax      = 30 * time.Minute
+	dialsARound  = 8
+	seedInterval = time.Hour
+	maxKnown     = 256
+	maxFailures  = 8                   // in a row, with no connection for forgetAfter
+	forgetAfter  = 30 * 24 * time.Hour // the address is dropped
+	touchEvery   = time.Hour           // a live connection is saved this often
+)
+
+// where an address was heard of, config wins over the others and
+// addresses only seen in the connections of other peers count least
+const (
+	sourceConfig = "config"
+	sourceSeed   = "seed"
+	sourceMesh   = "mesh"  // we were connected on it
+	sourceHeard  = "heard" // another peer was connected on it
+)
+
+var peerBucket = []byte("peers")
+
+// knownPeer is an address a peer can be dialled on
+type knownPeer struct {
+	Address   string
+	Source    string    // config, seed, mesh or heard
+	Name      string    `json:",omitempty"` // mesh peer last reached there
+	NickName  string    `json:",omitempty"`
+	Connected time.Time // last connection, zero for never
+	Tried     time.Time // last dial we made
+	Failures  int       // dials since the last connection
+}
+
+// backoff : how long after a dial to try again
+func backoff(failures int) time.Duration {
+	d := dialBase
+	for i := 1; i < failures && d < dialMax; i++ {
+		d *= 2
+	}
+	if d > dialMax {
+		d = dialMax
+	}
+	return d
+}
+
+// touch : note a connection on p, true when it is worth saving
+func (p *knownPeer) touch(name, nickName string, now time.Time) (changed bool) {
+	if name == "" {
+		name, nickName = p.Name, p.NickName
+	}
+	changed = p.Name != name || p.NickName != nickName || p.Failures != 0 || now.Sub(p.Connected) > touchEvery
+	p.Name, p.NickName = name, nickName
+	p.Connected, p.Failures = now, 0
+	return changed
+}
+
+// peerBook dials the known addresses that are not configured
+// peers, the mesh keeps retrying those itself. Lookups, dials and
+// writes to the store happen without the lock held.
+type peerBook struct {
+	db      *bolt.DB
+	cluster *Cluster
+
+	lock     sync.Mutex
+	peers    map[string]*knownPeer
+	dialing  map[string]time.Time // our dials not yet connected
+	dirty    map[string]bool      // addresses to write or delete
+	seedFile string
+	seedDNS  []string
+
+	flushLock sync.Mutex // one flush at a time so writes keep their order
+}
+
+// openPeerBook : load the known peers from path, each
+// gets one dial at start whatever its backoff was
+func openPeerBook(path string, cluster *Cluster) (b *peerBook, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b = &peerBook{
+		db:      db,
+		cluster: cluster,
+		peers:   make(map[string]*knownPeer),
+		dialing: make(map[string]time.Time),
+		dirty:   make(map[string]bool),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(peerBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var p knownPeer
+			if err := json.Unmarshal(v, &p); err != nil {
+				logger.Warningf("Peer book %s %v", k, err)
+				return nil
+			}
+			p.Tried = time.Time{}
+			b.peers[p.Address] = &p
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	logger.Infof("Peer book has %d addresses", len(b.peers))
+	return b, nil
+}
+
+func (b *peerBook) close() error {
+	return b.db.Close()
+}
+
+// setSeeds : where extra seed addresses come from
+func (b *peerBook) setSeeds(file string, dns []string) {
+	b.lock.Lock()
+	b.seedFile, b.seedDNS = file, dns
+	b.lock.Unlock()
+}
+
+// Known : the known peers by address
+func (b *peerBook) Known() (peers []knownPeer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, p := range b.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// run : dial and learn until ctx is done, then drop our dials
+func (b *peerBook) run(ctx context.Context) {
+	b.resolveSeeds()
+	b.round()
+	dial := time.NewTicker(dialInterval)
+	defer dial.Stop()
+	seeds := time.NewTicker(seedInterval)
+	defer seeds.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.lock.Lock()
+			b.forget(b.dialingAddrs())
+			b.lock.Unlock()
+			b.flush()
+			return
+		case <-dial.C:
+			b.round()
+		case <-seeds.C:
+			b.resolveSeeds()
+		}
+	}
+}
+
+// round : record the connections, fail the dials that timed out
+// and start the ones whose backoff is over
+func (b *peerBook) round() {
+	st := b.cluster.Status()
+	targets := b.cluster.router.ConnectionMaker.Targets(false)
+	now := time.Now()
+	b.lock.Lock()
+	pending := b.dialingAddrs()
+	b.lock.Unlock()
+	// our dials as the mesh shows them, looked up without the lock
+	shown := make(map[string]string, len(pending))
+	for _, addr := range pending {
+		shown[addr] = resolved(addr)
+	}
+	dials := b.plan(st, targets, shown, now)
+	for _, addr := range dials {
+		errs := b.cluster.router.ConnectionMaker.InitiateConnections([]string{addr}, false)
+		if len(errs) == 0 {
+			continue
+		}
+		logger.Debugf("Peer book %s %v", addr, errs[0])
+		b.lock.Lock()
+		delete(b.dialing, addr)
+		if p := b.peers[addr]; p != nil {
+			p.Failures++
+			b.save(p)
+		}
+		b.lock.Unlock()
+	}
+	b.flush()
+}
+
+// plan : update the book from the mesh status and pick the
+// addresses to dial, they are marked as dialing
+func (b *peerBook) plan(st *mesh.Status, targets []string, shown map[string]string, now time.Time) (dials []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// our dialled connections, and the ones other peers dialled
+	up := make(map[string]bool)
+	connected := make(map[string]bool)
+	for _, ps := range st.Peers {
+		for _, c := range ps.Connections {
+			if !c.Established {
+				continue
+			}
+			if ps.Name != st.Name {
+				if c.Outbound && c.Name != st.Name {
+					b.learn(c.Address, sourceHeard)
+				}
+				continue
+			}
+			connected[c.Name] = true
+			if !c.Outbound {
+				continue
+			}
+			up[c.Address] = true
+			p := b.learn(c.Address, sourceMesh)
+			if p == nil {
+				continue
+			}
+			changed := p.touch(c.Name, c.NickName, now)
+			if p.Source == sourceHeard {
+				p.Source, changed = sourceMesh, true
+			}
+			if changed {
+				b.save(p)
+			}
+		}
+	}
+	configured := make(map[string]bool)
+	for _, addr := range targets {
+		if _, ours := b.dialing[addr]; !ours {
+			configured[addr] = true
+			if p := b.learn(addr, sourceConfig); p != nil && p.Source != sourceConfig {
+				p.Source = sourceConfig
+				b.save(p)
+			}
+		}
+	}
+	var done []string
+	for addr, started := range b.dialing {
+		p := b.peers[addr]
+		addrShown, ok := shown[addr]
+		if !ok {
+			addrShown = addr
+		}
+		switch {
+		case p == nil:
+			done = append(done, addr)
+		case up[addrShown]:
+			if p.touch("", "", now) {
+				b.save(p)
+			}
+			done = append(done, addr)
+		case now.Sub(started) > dialTimeout:
+			p.Failures++
+			b.save(p)
+			logger.Debugf("Peer book %s failed %d times", addr, p.Failures)
+			done = append(done, addr)
+		}
+	}
+	// the mesh would retry them forever, we back off instead
+	b.forget(done)
+	for _, p := range b.sorted() {
+		if len(dials) == dialsARound {
+			break
+		}
+		if configured[p.Address] || up[p.Address] || connected[p.Name] {
+			continue
+		}
+		if _, ok := b.dialing[p.Address]; ok || now.Sub(p.Tried) < backoff(p.Failures) {
+			continue
+		}
+		if p.Failures >= maxFailures && now.Sub(p.Connected) > forgetAfter {
+			logger.Infof("Peer book forgets %s", p.Address)
+			b.remove(p.Address)
+			continue
+		}
+		// Tried starts over at a restart, it is not saved
+		p.Tried = now
+		b.dialing[p.Address] = now
+		dials = append(dials, p.Address)
+	}
+	return dials
+}
+
+// learn : the entry for addr, added when it is new and there is room
+func (b *peerBook) learn(addr, source string) *knownPeer {
+	if p, ok := b.peers[addr]; ok {
+		return p
+	}
+	if err := peerAddr(addr); err != nil {
+		return nil
+	}
+	if len(b.peers) >= maxKnown && !b.evict(source) {
+		return nil
+	}
+	p := &knownPeer{Address: addr, Source: source}
+	b.peers[addr] = p
+	b.save(p)
+	logger.Infof("Peer book learned %s from %s", addr, source)
+	return p
+}
+
+// evict : make room for an address from source by dropping the
+// worst entry that is not configured, heard addresses go first.
+// A heard address only displaces a heard one that has failed.
+func (b *peerBook) evict(source string) bool {
+	var victim *knownPeer
+	for _, p := range b.sorted() {
+		switch {
+		case p.Source == sourceConfig:
+			continue
+		case source == sourceHeard && (p.Source != sourceHeard || p.Failures == 0):
+			continue
+		}
+		// sorted best first, a later one is worse
+		if victim == nil || p.Source == sourceHeard || victim.Source != sourceHeard {
+			victim = p
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	logger.Debugf("Peer book drops %s for a new address", victim.Address)
+	b.remove(victim.Address)
+	return true
+}
+
+// sorted : the least failed and most recently connected first
+func (b *peerBook) sorted() (peers []*knownPeer) {
+	for _, p := range b.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Failures != peers[j].Failures {
+			return peers[i].Failures < peers[j].Failures
+		}
+		return peers[i].Connected.After(peers[j].Connected)
+	})
+	return peers
+}
+
+func (b *peerBook) dialingAddrs() (addrs []string) {
+	for addr := range b.dialing {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// forget : stop the mesh retrying our dials
+func (b *peerBook) forget(addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	b.cluster.router.ConnectionMaker.ForgetConnections(addrs)
+	for _, addr := range addrs {
+		delete(b.dialing, addr)
+	}
+}
+
+// save : write p at the next flush, hold the lock
+func (b *peerBook) save(p *knownPeer) {
+	b.dirty[p.Address] = true
+}
+
+// remove : drop addr now and from the store at the next flush
+func (b *peerBook) remove(addr string) {
+	delete(b.peers, addr)
+	b.dirty[addr] = true
+}
+
+// flush : write the entries saved or removed since the last flush
+func (b *peerBook) flush() {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+	b.lock.Lock()
+	var put []knownPeer
+	var del []string
+	for addr := range b.dirty {
+		if p, ok := b.peers[addr]; ok {
+			put = append(put, *p)
+		} else {
+			del = append(del, addr)
+		}
+	}
+	b.dirty = make(map[string]bool)
+	b.lock.Unlock()
+	if len(put)+len(del) == 0 {
+		return
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(peerBucket)
+		for i := range put {
+			data, err := json.Marshal(&put[i])
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(put[i].Address), data); err != nil {
+				return err
+			}
+		}
+		for _, addr := range del {
+			if err := bucket.Delete([]byte(addr)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("Peer book %v", err)
+	}
+}
+
+// resolveSeeds : add the seeds from the file and dns, lookups
+// happen without the lock held
+func (b *peerBook) resolveSeeds() {
+	b.lock.Lock()
+	file, dns := b.seedFile, b.seedDNS
+	b.lock.Unlock()
+	var seeds []string
+	if file != "" {
+		addrs, err := readSeedFile(file)
+		if err != nil {
+			logger.Errorf("Seed file %v", err)
+		}
+		seeds = append(seeds, addrs...)
+	}
+	for _, name := range dns {
+		addrs, err := lookupSeeds(name)
+		if err != nil {
+			logger.Errorf("Seed dns %s %v", name, err)
+		}
+		seeds = append(seeds, addrs...)
+	}
+	b.lock.Lock()
+	for _, addr := range seeds {
+		b.learn(addr, sourceSeed)
+	}
+	b.lock.Unlock()
+	b.flush()
+}
+
+// readSeedFile : an address a line, # starts a comment
+func readSeedFile(path string) (addrs []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, scanner.Err()
+}
+
+// lookupSeeds : SRV records for a name starting with an underscore,
+// like _mfsrepl._tcp.example.com, otherwise TXT records holding
+// addresses separated by spaces or commas
+func lookupSeeds(name string) (addrs []string, err error) {
+	if strings.HasPrefix(name, "_") {
+		_, srvs, err := net.LookupSRV("", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port)))
+		}
+		return addrs, nil
+	}
+	txts, err := net.LookupTXT(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		addrs = append(addrs, strings.FieldsFunc(txt, func(r rune) bool {
+			return r == ' ' || r == ','
+		})...)
+	}
+	return addrs, nil
+}
+
+// resolved : addr as the mesh shows connections to it,
+// a bare host is on the mesh port
+func resolved(addr string) string {
+	dial := addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		dial = net.JoinHostPort(addr, fmt.Sprint(mesh.Port))
+	}
+	tcp, err := net.ResolveTCPAddr("tcp", dial)
+	if err != nil {
+		return addr
+	}
+	return tcp.String()
+}
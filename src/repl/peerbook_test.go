@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPeerBookFull(t *testing.T) {
+	b := &peerBook{
+		peers:   make(map[string]*knownPeer),
+		dialing: make(map[string]time.Time),
+		dirty:   make(map[string]bool),
+	}
+	b.learn("10.0.0.1", sourceConfig)
+	for i := 0; len(b.peers) < maxKnown; i++ {
+		if b.learn(fmt.Sprintf("10.1.%d.%d:6783", i/256, i%256), sourceHeard) == nil {
+			t.Fatalf("book full at %d", len(b.peers))
+		}
+	}
+	// heard addresses can not push out ones that work
+	if b.learn("10.2.0.1:6783", sourceHeard) != nil {
+		t.Errorf("heard address displaced a working one")
+	}
+	failed := b.peers["10.1.0.7:6783"]
+	failed.Failures = 3
+	if b.learn("10.2.0.2:6783", sourceHeard) == nil || b.peers[failed.Address] != nil {
+		t.Errorf("heard address did not displace a failed one")
+	}
+	// a seed pushes out the worst heard address
+	worse := b.peers["10.1.0.9:6783"]
+	worse.Failures = 5
+	if b.learn("seed.example.com", sourceSeed) == nil || b.peers[worse.Address] != nil {
+		t.Errorf("seed did not displace the worst heard address")
+	}
+	if b.peers["10.0.0.1"] == nil || len(b.peers) != maxKnown {
+		t.Errorf("book holds %d, config kept %v", len(b.peers), b.peers["10.0.0.1"] != nil)
+	}
+	if !b.dirty[failed.Address] || !b.dirty["seed.example.com"] {
+		t.Errorf("changes not marked for the store")
+	}
+	// only configured addresses left, nothing goes
+	b.peers = map[string]*knownPeer{}
+	for i := 0; i < maxKnown; i++ {
+		b.learn(fmt.Sprintf("10.3.%d.%d:6783", i/256, i%256), sourceConfig)
+	}
+	if b.learn("other.example.com", sourceSeed) != nil {
+		t.Errorf("configured address displaced")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	now := time.Now()
+	p := &knownPeer{Address: "10.0.0.1:6783", Failures: 2}
+	if !p.touch("aa:bb:cc:dd:ee:ff", "bob", now) || p.Failures != 0 {
+		t.Errorf("first connection not saved %+v", p)
+	}
+	if p.touch("aa:bb:cc:dd:ee:ff", "bob", now.Add(time.Minute)) {
+		t.Errorf("same connection saved again")
+	}
+	if !p.touch("aa:bb:cc:dd:ee:ff", "eve", now.Add(2*time.Minute)) {
+		t.Errorf("new nickname not saved")
+	}
+	if !p.touch("", "", now.Add(2*touchEvery)) || p.NickName != "eve" {
+		t.Errorf("stale connection time not saved %+v", p)
+	}
+}
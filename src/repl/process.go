@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"mfs"
 	"refshare"
 	//	"time"
 )
 
-// Process
-func Process(cluster *Cluster, peer *refshare.Peer, share *mfs.Share, interval int) {
+// Process : pass local changes to the mesh and apply the
+// updates from peers until ctx is done
+func Process(ctx context.Context, cluster *Cluster, peer *refshare.Peer, share *mfs.Share, interval int) {
 	//c := time.Tick(time.Duration(interval) * time.Second)
 	// get the channels from the constructs
 	shareUpdates := share.UpdateChannel()
@@ -22,18 +24,15 @@ func Process(cluster *Cluster, peer *refshare.Peer, share *mfs.Share, interval i
 			cluster.logger.Debug("SHARE UPDATE %v", shareupdate)
 			peer.Insert(shareupdate.Path, shareupdate.NewHash)
 		case update := <-remoteUpdates:
-			// update the names
-			cluster.GetNames()
-			// convert to name from peerid
-			// only write active peers
-			val, ok := cluster.names[update.PeerName]
-			if ok {
-				update.PeerName = val
-				cluster.logger.Debug("INCOMING UPDATE %v", update)
-				share.SubmitUpdate(update)
-			}
+			// updates are signed and keyed by finger print,
+			// so the publisher does not need to be connected
+			cluster.logger.Debug("INCOMING UPDATE %v", update)
+			share.SubmitUpdate(update)
 			//share.Mkdir("/"+update.Path+"/"+update.PeerName, true)
 			cluster.logger.Debug("UPDATE FINISHED")
+		case <-ctx.Done():
+			cluster.logger.Info("Main Loop stopped")
+			return
 		}
 	}
 }
@@ -0,0 +1,288 @@
+package main
+
+// reload the config on SIGHUP or from the control api, what can
+// change live is applied and the rest waits for a restart
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+
+	"keys"
+	"mfs"
+)
+
+// reloader applies config changes to the running daemon,
+// ring and share are nil when refs are not shared
+type reloader struct {
+	lock    sync.Mutex
+	path    string
+	ov      []override // the environment and flags at start
+	running *Config
+	cluster *Cluster
+	store   *keys.KeyStore
+	ring    *keyring
+	share   *mfs.Share
+	book    *peerBook
+	ctl     *control
+}
+
+// reload : read the config again and apply what changed,
+// a config that does not load or validate changes nothing
+func (rl *reloader) reload() (changes []string, err error) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	c, err := readConfigWith(rl.path, rl.ov)
+	if err != nil {
+		return nil, err
+	}
+	old := rl.running
+	changes = append(changes, rl.peers(old, c)...)
+	changes = append(changes, rl.seeds(old, c)...)
+	changes = append(changes, rl.shares(old, c)...)
+	changes = append(changes, remotes(old, c)...)
+	changes = append(changes, rl.keys(old, c)...)
+	for _, name := range keepRestartOnly(old, c) {
+		logger.Warningf("Config %s changed, restart to apply", name)
+	}
+	for _, ch := range changes {
+		logger.Infof("Config %s", ch)
+	}
+	if len(changes) == 0 {
+		logger.Info("Config unchanged")
+	}
+	rl.running = c
+	rl.ctl.setConfig(c)
+	return changes, nil
+}
+
+// hangups : reload on each SIGHUP until ctx is done
+func (rl *reloader) hangups(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("SIGHUP, reloading config")
+			if _, err := rl.reload(); err != nil {
+				logger.Errorf("Config reload %v", err)
+			}
+		}
+	}
+}
+
+func (rl *reloader) peers(old, c *Config) (changes []string) {
+	added, removed := diffList(old.Peers, c.Peers)
+	for _, addr := range added {
+		if err := rl.cluster.Connect(addr); err != nil {
+			logger.Errorf("Peer %s %v", addr, err)
+		}
+		changes = append(changes, "peer "+addr+" added")
+	}
+	for _, addr := range removed {
+		rl.cluster.Forget(addr)
+		changes = append(changes, "peer "+addr+" removed")
+	}
+	return changes
+}
+
+// seeds : the new seeds are looked up at once
+func (rl *reloader) seeds(old, c *Config) (changes []string) {
+	if old.SeedFile != c.SeedFile {
+		changes = append(changes, fmt.Sprintf("SeedFile %q to %q", old.SeedFile, c.SeedFile))
+	}
+	added, removed := diffList(old.SeedDNS, c.SeedDNS)
+	for _, name := range added {
+		changes = append(changes, "seed dns "+name+" added")
+	}
+	for _, name := range removed {
+		changes = append(changes, "seed dns "+name+" removed")
+	}
+	if len(changes) > 0 && rl.book != nil {
+		rl.book.setSeeds(c.SeedFile, c.SeedDNS)
+		go rl.book.resolveSeeds()
+	}
+	return changes
+}
+
+func (rl *reloader) shares(old, c *Config) (changes []string) {
+	for _, name := range sortedShares(c.Shares) {
+		s := c.Shares[name]
+		was, ok := old.Shares[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("share %s added, source %q", name, s.Source))
+		case was.Source != s.Source:
+			changes = append(changes, fmt.Sprintf("share %s source %q to %q", name, was.Source, s.Source))
+		default:
+			continue
+		}
+		if rl.share != nil {
+			if err := rl.share.AddShare(name, s.Source); err != nil {
+				logger.Errorf("Share %q %v", name, err)
+			}
+		}
+	}
+	for _, name := range sortedShares(old.Shares) {
+		if _, ok := c.Shares[name]; ok {
+			continue
+		}
+		if rl.share != nil {
+			rl.share.RemoveShare(name)
+		}
+		changes = append(changes, "share "+name+" removed")
+	}
+	return changes
+}
+
+// remotes : only recorded, nothing acts on them yet
+func remotes(old, c *Config) (changes []string) {
+	names := make(map[string]bool)
+	for name := range old.Remotes {
+		names[name] = true
+	}
+	for name := range c.Remotes {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		was, now := old.Remotes[name], c.Remotes[name]
+		switch {
+		case was == nil:
+			changes = append(changes, "remote "+name+" added")
+		case now == nil:
+			changes = append(changes, "remote "+name+" removed")
+		case *was != *now:
+			changes = append(changes, fmt.Sprintf("remote %s pin %v replicate %v", name, now.Pin, now.Replicate))
+		}
+	}
+	return changes
+}
+
+func (rl *reloader) keys(old, c *Config) (changes []string) {
+	added, removed := diffList(old.Admins, c.Admins)
+	for _, fp := range added {
+		changes = append(changes, "admin "+fp+" added")
+	}
+	for _, fp := range removed {
+		changes = append(changes, "admin "+fp+" removed")
+	}
+	if len(added)+len(removed) > 0 {
+		rl.store.SetAdmins(c.Admins)
+	}
+	added, removed = diffList(old.Anchors, c.Anchors)
+	for _, fp := range added {
+		changes = append(changes, "anchor "+fp+" added")
+	}
+	for _, fp := range removed {
+		changes = append(changes, "anchor "+fp+" removed")
+	}
+	if len(added)+len(removed) > 0 {
+		rl.store.SetAnchors(c.Anchors)
+	}
+	was, _ := keys.ParseTrust(old.MinTrust)
+	now, _ := keys.ParseTrust(c.MinTrust)
+	if was != now {
+		if rl.ring != nil {
+			rl.ring.SetMinTrust(now)
+		}
+		changes = append(changes, fmt.Sprintf("MinTrust %s to %s", was, now))
+	}
+	if pol := admission(c); pol != admission(old) {
+		rl.store.SetPolicy(pol)
+		changes = append(changes, fmt.Sprintf("Admission %+v", pol))
+	}
+	return changes
+}
+
+// admission : the policy the config asks for
+func admission(c *Config) keys.Policy {
+	if c.Admission == nil {
+		return keys.DefaultPolicy()
+	}
+	return *c.Admission
+}
+
+// keepRestartOnly : put back the fields only read at start,
+// returning the names of those that differ
+func keepRestartOnly(old, c *Config) (names []string) {
+	fields := []struct {
+		name     string
+		was, now *string
+	}{
+		{"Listen", &old.Listen, &c.Listen},
+		{"Nickname", &old.Nickname, &c.Nickname},
+		{"PeerID", &old.PeerID, &c.PeerID},
+		{"Password", &old.Password, &c.Password},
+		{"PasswordFile", &old.PasswordFile, &c.PasswordFile},
+		{"Channel", &old.Channel, &c.Channel},
+		{"KeysetCID", &old.KeysetCID, &c.KeysetCID},
+		{"Control", &old.Control, &c.Control},
+		{"ControlToken", &old.ControlToken, &c.ControlToken},
+		{"Dashboard", &old.Dashboard, &c.Dashboard},
+		{"Metrics", &old.Metrics, &c.Metrics},
+		{"PeerStore", &old.PeerStore, &c.PeerStore},
+	}
+	for _, f := range fields {
+		if *f.was != *f.now {
+			names = append(names, f.name)
+			*f.now = *f.was
+		}
+	}
+	if old.Discovery != c.Discovery {
+		names = append(names, "Discovery")
+		c.Discovery = old.Discovery
+	}
+	// the share path is only read at start, the source goes live
+	for _, name := range sortedShares(c.Shares) {
+		was, ok := old.Shares[name]
+		if now := c.Shares[name]; ok && was.Path != now.Path {
+			names = append(names, "Shares."+name+".Path")
+			now.Path = was.Path
+		}
+	}
+	return names
+}
+
+// diffList : what is in now but not was, and in was but not now
+func diffList(was, now []string) (added, removed []string) {
+	in := func(list []string) map[string]bool {
+		m := make(map[string]bool, len(list))
+		for _, s := range list {
+			m[s] = true
+		}
+		return m
+	}
+	wasSet, nowSet := in(was), in(now)
+	for _, s := range now {
+		if !wasSet[s] {
+			added = append(added, s)
+			wasSet[s] = true
+		}
+	}
+	for _, s := range was {
+		if !nowSet[s] {
+			removed = append(removed, s)
+			nowSet[s] = true
+		}
+	}
+	return added, removed
+}
+
+func sortedShares(shares map[string]*mfs.Share) (names []string) {
+	for name := range shares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
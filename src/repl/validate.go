@@ -0,0 +1,245 @@
+package main
+
+// checks on every config field, errors carry the key and the
+// line of the file it is on
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+	"keys"
+	"mfs"
+)
+
+const maxNickname = 255 // as a key claim allows
+
+var (
+	ErrUnknownKey   = errors.New("Unknown key")
+	ErrBadPort      = errors.New("Bad port")
+	ErrDuplicate    = errors.New("Listed twice")
+	ErrEmpty        = errors.New("Can not be empty")
+	ErrTooLong      = errors.New("Too long")
+	ErrBadMfsPath   = errors.New("Not an absolute clean mfs path")
+	ErrBadChannel   = errors.New("Bad channel name")
+	ErrChannelTaken = errors.New("Channel is used by the key gossip")
+	ErrBadSeedName  = errors.New("Bad dns name")
+	ErrNoHost       = errors.New("Needs a host")
+)
+
+// channels are named like shares, keybase is taken
+var channelName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ConfigError is a problem with one key of the config file,
+// Line is 0 when the key is not in the file
+type ConfigError struct {
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	msg := e.Err.Error()
+	if e.Key != "" {
+		msg = e.Key + " " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d, %s", e.Line, msg)
+	}
+	return msg
+}
+
+// ConfigErrors is every problem found in a config
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// the parser reports "Near line N (last key parsed 'K'): msg"
+var nearLine = regexp.MustCompile(`^Near line (\d+) \(last key parsed '([^']*)'\): (.*)$`)
+
+// parseError : a toml parse error as a ConfigError
+func parseError(err error) error {
+	m := nearLine.FindStringSubmatch(err.Error())
+	if m == nil {
+		return &ConfigError{Err: err}
+	}
+	line, _ := strconv.Atoi(m[1])
+	return &ConfigError{Line: line, Key: m[2], Err: errors.New(m[3])}
+}
+
+// keyLine : the line key is set on, or its table starts on
+func keyLine(data []byte, key string) int {
+	if key == "" {
+		return 0
+	}
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		full := ""
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if end := strings.Index(line, "]"); end > 0 {
+				table = strings.Replace(strings.Trim(line[:end], "[ "), `"`, "", -1)
+				full = table
+			}
+		default:
+			eq := strings.Index(line, "=")
+			if eq <= 0 {
+				continue
+			}
+			full = strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+			if table != "" {
+				full = table + "." + full
+			}
+		}
+		if full == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// check : every problem with the config
+func (c *Config) check() (errs ConfigErrors) {
+	bad := func(key string, err error) {
+		errs = append(errs, &ConfigError{Key: key, Err: err})
+	}
+	if err := hostPort(c.Listen); err != nil {
+		bad("Listen", err)
+	}
+	switch {
+	case c.Nickname == "":
+		bad("Nickname", ErrEmpty)
+	case len(c.Nickname) > maxNickname:
+		bad("Nickname", ErrTooLong)
+	}
+	seen := make(map[string]bool)
+	for _, p := range c.Peers {
+		if err := peerAddr(p); err != nil {
+			bad("Peers", fmt.Errorf("%q %v", p, err))
+		} else if seen[p] {
+			bad("Peers", fmt.Errorf("%q %v", p, ErrDuplicate))
+		}
+		seen[p] = true
+	}
+	for _, name := range sortedShares(c.Shares) {
+		key := "Shares." + name
+		if err := mfs.ValidName(name); err != nil {
+			bad(key, err)
+			continue
+		}
+		s := c.Shares[name]
+		if s == nil {
+			continue
+		}
+		if !mfsPath(s.Path) {
+			bad(key+".Path", fmt.Errorf("%q %v", s.Path, ErrBadMfsPath))
+		}
+		if s.Source != "" && !mfsPath(s.Source) {
+			bad(key+".Source", fmt.Errorf("%q %v", s.Source, ErrBadMfsPath))
+		}
+	}
+	if c.PeerID != "" {
+		if _, err := mesh.PeerNameFromString(c.PeerID); err != nil {
+			bad("PeerID", err)
+		}
+	}
+	switch {
+	case !channelName.MatchString(c.Channel):
+		bad("Channel", fmt.Errorf("%q %v", c.Channel, ErrBadChannel))
+	case c.Channel == keyChannel:
+		bad("Channel", ErrChannelTaken)
+	}
+	for _, fp := range c.Admins {
+		if err := keys.ValidFingerPrint(fp); err != nil {
+			bad("Admins", fmt.Errorf("%q %v", fp, err))
+		}
+	}
+	for _, fp := range c.Anchors {
+		if err := keys.ValidFingerPrint(fp); err != nil {
+			bad("Anchors", fmt.Errorf("%q %v", fp, err))
+		}
+	}
+	if _, err := keys.ParseTrust(c.MinTrust); err != nil {
+		bad("MinTrust", fmt.Errorf("%q %v", c.MinTrust, err))
+	}
+	if c.KeysetCID != "" {
+		if err := mfs.ValidHash(c.KeysetCID); err != nil {
+			bad("KeysetCID", err)
+		}
+	}
+	if c.Admission != nil {
+		if err := c.Admission.Valid(); err != nil {
+			bad("Admission", err)
+		}
+	}
+	if _, addr, err := c.controlAddr(); err != nil && err != ErrControlOff {
+		bad("Control", err)
+	} else if err == nil && addr == "" {
+		bad("Control", ErrEmpty)
+	}
+	if c.Dashboard != "" {
+		if err := loopback(c.Dashboard); err != nil {
+			bad("Dashboard", err)
+		}
+	}
+	if c.Metrics != "" {
+		if err := hostPort(c.Metrics); err != nil {
+			bad("Metrics", err)
+		}
+	}
+	for _, name := range c.SeedDNS {
+		if name == "" || strings.ContainsAny(name, " ,") {
+			bad("SeedDNS", fmt.Errorf("%q %v", name, ErrBadSeedName))
+		}
+	}
+	return errs
+}
+
+// hostPort : an address to listen on or dial, the host may be empty
+func hostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return ErrBadPort
+	}
+	return nil
+}
+
+// peerAddr : a peer to dial as the mesh takes it, host[:port]
+// with the port defaulting to the mesh port
+func peerAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	switch {
+	case err != nil && strings.Contains(addr, ":"):
+		return err
+	case err != nil:
+		host = addr
+	default:
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return ErrBadPort
+		}
+	}
+	if host == "" {
+		return ErrNoHost
+	}
+	return nil
+}
+
+func mfsPath(p string) bool {
+	return strings.HasPrefix(p, "/") && path.Clean(p) == p
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPeerAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"10.0.0.2:6783", true},
+		{"10.0.0.2", true}, // the mesh port
+		{"peer.example.com", true},
+		{"[::1]:6783", true},
+		{":6783", false},
+		{"", false},
+		{"10.0.0.2:0", false},
+		{"10.0.0.2:http", false},
+		{"::1", false},
+	} {
+		if err := peerAddr(tc.addr); (err == nil) != tc.ok {
+			t.Errorf("peerAddr(%q) = %v", tc.addr, err)
+		}
+	}
+}
+
+func TestKeyLine(t *testing.T) {
+	data := []byte(`# a comment
+Nickname = "bob"
+
+[Shares.music]
+  Path = "/music"
+
+[Admission]
+  Rate = 2.0
+`)
+	for key, line := range map[string]int{
+		"Nickname":          2,
+		"Shares.music":      4,
+		"Shares.music.Path": 5,
+		"Admission.Rate":    8,
+		"Listen":            0,
+		"":                  0,
+	} {
+		if got := keyLine(data, key); got != line {
+			t.Errorf("keyLine(%q) = %d, want %d", key, got, line)
+		}
+	}
+}